@@ -2,6 +2,7 @@
 package adminserver
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
 )
@@ -45,17 +46,44 @@ func processHeaderCommands() {
 }
 
 func RouteAdminCall(response http.ResponseWriter, request *http.Request) {
-	if strings.HasPrefix(request.URL.Path, "/headers") {
+	if matchesRoute(request.URL.Path, "/headers") {
 		switch request.Method {
 		case "GET":
 			returnDefaultHeaders(response, request)
 		case "POST":
+			// posted headers are added to the defaults rather than replacing them
+			mergeCurrentHeaders(request)
 			updateDefaultHeaders(response, request)
 		case "DELETE":
 			clearDefaultHeaders(response, request)
 		default:
 			response.WriteHeader(http.StatusMethodNotAllowed)
 		}
+	} else if matchesRoute(request.URL.Path, "/cassettes") {
+		routeCassetteCall(response, request)
+	} else if matchesRoute(request.URL.Path, "/hosts") {
+		routeHostCall(response, request)
+	} else if matchesRoute(request.URL.Path, "/tcp") {
+		routeTCPProxyCall(response, request)
+	} else if matchesRoute(request.URL.Path, "/pools") {
+		routePoolCall(response, request)
+	} else {
+		response.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// matchesRoute checks that path is route or something under it, so that /hosts/example.com matches
+// /hosts but /hostsx doesn't
+func matchesRoute(path string, route string) bool {
+	return path == route || strings.HasPrefix(path, route+"/")
+}
+
+// mergeCurrentHeaders adds the default headers to request, unless it already has them
+func mergeCurrentHeaders(request *http.Request) {
+	for key, value := range GetCurrentHeaders() {
+		if _, found := request.Header[key]; !found {
+			request.Header[key] = value
+		}
 	}
 }
 
@@ -96,3 +124,14 @@ func sendHeaderCommand(response http.ResponseWriter, request *http.Request, mess
 		response.Header()[key] = value
 	}
 }
+
+// writeJSON sends value as the JSON body of response
+func writeJSON(response http.ResponseWriter, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(encoded)
+}
@@ -1,6 +1,7 @@
 package adminserver
 
 import (
+	"net/http"
 	"net/http/httptest"
 	"testing"
 )
@@ -55,6 +56,22 @@ func TestGetDefaultHeaders(test *testing.T) {
 	}
 }
 
+func TestPostedHeadersAddToDefaults(test *testing.T) {
+	resetDefaultHeaders()
+	defer resetDefaultHeaders()
+
+	for _, header := range []string{"X-Generate-Random", "X-Add-Noise"} {
+		request := httptest.NewRequest("POST", "/headers", nil)
+		request.Header.Set(header, "10")
+		RouteAdminCall(httptest.NewRecorder(), request)
+	}
+
+	headers := http.Header(GetCurrentHeaders())
+	if headers.Get("X-Generate-Random") != "10" || headers.Get("X-Add-Noise") != "10" {
+		test.Errorf("Expected both posts to be kept, got %v", headers)
+	}
+}
+
 func resetDefaultHeaders() {
 	request := httptest.NewRequest("POST", "/headers", nil)
 	response := httptest.NewRecorder()
@@ -0,0 +1,66 @@
+package adminserver
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"bad-server/badness"
+)
+
+// routeCassetteCall handles /cassettes (list them all) and /cassettes/{name} (export or delete one)
+func routeCassetteCall(response http.ResponseWriter, request *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(request.URL.Path, "/cassettes"), "/")
+	if strings.Contains(name, "/") {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case name == "" && request.Method == "GET":
+		listCassettes(response)
+	case name != "" && request.Method == "GET":
+		exportCassette(response, name)
+	case name != "" && request.Method == "DELETE":
+		deleteCassette(response, name)
+	default:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func listCassettes(response http.ResponseWriter) {
+	names, err := badness.ListCassettes()
+	if err != nil {
+		writeCassetteError(response, err)
+		return
+	}
+	writeJSON(response, names)
+}
+
+func exportCassette(response http.ResponseWriter, name string) {
+	encoded, err := badness.ExportCassette(name)
+	if err != nil {
+		writeCassetteError(response, err)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Content-Disposition", "attachment; filename=\""+name+".json\"")
+	response.Write(encoded)
+}
+
+func deleteCassette(response http.ResponseWriter, name string) {
+	if err := badness.DeleteCassette(name); err != nil {
+		writeCassetteError(response, err)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func writeCassetteError(response http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		response.WriteHeader(http.StatusNotFound)
+	} else {
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+	response.Write([]byte(err.Error()))
+}
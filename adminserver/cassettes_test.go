@@ -0,0 +1,54 @@
+package adminserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bad-server/badness"
+)
+
+func TestCassetteRoutes(test *testing.T) {
+	directory, err := ioutil.TempDir("", "cassettes")
+	if err != nil {
+		test.Fatalf("Could not create cassette directory: %v", err)
+	}
+	defer os.RemoveAll(directory)
+	config := badness.DefaultProxyConfig()
+	config.CassetteDir = directory
+	badness.ConfigureProxy(config)
+	defer badness.ConfigureProxy(badness.DefaultProxyConfig())
+
+	os.MkdirAll(filepath.Join(directory, "recorded"), 0755)
+	ioutil.WriteFile(filepath.Join(directory, "recorded", "abc.json"), []byte(`{"request":{},"response":{}}`), 0644)
+
+	call := func(method, path string) *http.Response {
+		recorder := httptest.NewRecorder()
+		RouteAdminCall(recorder, httptest.NewRequest(method, path, nil))
+		return recorder.Result()
+	}
+
+	body, _ := ioutil.ReadAll(call("GET", "/cassettes").Body)
+	if string(body) != `["recorded"]` {
+		test.Errorf("Unexpected cassette list %s", body)
+	}
+
+	response := call("GET", "/cassettes/recorded")
+	body, _ = ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != `[{"request":{},"response":{}}]` {
+		test.Errorf("Unexpected export %d %s", response.StatusCode, body)
+	}
+
+	if response := call("DELETE", "/cassettes/recorded"); response.StatusCode != http.StatusNoContent {
+		test.Errorf("Expected the delete to succeed, got %d", response.StatusCode)
+	}
+	if response := call("GET", "/cassettes/recorded"); response.StatusCode != http.StatusNotFound {
+		test.Errorf("Expected a deleted cassette to be gone, got %d", response.StatusCode)
+	}
+	if response := call("POST", "/cassettes"); response.StatusCode != http.StatusMethodNotAllowed {
+		test.Errorf("Expected POST to be rejected, got %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,93 @@
+package adminserver
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hostMessage updates or reads the headers that are applied to forward proxy traffic for a host
+type hostMessage struct {
+	host          string
+	headers       http.Header
+	returnChannel chan map[string]http.Header
+	adminMessage
+}
+
+var hostCommands = make(chan hostMessage)
+var hostHeaders = make(map[string]http.Header)
+
+func init() {
+	go processHostCommands()
+}
+
+func processHostCommands() {
+	for command := range hostCommands {
+		switch command.messageType {
+		case update:
+			hostHeaders[command.host] = command.headers
+		case clear:
+			delete(hostHeaders, command.host)
+		}
+
+		// hand back a copy, since the map keeps changing after this
+		allHeaders := make(map[string]http.Header, len(hostHeaders))
+		for host, headers := range hostHeaders {
+			allHeaders[host] = headers
+		}
+		command.returnChannel <- allHeaders
+	}
+}
+
+func sendHostCommand(host string, headers http.Header, messageType command) map[string]http.Header {
+	returnChan := make(chan map[string]http.Header, 1)
+	defer close(returnChan)
+	hostCommands <- hostMessage{host, headers, returnChan, adminMessage{messageType}}
+	return <-returnChan
+}
+
+// GetHostHeaders returns the headers that apply to traffic for host, which may include a port.
+// Rules for a host and port take precedence over rules for just the host
+func GetHostHeaders(host string) http.Header {
+	allHeaders := sendHostCommand("", nil, get)
+	if headers, found := allHeaders[strings.ToLower(host)]; found {
+		return headers
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		if headers, found := allHeaders[strings.ToLower(hostname)]; found {
+			return headers
+		}
+	}
+	return http.Header{}
+}
+
+// routeHostCall handles /hosts (list every host's rules) and /hosts/{host}
+func routeHostCall(response http.ResponseWriter, request *http.Request) {
+	host := strings.ToLower(strings.Trim(strings.TrimPrefix(request.URL.Path, "/hosts"), "/"))
+
+	switch {
+	case host == "" && request.Method == "GET":
+		writeJSON(response, sendHostCommand("", nil, get))
+	case host != "" && request.Method == "GET":
+		writeHostHeaders(response, sendHostCommand("", nil, get)[host])
+	case host != "" && request.Method == "POST":
+		// only bad-server's own headers make sense as rules
+		headers := make(http.Header)
+		for key, values := range request.Header {
+			if strings.HasPrefix(key, "X-") {
+				headers[key] = values
+			}
+		}
+		writeHostHeaders(response, sendHostCommand(host, headers, update)[host])
+	case host != "" && request.Method == "DELETE":
+		sendHostCommand(host, nil, clear)
+	default:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeHostHeaders(response http.ResponseWriter, headers http.Header) {
+	for key, value := range headers {
+		response.Header()[key] = value
+	}
+}
@@ -0,0 +1,57 @@
+package adminserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostRules(test *testing.T) {
+	request := httptest.NewRequest("POST", "/hosts/Example.com", nil)
+	request.Header.Set("X-Connection-Faults", "refuse")
+	request.Header.Set("User-Agent", "test")
+	recorder := httptest.NewRecorder()
+	RouteAdminCall(recorder, request)
+
+	if recorder.Result().Header.Get("X-Connection-Faults") != "refuse" {
+		test.Errorf("Expected the rule to be echoed back, got %v", recorder.Result().Header)
+	}
+
+	headers := GetHostHeaders("example.com:443")
+	if headers.Get("X-Connection-Faults") != "refuse" {
+		test.Errorf("Expected the host's rules to apply to any port, got %v", headers)
+	}
+	if headers.Get("User-Agent") != "" {
+		test.Errorf("Expected only X- headers to be kept, got %v", headers)
+	}
+	if len(GetHostHeaders("other.com")) != 0 {
+		test.Errorf("Expected no rules for another host")
+	}
+
+	recorder = httptest.NewRecorder()
+	RouteAdminCall(recorder, httptest.NewRequest("DELETE", "/hosts/example.com", nil))
+	if len(GetHostHeaders("example.com")) != 0 {
+		test.Errorf("Expected the rules to be deleted")
+	}
+
+	recorder = httptest.NewRecorder()
+	RouteAdminCall(recorder, httptest.NewRequest("PUT", "/hosts/example.com", nil))
+	if recorder.Result().StatusCode != http.StatusMethodNotAllowed {
+		test.Errorf("Expected PUT to be rejected, got %d", recorder.Result().StatusCode)
+	}
+}
+
+func TestHostRoutesMatchExactly(test *testing.T) {
+	for _, path := range []string{"/hostsx", "/hostsx/example.com", "/tcpx"} {
+		request := httptest.NewRequest("POST", path, nil)
+		request.Header.Set("X-Connection-Faults", "refuse")
+		recorder := httptest.NewRecorder()
+		RouteAdminCall(recorder, request)
+		if recorder.Result().StatusCode != http.StatusNotFound {
+			test.Errorf("Expected %s to be unknown, got %d", path, recorder.Result().StatusCode)
+		}
+	}
+	if hosts := sendHostCommand("", nil, get); len(hosts) != 0 {
+		test.Errorf("Expected no rules to be set, got %v", hosts)
+	}
+}
@@ -0,0 +1,49 @@
+package adminserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"bad-server/badness"
+)
+
+// routePoolCall handles /pools (list every pool) and /pools/{name} (set up, inspect or remove one)
+func routePoolCall(response http.ResponseWriter, request *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(request.URL.Path, "/pools"), "/")
+
+	switch {
+	case name == "" && request.Method == "GET":
+		writeJSON(response, badness.ListPools())
+	case name != "" && request.Method == "GET":
+		status, found := badness.GetPool(name)
+		if !found {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(response, status)
+	case name != "" && request.Method == "POST":
+		var config badness.PoolConfig
+		if err := json.NewDecoder(request.Body).Decode(&config); err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write([]byte(err.Error()))
+			return
+		}
+		if err := badness.SetPool(name, config); err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write([]byte(err.Error()))
+			return
+		}
+		status, _ := badness.GetPool(name)
+		writeJSON(response, status)
+	case name != "" && request.Method == "DELETE":
+		if err := badness.DeletePool(name); err != nil {
+			response.WriteHeader(http.StatusNotFound)
+			response.Write([]byte(err.Error()))
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,47 @@
+package adminserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bad-server/badness"
+)
+
+func TestPoolRoutes(test *testing.T) {
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		RouteAdminCall(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+
+	recorder := call("POST", "/pools/api", `{"balance": "random", "members": [{"url": "http://localhost:1"}, {"url": "http://localhost:2", "headers": {"X-Pause-Before-Response-Start": ["2000"]}}]}`)
+	if recorder.Code != http.StatusOK {
+		test.Fatalf("Expected the pool to be set up, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	defer badness.DeletePool("api")
+
+	var status badness.PoolStatus
+	json.Unmarshal(call("GET", "/pools/api", "").Body.Bytes(), &status)
+	if status.Balance != "random" || len(status.Members) != 2 || !status.Members[1].Healthy {
+		test.Errorf("Unexpected pool status %+v", status)
+	}
+
+	var statuses []badness.PoolStatus
+	json.Unmarshal(call("GET", "/pools", "").Body.Bytes(), &statuses)
+	if len(statuses) != 1 {
+		test.Errorf("Expected one pool, got %v", statuses)
+	}
+
+	if recorder := call("POST", "/pools/api", `{"members": []}`); recorder.Code != http.StatusBadRequest {
+		test.Errorf("Expected an empty pool to be rejected, got %d", recorder.Code)
+	}
+	if recorder := call("DELETE", "/pools/api", ""); recorder.Code != http.StatusNoContent {
+		test.Errorf("Expected the pool to be deleted, got %d", recorder.Code)
+	}
+	if recorder := call("GET", "/pools/api", ""); recorder.Code != http.StatusNotFound {
+		test.Errorf("Expected the pool to be gone, got %d", recorder.Code)
+	}
+}
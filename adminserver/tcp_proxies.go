@@ -0,0 +1,60 @@
+package adminserver
+
+import (
+	"net/http"
+	"strings"
+
+	"bad-server/badness"
+)
+
+// the headers used to set up a new TCP proxy
+const tcpListenHeader = "X-Tcp-Listen"
+const tcpTargetHeader = "X-Tcp-Target"
+
+// routeTCPProxyCall handles /tcp (list every proxy) and /tcp/{name} (start, update, inspect or stop one)
+func routeTCPProxyCall(response http.ResponseWriter, request *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(request.URL.Path, "/tcp"), "/")
+
+	switch {
+	case name == "" && request.Method == "GET":
+		writeJSON(response, badness.ListTCPProxies())
+	case name != "" && request.Method == "GET":
+		proxy := badness.GetTCPProxy(name)
+		if proxy == nil {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(response, proxy.Status())
+	case name != "" && request.Method == "POST":
+		updateTCPProxy(response, request, name)
+	case name != "" && request.Method == "DELETE":
+		if err := badness.StopTCPProxy(name); err != nil {
+			response.WriteHeader(http.StatusNotFound)
+			response.Write([]byte(err.Error()))
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// updateTCPProxy starts the named proxy, or replaces its faults if it's already running
+func updateTCPProxy(response http.ResponseWriter, request *http.Request, name string) {
+	faults := request.Header[badness.ConnectionFaults]
+
+	proxy := badness.GetTCPProxy(name)
+	var err error
+	if proxy != nil {
+		err = proxy.SetFaults(faults)
+	} else {
+		proxy, err = badness.StartTCPProxy(name, request.Header.Get(tcpListenHeader), request.Header.Get(tcpTargetHeader), faults)
+	}
+
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(response, proxy.Status())
+}
@@ -0,0 +1,57 @@
+package adminserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bad-server/badness"
+)
+
+func TestTCPProxyRoutes(test *testing.T) {
+	call := func(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		for header, value := range headers {
+			request.Header.Set(header, value)
+		}
+		recorder := httptest.NewRecorder()
+		RouteAdminCall(recorder, request)
+		return recorder
+	}
+
+	recorder := call("POST", "/tcp/cache", map[string]string{
+		tcpListenHeader:          "127.0.0.1:0",
+		tcpTargetHeader:          "127.0.0.1:1",
+		badness.ConnectionFaults: "latency=10ms",
+	})
+	if recorder.Code != http.StatusOK {
+		test.Fatalf("Expected the proxy to start, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	defer badness.StopTCPProxy("cache")
+
+	// posting again changes the faults of the running proxy
+	call("POST", "/tcp/cache", map[string]string{badness.ConnectionFaults: "reset"})
+	var status badness.TCPProxyStatus
+	json.Unmarshal(call("GET", "/tcp/cache", nil).Body.Bytes(), &status)
+	if status.Target != "127.0.0.1:1" || len(status.Faults) != 1 || status.Faults[0] != "reset" {
+		test.Errorf("Unexpected status %+v", status)
+	}
+
+	if recorder := call("POST", "/tcp/cache", map[string]string{badness.ConnectionFaults: "explode"}); recorder.Code != http.StatusBadRequest {
+		test.Errorf("Expected bad faults to be rejected, got %d", recorder.Code)
+	}
+
+	var statuses []badness.TCPProxyStatus
+	json.Unmarshal(call("GET", "/tcp", nil).Body.Bytes(), &statuses)
+	if len(statuses) != 1 {
+		test.Errorf("Expected one proxy, got %v", statuses)
+	}
+
+	if recorder := call("DELETE", "/tcp/cache", nil); recorder.Code != http.StatusNoContent {
+		test.Errorf("Expected the proxy to stop, got %d", recorder.Code)
+	}
+	if recorder := call("GET", "/tcp/cache", nil); recorder.Code != http.StatusNotFound {
+		test.Errorf("Expected the proxy to be gone, got %d", recorder.Code)
+	}
+}
@@ -2,6 +2,7 @@ package badness
 
 // Functions for getting Readers that generate response bodies
 import (
+	"errors"
 	"io"
 	"math/rand"
 	"net/http"
@@ -9,28 +10,55 @@ import (
 
 const RequestBodyIsResponse = "X-Request-Body-As-Response"
 
+// errAbortResponse can be returned by a body generator to cut the client off mid-response
+// rather than finishing it cleanly
+var errAbortResponse = errors.New("response aborted")
+
 func buildBodyGenerator(generator io.Reader) ResponseHandler {
+	return func(response http.ResponseWriter) error {
+		return writeGeneratorToResponse(generator, response, false)
+	}
+}
 
+// buildStreamingBodyGenerator is like buildBodyGenerator, but flushes each chunk to the client
+// as soon as it's read, for bodies that are meant to be consumed as they arrive
+func buildStreamingBodyGenerator(generator io.Reader) ResponseHandler {
 	return func(response http.ResponseWriter) error {
-		buf := make([]byte, 1024)
+		return writeGeneratorToResponse(generator, response, true)
+	}
+}
 
-		bytesRead, readErr := generator.Read(buf)
-		for bytesRead > 0 {
-			// per go docs:
-			// Callers should always process the n > 0 bytes returned before considering the error err.
-			// Doing so correctly handles I/O errors that happen after reading some bytes and also both of the allowed EOF behaviors.
-			_, writeErr := response.Write(buf[0:bytesRead])
-			if readErr != nil {
-				return readErr
-			}
-			if writeErr != nil {
-				return writeErr
-			}
+func writeGeneratorToResponse(generator io.Reader, response http.ResponseWriter, flush bool) error {
+	buf := make([]byte, 1024)
+	flusher, canFlush := response.(http.Flusher)
 
-			bytesRead, readErr = generator.Read(buf)
+	bytesRead, readErr := generator.Read(buf)
+	for bytesRead > 0 {
+		// per go docs:
+		// Callers should always process the n > 0 bytes returned before considering the error err.
+		// Doing so correctly handles I/O errors that happen after reading some bytes and also both of the allowed EOF behaviors.
+		_, writeErr := response.Write(buf[0:bytesRead])
+		if flush && canFlush {
+			flusher.Flush()
 		}
-		return nil
+		if readErr != nil {
+			break
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+
+		bytesRead, readErr = generator.Read(buf)
+	}
+
+	if readErr == errAbortResponse {
+		// net/http closes the connection without finishing the response when it sees this
+		panic(http.ErrAbortHandler)
+	}
+	if readErr != nil && readErr != io.EOF {
+		return readErr
 	}
+	return nil
 }
 
 const GenerateRandomResponse = "X-Generate-Random"
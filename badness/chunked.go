@@ -0,0 +1,164 @@
+package badness
+
+// Chunked transfer-encoding faults. X-Chunked-Faults builds on raw responses to send
+// a chunked body whose framing is broken in the requested ways. Any X-Raw-Response
+// faults are applied to the status line and headers as well.
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const ChunkedFaults = "X-Chunked-Faults"
+
+type chunkedFaultSettings struct {
+	chunkSize     int
+	wrongSize     bool
+	invalidSize   bool
+	extensions    bool
+	noTerminator  bool
+	trailers      bool
+	contentLength bool
+}
+
+// parseChunkedFaultSettings reads the comma-separated faults in the X-Chunked-Faults header
+func parseChunkedFaultSettings(headerValues []string) (chunkedFaultSettings, error) {
+	settings := chunkedFaultSettings{chunkSize: 64}
+
+	for key, value := range parseHeadersWithKeyValues(headerValues, ",") {
+		key = strings.TrimSpace(key)
+		switch key {
+		case "":
+			continue
+		case "chunk-size":
+			size, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || size <= 0 {
+				return settings, fmt.Errorf("chunk-size must be a positive integer, got %s", value)
+			}
+			settings.chunkSize = size
+		case "wrong-size":
+			settings.wrongSize = true
+		case "invalid-size":
+			settings.invalidSize = true
+		case "extensions":
+			settings.extensions = true
+		case "no-terminator":
+			settings.noTerminator = true
+		case "trailers":
+			settings.trailers = true
+		case "content-length":
+			settings.contentLength = true
+		default:
+			return settings, fmt.Errorf("Unknown %s fault %s", ChunkedFaults, key)
+		}
+	}
+	return settings, nil
+}
+
+// chunkSizeLine builds the line that precedes each chunk
+func (settings chunkedFaultSettings) chunkSizeLine(size int) string {
+	declared := size
+	if settings.wrongSize {
+		// one byte short, so the client finds data where it expects a CRLF
+		declared = size - 1
+	}
+
+	sizeString := strconv.FormatInt(int64(declared), 16)
+	if settings.invalidSize {
+		// hex prefixes aren't allowed in chunk sizes
+		sizeString = "0x" + sizeString
+	}
+
+	if settings.extensions {
+		sizeString += `;bad-server=extension;quoted="a;b"`
+	}
+	return sizeString + "\r\n"
+}
+
+// writeChunkedBody copies body to writer as a chunked body with the requested faults
+func writeChunkedBody(writer io.Writer, body io.Reader, settings chunkedFaultSettings) error {
+	buffer := make([]byte, settings.chunkSize)
+	for {
+		bytesRead, readErr := io.ReadFull(body, buffer)
+		if bytesRead > 0 {
+			chunk := settings.chunkSizeLine(bytesRead) + string(buffer[0:bytesRead]) + "\r\n"
+			if _, err := writer.Write([]byte(chunk)); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	if settings.noTerminator {
+		return nil
+	}
+
+	terminator := "0\r\n"
+	if settings.trailers {
+		// redefine headers the client has already seen
+		terminator += "Content-Type: application/x-bad-server-trailer\r\n" +
+			"Content-Length: 0\r\n" +
+			"Content-Encoding: gzip\r\n"
+	}
+	terminator += "\r\n"
+	_, err := writer.Write([]byte(terminator))
+	return err
+}
+
+// buildChunkedResponseHandler returns a ResponseHandler that writes request's response
+// directly to the connection with a broken chunked body
+func buildChunkedResponseHandler(request *http.Request) ResponseHandler {
+	settings, err := parseChunkedFaultSettings(request.Header[ChunkedFaults])
+	if err != nil {
+		return generateBadResponseHandler(err.Error())
+	}
+
+	rawSettings, err := parseRawResponseSettings(request.Header[RawResponse])
+	if err != nil {
+		return generateBadResponseHandler(err.Error())
+	}
+
+	return func(response http.ResponseWriter) error {
+		captured := captureStatusAndHeaders(request)
+		body, err := generateRawBody(request, ChunkedFaults)
+		if err != nil {
+			return generateBadResponseHandler(fmt.Sprintf("Could not generate body: %v", err))(response)
+		}
+
+		captured.header.Set("Transfer-Encoding", "chunked")
+		if settings.contentLength {
+			captured.header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		if settings.trailers {
+			captured.header.Set("Trailer", "Content-Type, Content-Length, Content-Encoding")
+		}
+		if captured.header.Get("Connection") == "" {
+			captured.header.Set("Connection", "close")
+		}
+
+		affected, err := getResponseAffector(request, bytes.NewReader(body))
+		if err != nil {
+			return generateBadResponseHandler(fmt.Sprintf("Could not get affector: %v", err))(response)
+		}
+
+		conn, _, err := hijackConnection(response)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write(buildRawHead(rawSettings, captured.statusCode, captured.header)); err != nil {
+			return err
+		}
+		return writeChunkedBody(conn, affected, settings)
+	}
+}
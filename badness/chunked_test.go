@@ -0,0 +1,62 @@
+package badness
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseChunkedFaultSettings(test *testing.T) {
+	settings, err := parseChunkedFaultSettings([]string{"chunk-size=10,wrong-size", "trailers"})
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+	if settings.chunkSize != 10 || !settings.wrongSize || !settings.trailers || settings.noTerminator {
+		test.Errorf("Unexpected settings %v", settings)
+	}
+
+	for _, bad := range []string{"chunk-size=0", "chunk-size=x", "wobbly"} {
+		if _, err := parseChunkedFaultSettings([]string{bad}); err == nil {
+			test.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
+
+type chunkedBodyExpect struct {
+	settings chunkedFaultSettings
+	body     string
+	expected string
+}
+
+func TestWriteChunkedBody(test *testing.T) {
+	expectations := []chunkedBodyExpect{
+		chunkedBodyExpect{chunkedFaultSettings{chunkSize: 4}, "abcdefghij", "4\r\nabcd\r\n4\r\nefgh\r\n2\r\nij\r\n0\r\n\r\n"},
+		chunkedBodyExpect{chunkedFaultSettings{chunkSize: 16, wrongSize: true}, "abcdefghij", "9\r\nabcdefghij\r\n0\r\n\r\n"},
+		chunkedBodyExpect{chunkedFaultSettings{chunkSize: 16, invalidSize: true}, "abcdefghij", "0xa\r\nabcdefghij\r\n0\r\n\r\n"},
+		chunkedBodyExpect{chunkedFaultSettings{chunkSize: 16, extensions: true}, "abc", "3;bad-server=extension;quoted=\"a;b\"\r\nabc\r\n0\r\n\r\n"},
+		chunkedBodyExpect{chunkedFaultSettings{chunkSize: 16, noTerminator: true}, "abc", "3\r\nabc\r\n"},
+		chunkedBodyExpect{chunkedFaultSettings{chunkSize: 16, trailers: true}, "abc", "3\r\nabc\r\n0\r\nContent-Type: application/x-bad-server-trailer\r\nContent-Length: 0\r\nContent-Encoding: gzip\r\n\r\n"},
+	}
+
+	for index, expect := range expectations {
+		var output bytes.Buffer
+		if err := writeChunkedBody(&output, strings.NewReader(expect.body), expect.settings); err != nil {
+			test.Fatalf("Test %d: Unexpected error: %v", index, err)
+		}
+		if output.String() != expect.expected {
+			test.Errorf("Test %d: Expected %q but got %q", index, expect.expected, output.String())
+		}
+	}
+}
+
+func TestChunkedResponse(test *testing.T) {
+	server := newPipelineServer()
+	defer server.Close()
+
+	response := rawRequest(test, server.Listener.Addr().String(), ChunkedFaults+": content-length,chunk-size=2", RandomJson+": response_template=[int|1]:2", RawResponse+": http10")
+	for _, expected := range []string{"HTTP/1.0 200 OK\r\n", "Content-Length: 5\r\n", "Transfer-Encoding: chunked\r\n", "\r\n\r\n2\r\n[1\r\n2\r\n,1\r\n1\r\n]\r\n0\r\n\r\n"} {
+		if !strings.Contains(response, expected) {
+			test.Errorf("Expected %q in %q", expected, response)
+		}
+	}
+}
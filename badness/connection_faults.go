@@ -0,0 +1,263 @@
+package badness
+
+// Connection-level faults. These apply to raw byte streams, such as CONNECT tunnels, where
+// there's no HTTP response to damage, only the connection carrying it.
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ConnectionFaults = "X-Connection-Faults"
+
+// directionFaults are the faults applied to data going one way through a connection
+type directionFaults struct {
+	// delay before each chunk of data is passed along
+	latency time.Duration
+	// cap on the bytes per second. 0 is unlimited
+	bytesPerSecond int
+	// probability (0-1) of each byte being replaced with a random one
+	corruptProbability float64
+}
+
+type connectionFaultSettings struct {
+	// from the client to the upstream
+	upstream directionFaults
+	// from the upstream back to the client
+	downstream directionFaults
+	// reset the connection once this many bytes have been sent in one direction. 0 never resets
+	resetAfter int64
+	// probabilities (0-1) of resetting a connection as soon as it's established,
+	// or refusing to establish it at all
+	resetProbability  float64
+	refuseProbability float64
+	// wait this long before passing along that one side has closed the connection
+	slowClose time.Duration
+	// never pass along that one side has closed the connection
+	halfOpen bool
+}
+
+// parseConnectionFaultSettings reads the comma-separated key=value options in the X-Connection-Faults header.
+// percentages are passed in as 0-100, and reset or refuse on their own mean every connection.
+// latency, throttle and corrupt apply both ways, unless they're prefixed with upstream- or downstream-
+func parseConnectionFaultSettings(headerValues []string) (connectionFaultSettings, error) {
+	settings := connectionFaultSettings{}
+	options := parseHeadersWithKeyValues(headerValues, ",")
+
+	// options for both directions go first, so the ones for a single direction can override them
+	for _, forOneDirection := range []bool{false, true} {
+		for key, value := range options {
+			key = strings.TrimSpace(key)
+			value = strings.TrimSpace(value)
+
+			option := strings.TrimPrefix(strings.TrimPrefix(key, "upstream-"), "downstream-")
+			if (option != key) != forOneDirection {
+				continue
+			}
+			directions := []*directionFaults{&settings.upstream, &settings.downstream}
+			if strings.HasPrefix(key, "upstream-") {
+				directions = directions[0:1]
+			} else if strings.HasPrefix(key, "downstream-") {
+				directions = directions[1:2]
+			}
+
+			var err error
+			directional := false
+			switch option {
+			case "":
+				continue
+			case "latency":
+				directional = true
+				var latency time.Duration
+				latency, err = stringToDuration(value)
+				for _, direction := range directions {
+					direction.latency = latency
+				}
+			case "throttle":
+				directional = true
+				var bytesPerSecond int
+				bytesPerSecond, err = strconv.Atoi(value)
+				if err == nil && bytesPerSecond < 0 {
+					err = fmt.Errorf("must not be negative")
+				}
+				for _, direction := range directions {
+					direction.bytesPerSecond = bytesPerSecond
+				}
+			case "corrupt":
+				directional = true
+				var probability float64
+				probability, err = parsePercentage(value)
+				for _, direction := range directions {
+					direction.corruptProbability = probability
+				}
+			case "reset-after":
+				settings.resetAfter, err = strconv.ParseInt(value, 10, 64)
+			case "reset":
+				settings.resetProbability, err = parseOptionalPercentage(value)
+			case "refuse":
+				settings.refuseProbability, err = parseOptionalPercentage(value)
+			case "slow-close":
+				settings.slowClose, err = stringToDuration(value)
+			case "half-open":
+				settings.halfOpen = true
+			default:
+				err = fmt.Errorf("Unknown option")
+			}
+
+			if err == nil && forOneDirection && !directional {
+				err = fmt.Errorf("can't be set for one direction")
+			}
+			if err != nil {
+				return settings, fmt.Errorf("Invalid %s option %s=%s: %v", ConnectionFaults, key, value, err)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// parseOptionalPercentage is parsePercentage, except that no value at all means 100%
+func parseOptionalPercentage(value string) (float64, error) {
+	if value == "" {
+		return 1, nil
+	}
+	return parsePercentage(value)
+}
+
+// direction returns the faults for data going to the client if downstream is true, or to the upstream if not
+func (settings connectionFaultSettings) direction(downstream bool) directionFaults {
+	if downstream {
+		return settings.downstream
+	}
+	return settings.upstream
+}
+
+// shouldRefuse decides whether a new connection should be refused
+func (settings connectionFaultSettings) shouldRefuse() bool {
+	return rand.Float64() < settings.refuseProbability
+}
+
+// shouldReset decides whether a new connection should be reset straight away
+func (settings connectionFaultSettings) shouldReset() bool {
+	return rand.Float64() < settings.resetProbability
+}
+
+// errConnectionReset is returned by copyWithFaults when it reset the connection on purpose
+var errConnectionReset = fmt.Errorf("connection reset by bad-server")
+
+// copyWithFaults copies from source to destination until source runs out, applying latency,
+// throttling, corruption and resets along the way. current is checked before each chunk, so
+// the faults can change while the copy is running
+func copyWithFaults(destination io.Writer, source io.Reader, current func() connectionFaultSettings, downstream bool) error {
+	buffer := make([]byte, 32*1024)
+
+	var copied int64
+	for {
+		settings := current()
+		faults := settings.direction(downstream)
+		// reset-after can be lowered below what's already been copied while the copy is running
+		if settings.resetAfter > 0 && copied >= settings.resetAfter {
+			return errConnectionReset
+		}
+
+		chunkSize := len(buffer)
+		if faults.bytesPerSecond > 0 && faults.bytesPerSecond/10 < chunkSize {
+			// small enough chunks that the throttled rate is reasonably smooth
+			chunkSize = faults.bytesPerSecond/10 + 1
+		}
+
+		bytesRead, readErr := source.Read(buffer[0:chunkSize])
+		if bytesRead > 0 {
+			// the read may have waited a while, so pick up any changes since
+			settings = current()
+			faults = settings.direction(downstream)
+
+			chunk := buffer[0:bytesRead]
+			if settings.resetAfter > 0 && copied+int64(bytesRead) >= settings.resetAfter {
+				remaining := settings.resetAfter - copied
+				if remaining < 0 {
+					remaining = 0
+				}
+				chunk = chunk[0:remaining]
+			}
+			addNoise(chunk, faults.corruptProbability)
+
+			time.Sleep(faults.latency)
+			if _, err := destination.Write(chunk); err != nil {
+				return err
+			}
+			copied += int64(len(chunk))
+
+			if settings.resetAfter > 0 && copied >= settings.resetAfter {
+				return errConnectionReset
+			}
+			if faults.bytesPerSecond > 0 {
+				time.Sleep(time.Duration(len(chunk)) * time.Second / time.Duration(faults.bytesPerSecond))
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// resetConnection closes conn with a RST instead of the usual FIN, if it's a TCP connection
+func resetConnection(conn net.Conn) {
+	if tcpConn, isTCP := conn.(*net.TCPConn); isTCP {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// closeWrite tells the other end of conn that nothing more will be sent, while still allowing reads
+func closeWrite(conn net.Conn) {
+	if tcpConn, isTCP := conn.(*net.TCPConn); isTCP {
+		tcpConn.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// tunnelWithFaults passes data both ways between client and upstream until both sides are done,
+// then closes both connections. current is checked as the data goes through, so the faults
+// can change while the tunnel is open
+func tunnelWithFaults(client, upstream net.Conn, current func() connectionFaultSettings) {
+	if current().shouldReset() {
+		resetConnection(client)
+		resetConnection(upstream)
+		return
+	}
+
+	results := make(chan error, 2)
+	pipe := func(destination, source net.Conn, downstream bool) {
+		err := copyWithFaults(destination, source, current, downstream)
+		if settings := current(); err == nil && !settings.halfOpen {
+			time.Sleep(settings.slowClose)
+			closeWrite(destination)
+		}
+		results <- err
+	}
+	go pipe(upstream, client, false)
+	go pipe(client, upstream, true)
+
+	for finished := 0; finished < 2; finished++ {
+		if err := <-results; err != nil {
+			// a reset or a broken connection ends both directions at once
+			resetConnection(client)
+			resetConnection(upstream)
+			for finished++; finished < 2; finished++ {
+				<-results
+			}
+			return
+		}
+	}
+	client.Close()
+	upstream.Close()
+}
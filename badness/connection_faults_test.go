@@ -0,0 +1,81 @@
+package badness
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConnectionFaultSettings(test *testing.T) {
+	settings, err := parseConnectionFaultSettings([]string{"latency=10ms,throttle=100,upstream-latency=1s", "reset=50,refuse"})
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+	if settings.upstream.latency != time.Second || settings.downstream.latency != 10*time.Millisecond {
+		test.Errorf("Expected upstream-latency to override latency: %+v", settings)
+	}
+	if settings.upstream.bytesPerSecond != 100 || settings.downstream.bytesPerSecond != 100 {
+		test.Errorf("Expected throttle to apply both ways: %+v", settings)
+	}
+	if settings.resetProbability != 0.5 || settings.refuseProbability != 1 {
+		test.Errorf("Unexpected probabilities: %+v", settings)
+	}
+
+	if _, err := parseConnectionFaultSettings([]string{"explode"}); err == nil {
+		test.Errorf("Expected an error for an unknown option")
+	}
+	if _, err := parseConnectionFaultSettings([]string{"upstream-reset-after=10"}); err == nil {
+		test.Errorf("Expected an error for an option that can't be set per direction")
+	}
+}
+
+func TestCopyWithFaults(test *testing.T) {
+	var destination bytes.Buffer
+	start := time.Now()
+	err := copyWithFaults(&destination, strings.NewReader(strings.Repeat("a", 100)), fixedSettings(connectionFaultSettings{upstream: directionFaults{bytesPerSecond: 1000}}), false)
+	if err != nil || destination.Len() != 100 {
+		test.Errorf("Expected all the data to be copied, got %d %v", destination.Len(), err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		test.Errorf("Expected 100 bytes at 1000 bytes/s to take around 100ms, took %v", elapsed)
+	}
+
+	destination.Reset()
+	err = copyWithFaults(&destination, strings.NewReader("hello"), fixedSettings(connectionFaultSettings{resetAfter: 2}), false)
+	if err != errConnectionReset || destination.String() != "he" {
+		test.Errorf("Expected a reset after 2 bytes, got %s %v", destination.String(), err)
+	}
+
+	// lowering reset-after below what's been copied resets the connection instead of writing any more
+	destination.Reset()
+	resetAfter := int64(0)
+	lowered := func() connectionFaultSettings {
+		return connectionFaultSettings{resetAfter: resetAfter, upstream: directionFaults{bytesPerSecond: 100}}
+	}
+	source := &loweringReader{Reader: strings.NewReader(strings.Repeat("a", 100)), lower: func() { resetAfter = 5 }}
+	err = copyWithFaults(&destination, source, lowered, false)
+	if err != errConnectionReset || destination.Len() != 11 {
+		test.Errorf("Expected a reset once reset-after was lowered, got %d bytes %v", destination.Len(), err)
+	}
+}
+
+// loweringReader calls lower when its second read starts, to change the faults partway through a copy
+type loweringReader struct {
+	io.Reader
+	reads int
+	lower func()
+}
+
+func (reader *loweringReader) Read(buffer []byte) (int, error) {
+	reader.reads++
+	if reader.reads == 2 {
+		reader.lower()
+	}
+	return reader.Reader.Read(buffer)
+}
+
+func fixedSettings(settings connectionFaultSettings) func() connectionFaultSettings {
+	return func() connectionFaultSettings { return settings }
+}
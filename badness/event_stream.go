@@ -0,0 +1,251 @@
+package badness
+
+// Server-Sent Events. X-Event-Stream turns the response into a text/event-stream whose
+// event data comes from the X-Random-Json template (if there is one), and can be told
+// to misbehave in the ways long-lived streams tend to.
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EventStream = "X-Event-Stream"
+
+const lastEventID = "Last-Event-ID"
+
+type eventStreamSettings struct {
+	// number of events to send before ending the stream. 0 never ends
+	events   int
+	interval time.Duration
+	// retry hint in milliseconds. If sendRetry is false, no hint is sent
+	retry     int
+	sendRetry bool
+	// a comment is sent this often while waiting between events. 0 disables it
+	heartbeat time.Duration
+	// probabilities (0-1) of misbehaving for each event
+	dropProbability      float64
+	duplicateProbability float64
+	malformedProbability float64
+	// after stallAfter events, go completely silent for stall
+	stallAfter int
+	stall      time.Duration
+	// cut the connection after this many events. 0 never disconnects
+	disconnectAfter int
+}
+
+// parseEventStreamSettings reads the comma-separated key=value options in the X-Event-Stream header.
+// percentages are passed in as 0-100
+func parseEventStreamSettings(headerValues []string) (eventStreamSettings, error) {
+	settings := eventStreamSettings{
+		events:    10,
+		interval:  time.Second,
+		retry:     3000,
+		sendRetry: true,
+		stall:     time.Minute,
+	}
+
+	for key, value := range parseHeadersWithKeyValues(headerValues, ",") {
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "":
+			continue
+		case "events":
+			settings.events, err = strconv.Atoi(value)
+		case "interval":
+			settings.interval, err = stringToDuration(value)
+		case "retry":
+			settings.retry, err = strconv.Atoi(value)
+		case "noretry":
+			settings.sendRetry = false
+		case "heartbeat":
+			settings.heartbeat, err = stringToDuration(value)
+		case "drop":
+			settings.dropProbability, err = parsePercentage(value)
+		case "duplicate":
+			settings.duplicateProbability, err = parsePercentage(value)
+		case "malformed":
+			settings.malformedProbability, err = parsePercentage(value)
+		case "stall-after":
+			settings.stallAfter, err = strconv.Atoi(value)
+		case "stall":
+			settings.stall, err = stringToDuration(value)
+		case "disconnect-after":
+			settings.disconnectAfter, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("Unknown option")
+		}
+
+		if err != nil {
+			return settings, fmt.Errorf("Invalid %s option %s=%s: %v", EventStream, key, value, err)
+		}
+	}
+	return settings, nil
+}
+
+// the ways an event can be broken when it's chosen to be malformed
+var malformedEventFormats = []string{
+	// no colon after the field name
+	"id: %d\ndata %s\n\n",
+	// misspelled field name
+	"id: %d\ndtaa: %s\n\n",
+	// id with a value that isn't an id
+	"id: %d\x00\ndata: %s\n\n",
+	// retry that isn't a number
+	"id: %d\nretry: soon\ndata: %s\n\n",
+	// no blank line terminating the event
+	"id: %d\ndata: %s\n",
+}
+
+type eventStreamGenerator struct {
+	settings eventStreamSettings
+	// the stream stops waiting for its next event once the client's gone
+	ctx context.Context
+	// generates the data for each event. If nil, a small fixed object is used
+	payload jsonElementGenerator
+
+	nextID      int
+	eventsSent  int
+	started     bool
+	stalled     bool
+	nextEventAt time.Time
+	buffer      bytes.Buffer
+}
+
+func (generator *eventStreamGenerator) Read(buf []byte) (int, error) {
+	for generator.buffer.Len() == 0 {
+		if err := generator.fill(); err != nil {
+			return 0, err
+		}
+	}
+	return generator.buffer.Read(buf)
+}
+
+// fill waits for and then writes the next thing in the stream (a retry hint, a heartbeat or an event)
+// into the generator's buffer. It may write nothing if an event was dropped
+func (generator *eventStreamGenerator) fill() error {
+	settings := generator.settings
+
+	if !generator.started {
+		generator.started = true
+		generator.nextEventAt = time.Now()
+		if settings.sendRetry {
+			fmt.Fprintf(&generator.buffer, "retry: %d\n\n", settings.retry)
+		}
+		return nil
+	}
+
+	if settings.events > 0 && generator.eventsSent >= settings.events {
+		return io.EOF
+	}
+
+	if settings.disconnectAfter > 0 && generator.eventsSent >= settings.disconnectAfter {
+		return errAbortResponse
+	}
+
+	if settings.stallAfter > 0 && generator.eventsSent >= settings.stallAfter && !generator.stalled {
+		// no events and no heartbeats
+		generator.stalled = true
+		if err := generator.wait(settings.stall); err != nil {
+			return err
+		}
+		generator.nextEventAt = time.Now()
+	}
+
+	untilNextEvent := time.Until(generator.nextEventAt)
+	if settings.heartbeat > 0 && untilNextEvent > settings.heartbeat {
+		if err := generator.wait(settings.heartbeat); err != nil {
+			return err
+		}
+		generator.buffer.WriteString(": heartbeat\n\n")
+		return nil
+	}
+
+	if err := generator.wait(untilNextEvent); err != nil {
+		return err
+	}
+	generator.nextEventAt = generator.nextEventAt.Add(settings.interval)
+	generator.eventsSent++
+	return generator.writeEvent()
+}
+
+// wait sleeps for duration, unless the client goes away first
+func (generator *eventStreamGenerator) wait(duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-generator.ctx.Done():
+		return generator.ctx.Err()
+	}
+}
+
+// writeEvent writes the next event to the buffer, deciding along the way whether it should be
+// dropped, duplicated or malformed
+func (generator *eventStreamGenerator) writeEvent() error {
+	settings := generator.settings
+
+	id := generator.nextID
+	generator.nextID++
+
+	if rand.Float64() < settings.dropProbability {
+		// the id is used up, so the client sees a gap
+		return nil
+	}
+
+	if generator.eventsSent > 1 && rand.Float64() < settings.duplicateProbability {
+		id--
+		// give the id back, so the next event picks up where the duplicate left off
+		generator.nextID--
+	}
+
+	var data bytes.Buffer
+	if generator.payload != nil {
+		if _, err := generator.payload.generate(&data); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(&data, "{\"event\":%d}", id)
+	}
+
+	format := "id: %d\ndata: %s\n\n"
+	if rand.Float64() < settings.malformedProbability {
+		format = malformedEventFormats[rand.Intn(len(malformedEventFormats))]
+	}
+	fmt.Fprintf(&generator.buffer, format, id, data.String())
+	return nil
+}
+
+// newEventStreamGenerator creates an event stream for request. Event ids resume after the
+// request's Last-Event-ID if it sent one.
+func newEventStreamGenerator(request *http.Request, payload jsonElementGenerator) (io.Reader, error) {
+	settings, err := parseEventStreamSettings(request.Header[EventStream])
+	if err != nil {
+		return nil, err
+	}
+
+	firstID := 1
+	if lastID := request.Header.Get(lastEventID); lastID != "" {
+		if parsedID, err := strconv.Atoi(lastID); err == nil {
+			firstID = parsedID + 1
+		}
+	}
+	return &eventStreamGenerator{settings: settings, ctx: request.Context(), payload: payload, nextID: firstID}, nil
+}
+
+// buildEventStreamHeaders returns the ResponseHandlers that mark the response as an event stream
+func buildEventStreamHeaders() []ResponseHandler {
+	return []ResponseHandler{
+		buildHeaderSetter("Content-Type", []string{"text/event-stream"}),
+		buildHeaderSetter("Cache-Control", []string{"no-cache"}),
+	}
+}
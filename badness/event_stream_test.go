@@ -0,0 +1,137 @@
+package badness
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEventStreamSettings(test *testing.T) {
+	settings, err := parseEventStreamSettings([]string{"events=5,interval=10ms,noretry,drop=50,stall-after=2,stall=1s"})
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+
+	if settings.events != 5 || settings.interval != 10*time.Millisecond || settings.sendRetry {
+		test.Errorf("Unexpected settings %v", settings)
+	}
+	if !float64sEqual(.5, settings.dropProbability, .01) {
+		test.Errorf("Expected drop probability of .5 but got %f", settings.dropProbability)
+	}
+	if settings.stallAfter != 2 || settings.stall != time.Second {
+		test.Errorf("Unexpected stall settings %v", settings)
+	}
+
+	for _, bad := range []string{"events=x", "interval=soon", "drop=lots", "drop=150", "drop=-5", "malformed=101", "wiggle=3"} {
+		if _, err := parseEventStreamSettings([]string{bad}); err == nil {
+			test.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
+
+func TestEventStreamOutput(test *testing.T) {
+	request := makeTestRequest()
+	request.Header[EventStream] = []string{"events=3,interval=1ms"}
+	request.Header.Set(lastEventID, "41")
+
+	generator, err := newEventStreamGenerator(request, nil)
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+
+	output, err := ioutil.ReadAll(generator)
+	if err != nil {
+		test.Fatalf("Unexpected error reading stream: %v", err)
+	}
+
+	expected := "retry: 3000\n\n" +
+		"id: 42\ndata: {\"event\":42}\n\n" +
+		"id: 43\ndata: {\"event\":43}\n\n" +
+		"id: 44\ndata: {\"event\":44}\n\n"
+	if string(output) != expected {
+		test.Errorf("Expected %q but got %q", expected, string(output))
+	}
+}
+
+func TestEventStreamPayloadFromTemplate(test *testing.T) {
+	request := makeTestRequest()
+	request.Header[EventStream] = []string{"events=2,interval=1ms,noretry"}
+	request.Header[RandomJson] = []string{"response_template=[int|7]:2"}
+
+	output := readAllFromPipeline(test, request)
+	if output != "id: 1\ndata: [7,7]\n\nid: 2\ndata: [7,7]\n\n" {
+		test.Errorf("Unexpected event stream %q", output)
+	}
+}
+
+func TestEventStreamDropsEvents(test *testing.T) {
+	request := makeTestRequest()
+	request.Header[EventStream] = []string{"events=3,interval=1ms,noretry,drop=100"}
+
+	generator, _ := newEventStreamGenerator(request, nil)
+	output, _ := ioutil.ReadAll(generator)
+	if len(output) != 0 {
+		test.Errorf("Expected every event to be dropped but got %q", string(output))
+	}
+}
+
+func TestEventStreamHeartbeat(test *testing.T) {
+	request := makeTestRequest()
+	request.Header[EventStream] = []string{"events=2,interval=50ms,heartbeat=20ms,noretry"}
+
+	generator, _ := newEventStreamGenerator(request, nil)
+	output, _ := ioutil.ReadAll(generator)
+	if !strings.Contains(string(output), ": heartbeat\n\n") {
+		test.Errorf("Expected heartbeats between events in %q", string(output))
+	}
+}
+
+func TestEventStreamDisconnect(test *testing.T) {
+	request := makeTestRequest()
+	request.Header[EventStream] = []string{"events=10,interval=1ms,disconnect-after=2"}
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			test.Errorf("Expected the response to be aborted, got %v", recovered)
+		}
+	}()
+	readAllFromPipeline(test, request)
+}
+
+func TestEventStreamStopsWithClient(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	request := makeTestRequest().WithContext(ctx)
+	request.Header[EventStream] = []string{"events=2,interval=1m,stall-after=1,stall=1h,noretry"}
+
+	generator, _ := newEventStreamGenerator(request, nil)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	// the stream is waiting for an interval or a stall when the client goes away
+	start := time.Now()
+	if _, err := ioutil.ReadAll(generator); err != context.Canceled {
+		test.Errorf("Expected the stream to end with the client, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		test.Errorf("Expected the stream to stop straight away, took %v", elapsed)
+	}
+}
+
+// readAllFromPipeline runs request through the pipeline and returns the response body
+func readAllFromPipeline(test *testing.T, request *http.Request) string {
+	recorder := httptest.NewRecorder()
+	for _, handler := range GetResponsePipeline(request) {
+		handler(recorder)
+	}
+
+	if contentType := recorder.Header().Get("Content-Type"); requestHasHeader(request, EventStream) && contentType != "text/event-stream" {
+		test.Errorf("Expected an event-stream content type, got %s", contentType)
+	}
+	return recorder.Body.String()
+}
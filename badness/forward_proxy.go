@@ -0,0 +1,82 @@
+package badness
+
+// Forward proxy. Clients that honor HTTP_PROXY and HTTPS_PROXY send bad-server absolute-form requests
+// (GET http://host/path) for plain HTTP, and CONNECT requests to open tunnels for HTTPS. Plain requests
+// are proxied through the usual response pipeline, while tunnels can only have X-Connection-Faults
+// applied since their contents are encrypted.
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ServeForwardProxy handles a request that was sent to bad-server as an HTTP proxy
+func ServeForwardProxy(response http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodConnect {
+		serveTunnel(response, request)
+		return
+	}
+
+	if !request.URL.IsAbs() {
+		generateBadResponseHandler(fmt.Sprintf("Expected an absolute-form request, got %s", request.URL))(response)
+		return
+	}
+
+	// the whole url is used so the path and query go along unchanged
+	if !requestHasHeader(request, ProxyRequest) && !requestHasHeader(request, ProxyReplay) {
+		request.Header.Set(ProxyRequest, request.URL.String())
+	}
+	for _, handler := range GetResponsePipeline(request) {
+		handler(response)
+	}
+}
+
+// serveTunnel opens a connection to the CONNECT request's target and passes data through it
+func serveTunnel(response http.ResponseWriter, request *http.Request) {
+	settings, err := parseConnectionFaultSettings(request.Header[ConnectionFaults])
+	if err != nil {
+		generateBadResponseHandler(err.Error())(response)
+		return
+	}
+
+	if settings.shouldRefuse() {
+		response.WriteHeader(proxyConfig.ErrorStatus)
+		fmt.Fprintf(response, "Connection to %s refused", request.Host)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", request.Host, proxyConfig.ConnectTimeout)
+	if err != nil {
+		status := proxyConfig.ErrorStatus
+		if isTimeout(err) {
+			status = proxyConfig.TimeoutStatus
+		}
+		response.WriteHeader(status)
+		fmt.Fprintf(response, "Could not connect to %s: %v", request.Host, err)
+		return
+	}
+
+	client, clientReader, err := hijackConnection(response)
+	if err != nil {
+		upstream.Close()
+		response.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(response, "%v", err)
+		return
+	}
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	// clients can start talking to the target without waiting for the 200, and whatever the server read
+	// ahead of the request would be lost if it weren't passed on first
+	if early, _ := clientReader.Peek(clientReader.Buffered()); len(early) > 0 {
+		if _, err := upstream.Write(early); err != nil {
+			client.Close()
+			upstream.Close()
+			return
+		}
+	}
+	tunnelWithFaults(client, upstream, func() connectionFaultSettings { return settings })
+}
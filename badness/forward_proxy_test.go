@@ -0,0 +1,142 @@
+package badness
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoListener accepts TCP connections and echoes back whatever they send
+func newEchoListener(test *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("Could not listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+// openTunnel sends a CONNECT for target through the forward proxy at proxyAddress, and returns
+// the connection along with the proxy's status line
+func openTunnel(test *testing.T, proxyAddress, target string, headerLines ...string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		test.Fatalf("Could not connect to proxy: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	for _, line := range headerLines {
+		request += line + "\r\n"
+	}
+	conn.Write([]byte(request + "\r\n"))
+
+	reader := bufio.NewReader(conn)
+	statusLine, _ := reader.ReadString('\n')
+	// skip the rest of the proxy's response head
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil || line == "\r\n" {
+			break
+		}
+	}
+	return conn, reader, statusLine
+}
+
+func TestForwardProxyHTTP(test *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte(request.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(ServeForwardProxy))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	request, _ := http.NewRequest("GET", upstream.URL+"/path?query=1", nil)
+	request.Header.Set(CodeByHistogram, "418")
+	response, err := client.Do(request)
+	if err != nil {
+		test.Fatalf("Request through the proxy failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusTeapot {
+		test.Errorf("Expected the pipeline to apply the histogram, got %d", response.StatusCode)
+	}
+	if string(body) != "/path?query=1" {
+		test.Errorf("Expected the path and query to reach the upstream, got %s", body)
+	}
+}
+
+func TestForwardProxyTunnel(test *testing.T) {
+	echo := newEchoListener(test)
+	defer echo.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(ServeForwardProxy))
+	defer proxy.Close()
+	proxyAddress := strings.TrimPrefix(proxy.URL, "http://")
+
+	conn, reader, status := openTunnel(test, proxyAddress, echo.Addr().String())
+	if !strings.Contains(status, "200") {
+		test.Fatalf("Expected the tunnel to open, got %s", status)
+	}
+	conn.Write([]byte("hello"))
+	echoed := make([]byte, 5)
+	if _, err := io.ReadFull(reader, echoed); err != nil || string(echoed) != "hello" {
+		test.Errorf("Expected the data to be echoed, got %s %v", echoed, err)
+	}
+	conn.Close()
+
+	// data sent along with the CONNECT, before the 200 arrives, still reaches the target
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		test.Fatalf("Could not connect to proxy: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	target := echo.Addr().String()
+	conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\nearly"))
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || response.StatusCode != http.StatusOK {
+		test.Fatalf("Expected the tunnel to open, got %v %v", response, err)
+	}
+	echoed = make([]byte, 5)
+	if _, err := io.ReadFull(response.Body, echoed); err != nil || string(echoed) != "early" {
+		test.Errorf("Expected the early data to be echoed, got %q %v", echoed, err)
+	}
+	conn.Close()
+
+	_, _, status = openTunnel(test, proxyAddress, echo.Addr().String(), ConnectionFaults+": refuse")
+	if !strings.Contains(status, "502") {
+		test.Errorf("Expected the tunnel to be refused, got %s", status)
+	}
+
+	conn, reader, _ = openTunnel(test, proxyAddress, echo.Addr().String(), ConnectionFaults+": reset-after=3")
+	conn.Write([]byte("hello"))
+	received, err := ioutil.ReadAll(reader)
+	// the reset can beat the echo back, so there may be nothing to read
+	if err == nil || !strings.HasPrefix("hel", string(received)) {
+		test.Errorf("Expected the tunnel to be reset after 3 bytes, got %q %v", received, err)
+	}
+	conn.Close()
+}
@@ -12,24 +12,112 @@ import (
 
 type ResponseHandler func(response http.ResponseWriter) error
 
+// controlHeaders lists the request headers that bad-server interprets, as opposed to
+// headers that belong to the client's own request
+var controlHeaders = []string{
+	CodeByHistogram,
+	RequestBodyIsResponse,
+	PauseBeforeStart,
+	AddNoise,
+	ForceHeader,
+	GenerateRandomResponse,
+	RandomLaggyResponse,
+	ProxyRequest,
+	ProxyTimeout,
+	ProxyStatusMode,
+	ProxyForwardAllow,
+	ProxyForwardDeny,
+	ProxyHost,
+	ProxyRecord,
+	ProxyReplay,
+	ProxyMatch,
+	ProxyRequestDelay,
+	ProxyRequestThrottle,
+	ProxyRequestDropHeader,
+	ProxyRequestSetHeader,
+	ProxyRequestRepeat,
+	ProxyRequestTruncate,
+	ProxyPool,
+	RandomJson,
+	JsonExplain,
+	Redirect,
+	EventStream,
+	WebSocket,
+	WebSocketDelays,
+	RawResponse,
+	ChunkedFaults,
+	ConnectionFaults,
+	JsonMutate,
+}
+
 // GetResponsePipeline returns an appropriately ordered
 // slice of badness functions (based on request headers) that can be applied to a ResponseWriter.
 // functions take a ResponseWriter as an argument.
 func GetResponsePipeline(request *http.Request) []ResponseHandler {
 	pipeline := make([]ResponseHandler, 0)
 
+	// a redirect chain carries its headers in the query string, so unpack them before
+	// anything else looks at the request
+	if err := applyRedirectState(request); err != nil {
+		return []ResponseHandler{generateBadResponseHandler(fmt.Sprintf("Could not read redirect state: %v", err))}
+	}
+
+	// a pool member can have its own headers, so it needs to be picked before anything else
+	// looks at them. The rest of the pipeline runs as if the request had named the member itself
+	if requestHasHeader(request, ProxyPool) {
+		record, err := applyPoolMember(request)
+		if err != nil {
+			return []ResponseHandler{generateBadResponseHandler(err.Error())}
+		}
+		return []ResponseHandler{buildPoolPipeline(GetResponsePipeline(request), record)}
+	}
+
+	if requestHasHeader(request, Redirect) {
+		if redirectHandler, redirecting := buildRedirectHandler(request); redirecting {
+			return []ResponseHandler{redirectHandler}
+		}
+	}
+
+	// websockets take over the connection, so nothing else in the pipeline applies
+	if requestHasHeader(request, WebSocket) {
+		return []ResponseHandler{buildWebSocketHandler(request)}
+	}
+
+	// chunked faults are written on a raw connection too, and take any raw faults into account
+	if requestHasHeader(request, ChunkedFaults) {
+		return []ResponseHandler{buildChunkedResponseHandler(request)}
+	}
+
+	if requestHasHeader(request, RawResponse) {
+		return []ResponseHandler{buildRawResponseHandler(request)}
+	}
+
 	// proxies circumvent the normal header/body building portions of the pipeline because
-	// it pre-empts other headers and follows a different path
-	if requestHasHeader(request, ProxyRequest) {
+	// it pre-empts other headers and follows a different path. The status code histogram
+	// and X-Return-Header are layered on top of the upstream response instead. Replayed
+	// responses take the same path, as if they'd just come from the upstream
+	if requestHasHeader(request, ProxyRequest) || requestHasHeader(request, ProxyReplay) {
+		var statusOverride func(int) int
+		if requestHasHeader(request, CodeByHistogram) {
+			var err error
+			statusOverride, err = buildProxyStatusOverride(request)
+			if err != nil {
+				return []ResponseHandler{generateBadResponseHandler(fmt.Sprintf("Could not build status override: %v", err))}
+			}
+		}
+
+		// the upstream request is already on its way. Its headers go to the client as soon as they
+		// arrive, unless the client asked for a pause before the response starts
 		proxy := buildProxyResponse(request)
-		pipeline = append(pipeline, proxy.buildProxyHeaderGenerator())
+		overrides := parseHeaderOverrides(request.Header[ForceHeader])
+		flushHeaders := !requestHasHeader(request, PauseBeforeStart)
+		pipeline = append(pipeline, proxy.buildProxyHeaderGenerator(overrides, statusOverride, flushHeaders, requestHasHeader(request, JsonMutate)))
 
 		affector, err := getResponseAffector(request, proxy.getProxyReader())
 		if err != nil {
-			pipeline = []ResponseHandler{generateBadResponseHandler(fmt.Sprintf("Could not get affector: %v", err))}
-			return pipeline
+			return []ResponseHandler{generateBadResponseHandler(fmt.Sprintf("Could not get affector: %v", err)), proxy.buildProxyCloser()}
 		}
-		pipeline = append(pipeline, buildBodyGenerator(affector))
+		pipeline = append(pipeline, buildStreamingBodyGenerator(affector))
 		pipeline = append(pipeline, proxy.buildProxyCloser())
 
 	} else {
@@ -39,12 +127,14 @@ func GetResponsePipeline(request *http.Request) []ResponseHandler {
 			pipeline = append(pipeline, generateHistogramStatusCode(request))
 		}
 
-		bodyGenerator := getBodyGenerator(request)
-		affectedGenerator, err := getResponseAffector(request, bodyGenerator)
-		if err == nil {
-			pipeline = append(pipeline, buildBodyGenerator(affectedGenerator))
+		affectedGenerator, err := getResponseAffector(request, getBodyGenerator(request))
+		if err != nil {
+			return []ResponseHandler{generateBadResponseHandler(fmt.Sprintf("Could not get affector: %v", err))}
+		}
+		if requestHasHeader(request, EventStream) {
+			pipeline = append(pipeline, buildStreamingBodyGenerator(affectedGenerator))
 		} else {
-			pipeline = []ResponseHandler{generateBadResponseHandler(fmt.Sprintf("Could not get affector: %v", err))}
+			pipeline = append(pipeline, buildBodyGenerator(affectedGenerator))
 		}
 	}
 
@@ -54,6 +144,10 @@ func GetResponsePipeline(request *http.Request) []ResponseHandler {
 // getHeaderGenerators builds up a slice of ResponseHandlers based on headers
 func getHeaderGenerators(request *http.Request) []ResponseHandler {
 	responseHandlers := make([]ResponseHandler, 0)
+	// these go first so X-Return-Header can override them
+	if requestHasHeader(request, EventStream) {
+		responseHandlers = append(responseHandlers, buildEventStreamHeaders()...)
+	}
 	if requestHasHeader(request, ForceHeader) {
 		forceHeaders := buildForcedHeaders(request)
 		responseHandlers = append(responseHandlers, forceHeaders...)
@@ -75,21 +169,20 @@ func getBodyGenerator(request *http.Request) io.Reader {
 			return strings.NewReader("")
 		}
 		return newRandomBodyGenerator(bodySize)
-	} else if requestHasHeader(request, RandomJson) {
-		// gather up all the values for the header into one string
-		allHeaderValues := request.Header[RandomJson]
-		templateInput, err := normalizeJsonTemplateParameters(allHeaderValues)
-
-		var generator jsonElementGenerator
+	} else if requestHasHeader(request, EventStream) {
+		// each event's data comes from the json template, if there is one
+		var payload jsonElementGenerator
+		if requestHasHeader(request, RandomJson) {
+			payload = getJsonTemplateGenerator(request)
+		}
+		generator, err := newEventStreamGenerator(request, payload)
 		if err != nil {
-			generator = newErrorGenerator(fmt.Sprintf("Could not process input %v", err))
-		} else {
-			generator, err = createJsonTemplate(templateInput)
-			if err != nil {
-				generator = newErrorGenerator(fmt.Sprintf("Could not parse input for generator %v", err))
-			}
+			log.Printf("Could not build event stream: %v", err)
+			return strings.NewReader(fmt.Sprintf("Could not build event stream: %v", err))
 		}
-
+		return generator
+	} else if requestHasHeader(request, RandomJson) {
+		generator := getJsonTemplateGenerator(request)
 		reader, writer := io.Pipe()
 		go func() {
 			generator.generate(writer)
@@ -101,6 +194,27 @@ func getBodyGenerator(request *http.Request) io.Reader {
 	}
 }
 
+// getJsonTemplateGenerator builds a json generator from the X-Random-Json headers in request.
+// If the template can't be built, the generator will write out the error as json instead.
+func getJsonTemplateGenerator(request *http.Request) jsonElementGenerator {
+	// gather up all the values for the header into one string
+	allHeaderValues := request.Header[RandomJson]
+	templateInput, err := normalizeJsonTemplateParameters(allHeaderValues)
+
+	var generator jsonElementGenerator
+	if err != nil {
+		generator = newErrorGenerator(fmt.Sprintf("Could not process input %v", err))
+	} else {
+		generator, err = createJsonTemplate(templateInput)
+		if err != nil {
+			generator = newErrorGenerator(fmt.Sprintf("Could not parse input for generator %v", err))
+		} else if requestHasHeader(request, JsonExplain) {
+			generator = newExplainGenerator(generator, templateInput)
+		}
+	}
+	return generator
+}
+
 const responseTemplateKey = "response_template="
 
 // normalizeJsonTemplateParameters ensures that the X-Random-Json header values
@@ -150,6 +264,14 @@ func getResponseAffector(request *http.Request, reader io.Reader) (returnReader
 
 	returnReader = reader
 
+	// this has to see the body before anything else damages it, or it won't parse
+	if requestHasHeader(request, JsonMutate) {
+		returnReader, err = getJsonMutateAffector(request, returnReader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	for header, getter := range headerToAffector {
 		if requestHasHeader(request, header) {
 			returnReader, err = getter(request, returnReader)
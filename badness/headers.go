@@ -68,3 +68,47 @@ func collateForcedHeaders(forcedHeaders []string) map[string][]string {
 	}
 	return collatedHeaders
 }
+
+// headerOverrides describes how X-Return-Header changes a set of headers that already exists,
+// such as a proxied response's. Values are collated the same way as forced headers:
+//    X-Return-Header: Content-Type: text/plain   replaces any Content-Type
+//    X-Return-Header: +Via: bad-server           adds a value to Via
+//    X-Return-Header: -Etag                      removes Etag
+type headerOverrides struct {
+	set    map[string][]string
+	add    map[string][]string
+	remove []string
+}
+
+func parseHeaderOverrides(forcedHeaders []string) headerOverrides {
+	setHeaders := make([]string, 0)
+	addHeaders := make([]string, 0)
+	removeHeaders := make([]string, 0)
+
+	for _, forcedHeader := range forcedHeaders {
+		if strings.HasPrefix(forcedHeader, "+") {
+			addHeaders = append(addHeaders, forcedHeader[1:])
+		} else if strings.HasPrefix(forcedHeader, "-") {
+			// allow a trailing colon, since that's what a header usually looks like
+			removeHeaders = append(removeHeaders, strings.TrimSpace(strings.TrimSuffix(forcedHeader[1:], ":")))
+		} else {
+			setHeaders = append(setHeaders, forcedHeader)
+		}
+	}
+
+	return headerOverrides{collateForcedHeaders(setHeaders), collateForcedHeaders(addHeaders), removeHeaders}
+}
+
+// apply changes header in place. Removals happen first, then replacements, then additions
+func (overrides headerOverrides) apply(header http.Header) {
+	for _, key := range overrides.remove {
+		header.Del(key)
+	}
+	for key, values := range overrides.set {
+		header[http.CanonicalHeaderKey(key)] = values
+	}
+	for key, values := range overrides.add {
+		canonicalKey := http.CanonicalHeaderKey(key)
+		header[canonicalKey] = append(header[canonicalKey], values...)
+	}
+}
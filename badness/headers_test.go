@@ -1,6 +1,7 @@
 package badness
 
 import (
+	"net/http"
 	"net/http/httptest"
 	"sort"
 	"testing"
@@ -91,3 +92,26 @@ func TestResponseGetsForcedHeaders(test *testing.T) {
 		test.Fatalf("My-Header: %v differed from %v at %d", contentTypeExpect, response.Header()["Content-Type"], diffIndex)
 	}
 }
+
+func TestHeaderOverrides(test *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Etag", "abc")
+	header.Set("Via", "upstream")
+
+	overrides := parseHeaderOverrides([]string{"content-type: text/plain", "-Etag", "+Via: bad-server", "+X-New: 1"})
+	overrides.apply(header)
+
+	if header.Get("Content-Type") != "text/plain" {
+		test.Errorf("Expected Content-Type to be replaced, got %v", header["Content-Type"])
+	}
+	if _, found := header["Etag"]; found {
+		test.Errorf("Expected Etag to be removed")
+	}
+	if diffIndex, matched := compareStringSlices([]string{"upstream", "bad-server"}, header["Via"]); !matched {
+		test.Errorf("Expected a Via value to be added, differed at %d: %v", diffIndex, header["Via"])
+	}
+	if header.Get("X-New") != "1" {
+		test.Errorf("Expected X-New to be added, got %v", header["X-New"])
+	}
+}
@@ -25,8 +25,6 @@ func bucketForProbability(probability float64, buckets []histogramBucket) int {
 		cumulativeProbability += bucket.probability
 		if cumulativeProbability > probability {
 			return index
-		} else {
-			cumulativeProbability += bucket.probability
 		}
 	}
 	return bucketNotFound
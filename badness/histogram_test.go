@@ -34,3 +34,14 @@ func TestFindingHistogramBucket(test *testing.T) {
 		test.Fatalf("Expected -1 for unavailable index, got %d", bucket)
 	}
 }
+
+func TestHistogramBucketsCoverTheirProbability(test *testing.T) {
+	hist := []histogramBucket{{.2}, {.3}, {.4}, {.1}}
+
+	expectations := map[float64]int{.19: 0, .2: 1, .49: 1, .5: 2, .89: 2, .9: 3, .99: 3}
+	for random, expected := range expectations {
+		if bucket := bucketForProbability(random, hist); bucket != expected {
+			test.Errorf("Expected %f to land in bucket %d, got %d", random, expected, bucket)
+		}
+	}
+}
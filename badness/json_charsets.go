@@ -0,0 +1,173 @@
+package badness
+
+// Character sets for json_template strings. Plain ASCII letters never need escaping and are always one
+// byte per character, so they leave a client's string handling untested. These sets fill strings with
+// multi-byte and right-to-left text, characters that have to be escaped, and (on purpose) text that
+// isn't valid Unicode at all.
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"unicode/utf8"
+)
+
+// the hostile sets put one of their characters in place of a letter this often
+const hostileCharacterOneIn = 4
+
+// stringCharset returns length characters for the inside of a JSON string, already escaped
+type stringCharset func(length int) []byte
+
+// stringCharsetsByName maps the format given in a template to its set. ascii is handled by
+// randomStringGenerator itself
+var stringCharsetsByName = map[string]stringCharset{
+	"unicode":    charactersFrom(randomBMPRune),
+	"emoji":      charactersFrom(randomEmoji),
+	"rtl":        charactersFrom(randomRTLRune),
+	"control":    sprinkledWith(randomControlCharacter),
+	"quotes":     sprinkledWith(randomQuote),
+	"surrogates": loneSurrogates,
+	"invalid":    sprinkledWith(randomInvalidBytes),
+}
+
+// ranges of runes, from first to last inclusive
+type runeRange struct {
+	first rune
+	last  rune
+}
+
+var emojiRanges = []runeRange{{0x1F600, 0x1F64F}, {0x1F300, 0x1F5FF}, {0x1F680, 0x1F6FF}, {0x2600, 0x26FF}, {0x1F900, 0x1F9FF}}
+
+// Hebrew and Arabic letters, skipping the Arabic tatweel, which only stretches the letters around it
+var rtlRanges = []runeRange{{0x05D0, 0x05EA}, {0x0627, 0x063F}, {0x0641, 0x064A}}
+
+// combining marks, both general-purpose and Arabic vowel marks
+var combiningRanges = []runeRange{{0x0300, 0x036F}, {0x064B, 0x0652}}
+
+// right-to-left mark, right-to-left embedding and right-to-left override
+var bidiControls = []rune{0x200F, 0x202B, 0x202E}
+
+var quoteCharacters = []rune{'"', '\\', '\'', '`', '/'}
+
+// byte sequences that aren't valid UTF-8: bytes that never appear, an overlong encoding, a sequence
+// that's cut short and an encoded surrogate
+var invalidSequences = [][]byte{{0xFF}, {0xFE}, {0xC0, 0x80}, {0xE2, 0x82}, {0xED, 0xA0, 0x80}}
+
+func randomRuneFrom(ranges []runeRange) rune {
+	chosen := ranges[rand.Intn(len(ranges))]
+	return chosen.first + rand.Int31n(chosen.last-chosen.first+1)
+}
+
+func randomLetter() rune {
+	return rune(stringCharacters[rand.Intn(len(stringCharacters))])
+}
+
+// charactersFrom builds a set where every character comes from pick
+func charactersFrom(pick func(buffer *bytes.Buffer)) stringCharset {
+	return func(length int) []byte {
+		var buffer bytes.Buffer
+		for count := 0; count < length; count++ {
+			pick(&buffer)
+		}
+		return buffer.Bytes()
+	}
+}
+
+// sprinkledWith builds a set of letters, with some of them replaced by a character from hostile
+func sprinkledWith(hostile func(buffer *bytes.Buffer)) stringCharset {
+	return charactersFrom(func(buffer *bytes.Buffer) {
+		if rand.Intn(hostileCharacterOneIn) == 0 {
+			hostile(buffer)
+		} else {
+			writeJsonRune(buffer, randomLetter())
+		}
+	})
+}
+
+// randomBMPRune writes anything from the Basic Multilingual Plane, other than the surrogates
+func randomBMPRune(buffer *bytes.Buffer) {
+	character := rand.Int31n(0x10000 - 0x800)
+	if character >= 0xD800 {
+		character += 0x800
+	}
+	writeJsonRune(buffer, character)
+}
+
+func randomEmoji(buffer *bytes.Buffer) {
+	writeJsonRune(buffer, randomRuneFrom(emojiRanges))
+}
+
+// randomRTLRune writes a right-to-left letter. Some get a combining mark, and a few are preceded by a
+// control character that changes the text's direction
+func randomRTLRune(buffer *bytes.Buffer) {
+	if rand.Intn(10) == 0 {
+		writeJsonRune(buffer, bidiControls[rand.Intn(len(bidiControls))])
+	}
+	writeJsonRune(buffer, randomRuneFrom(rtlRanges))
+	if rand.Intn(3) == 0 {
+		writeJsonRune(buffer, randomRuneFrom(combiningRanges))
+	}
+}
+
+func randomControlCharacter(buffer *bytes.Buffer) {
+	writeJsonRune(buffer, rand.Int31n(0x20))
+}
+
+func randomQuote(buffer *bytes.Buffer) {
+	writeJsonRune(buffer, quoteCharacters[rand.Intn(len(quoteCharacters))])
+}
+
+// randomInvalidBytes writes bytes that aren't valid UTF-8, without escaping them, so the string
+// isn't valid JSON text any more
+func randomInvalidBytes(buffer *bytes.Buffer) {
+	buffer.Write(invalidSequences[rand.Intn(len(invalidSequences))])
+}
+
+// loneSurrogates is a set of letters with escaped surrogates that don't pair up. The JSON is well-formed,
+// but the string it decodes to isn't valid Unicode
+func loneSurrogates(length int) []byte {
+	var buffer bytes.Buffer
+	afterHigh := false
+	for count := 0; count < length; count++ {
+		if rand.Intn(hostileCharacterOneIn) != 0 {
+			writeJsonRune(&buffer, randomLetter())
+			afterHigh = false
+			continue
+		}
+
+		surrogate := 0xD800 + rand.Intn(0x800)
+		if afterHigh && surrogate >= 0xDC00 {
+			// a low surrogate would make a valid pair with the high one before it
+			surrogate -= 0x400
+		}
+		fmt.Fprintf(&buffer, "\\u%04x", surrogate)
+		afterHigh = surrogate < 0xDC00
+	}
+	return buffer.Bytes()
+}
+
+// writeJsonRune writes character to buffer, escaped for the inside of a JSON string
+func writeJsonRune(buffer *bytes.Buffer, character rune) {
+	switch character {
+	case '"':
+		buffer.WriteString(`\"`)
+	case '\\':
+		buffer.WriteString(`\\`)
+	case '\n':
+		buffer.WriteString(`\n`)
+	case '\r':
+		buffer.WriteString(`\r`)
+	case '\t':
+		buffer.WriteString(`\t`)
+	case '\b':
+		buffer.WriteString(`\b`)
+	case '\f':
+		buffer.WriteString(`\f`)
+	default:
+		if character < 0x20 {
+			fmt.Fprintf(buffer, "\\u%04x", character)
+		} else {
+			var encoded [utf8.UTFMax]byte
+			buffer.Write(encoded[:utf8.EncodeRune(encoded[:], character)])
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package badness
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// checks that every character of a decoded string belongs to its set
+var charsetCharacterChecks = map[string]func(rune) bool{
+	"ascii":   func(character rune) bool { return character < utf8.RuneSelf && unicode.IsLetter(character) },
+	"unicode": func(character rune) bool { return character < 0x10000 },
+	"emoji":   func(character rune) bool { return character >= 0x2600 },
+	"control": func(character rune) bool { return character < 0x20 || unicode.IsLetter(character) },
+	"quotes": func(character rune) bool {
+		return strings.ContainsRune("\"\\'`/", character) || unicode.IsLetter(character)
+	},
+	// lone surrogates decode to the replacement character
+	"surrogates": func(character rune) bool { return character == utf8.RuneError || unicode.IsLetter(character) },
+}
+
+func TestStringCharsets(test *testing.T) {
+	for charset, check := range charsetCharacterChecks {
+		for _, value := range generateSemanticValues(test, "string:8..12:"+charset, 200) {
+			length := utf8.RuneCountInString(value)
+			if length < 8 || length > 12 {
+				test.Errorf("string:8..12:%s generated %d characters in %q", charset, length, value)
+			}
+			for _, character := range value {
+				if !check(character) {
+					test.Errorf("string:8..12:%s generated %U in %q", charset, character, value)
+				}
+			}
+		}
+	}
+}
+
+func TestRightToLeftStrings(test *testing.T) {
+	for _, value := range generateSemanticValues(test, "string:10:rtl", 200) {
+		letters := 0
+		for _, character := range value {
+			if unicode.In(character, unicode.Hebrew, unicode.Arabic) && unicode.IsLetter(character) {
+				letters++
+			} else if !unicode.In(character, unicode.Mn, unicode.Bidi_Control) {
+				test.Errorf("string:10:rtl generated %U in %q", character, value)
+			}
+		}
+		if letters != 10 {
+			test.Errorf("Expected 10 right-to-left letters, got %d in %q", letters, value)
+		}
+	}
+}
+
+func TestInvalidCharsetIsNotUtf8(test *testing.T) {
+	generator, err := createJsonTemplate("string:200:invalid")
+	if err != nil {
+		test.Fatalf("Could not build template: %v", err)
+	}
+	generated := generatedString(generator)
+	if utf8.ValidString(generated) {
+		test.Errorf("Expected invalid UTF-8, got %q", generated)
+	}
+	if !strings.HasPrefix(generated, "\"") || !strings.HasSuffix(generated, "\"") {
+		test.Errorf("Expected a quoted string, got %q", generated)
+	}
+}
+
+func TestCharsetsStayInsideTheirString(test *testing.T) {
+	// control characters and quotes have to be escaped, or the array would fall apart
+	for _, charset := range []string{"control", "quotes", "surrogates"} {
+		generator, err := createJsonTemplate("[string:20:" + charset + "]:50")
+		if err != nil {
+			test.Fatalf("Could not build template: %v", err)
+		}
+		var values []string
+		if err := json.Unmarshal([]byte(generatedString(generator)), &values); err != nil || len(values) != 50 {
+			test.Errorf("Expected 50 %s strings, got %d: %v", charset, len(values), err)
+		}
+	}
+}
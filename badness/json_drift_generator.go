@@ -0,0 +1,150 @@
+package badness
+
+// Type drift for json_template, where object members are sometimes written as the wrong type: "42" where
+// 42 was expected, [42] instead of 42, or null instead of an array. Real APIs regress like this, and
+// clients that decode into typed structures tend to handle it badly. Which fields drifted is part of the
+// explain output, so tests can check their client noticed.
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"strconv"
+)
+
+// the JSON types a value can drift between
+const (
+	jsonString = iota
+	jsonNumber
+	jsonBool
+	jsonNull
+	jsonArray
+	jsonObject
+	jsonTypeCount
+)
+
+// jsonTypeOf returns the type of an encoded JSON value
+func jsonTypeOf(value []byte) int {
+	if len(value) == 0 {
+		return jsonNull
+	}
+	switch value[0] {
+	case '"':
+		return jsonString
+	case '[':
+		return jsonArray
+	case '{':
+		return jsonObject
+	case 't', 'f':
+		return jsonBool
+	case 'n':
+		return jsonNull
+	default:
+		return jsonNumber
+	}
+}
+
+// driftReport counts the values that drifted for each field. Fields are named by where they are in the
+// template, such as user.age, or $[].id for the id of inline objects in an array at the root
+type driftReport struct {
+	counts map[string]int
+}
+
+func newDriftReport() *driftReport {
+	return &driftReport{counts: make(map[string]int)}
+}
+
+func (report *driftReport) add(field string) {
+	report.counts[field]++
+}
+
+// take returns the counts so far, and starts counting again from nothing
+func (report *driftReport) take() map[string]int {
+	counts := report.counts
+	report.counts = make(map[string]int)
+	return counts
+}
+
+// driftReportingGenerator is the root of a template that has drift, so that the explain output can find
+// out what drifted
+type driftReportingGenerator struct {
+	jsonElementGenerator
+	report *driftReport
+}
+
+// ---- drift generator -----
+// writes its generator's values, except that some of them are changed to a different type
+type driftGenerator struct {
+	generator jsonElementGenerator
+	// the chance (0-1) of the value drifting
+	probability float64
+	field       string
+	report      *driftReport
+}
+
+func (generator driftGenerator) generate(writer io.Writer) (int, error) {
+	if rand.Float64() >= generator.probability {
+		return generator.generator.generate(writer)
+	}
+
+	var buffer bytes.Buffer
+	if _, err := generator.generator.generate(&buffer); err != nil {
+		return 0, err
+	}
+	generator.report.add(generator.field)
+	return writer.Write(driftedValue(buffer.Bytes()))
+}
+
+func newDriftGenerator(generator jsonElementGenerator, probability float64, field string, report *driftReport) jsonElementGenerator {
+	return driftGenerator{generator, probability, field, report}
+}
+
+// driftedValue returns a value that's a different type from value. Where there's a realistic way to get
+// there from value, that's used: anything can be turned into a string or wrapped in an array or object,
+// strings holding a number lose their quotes, and bools become 1 or 0, or 1.0 or 0.0
+func driftedValue(value []byte) []byte {
+	original := jsonTypeOf(value)
+	drifted := rand.Intn(jsonTypeCount - 1)
+	if drifted >= original {
+		drifted++
+	}
+
+	switch drifted {
+	case jsonString:
+		quoted, _ := json.Marshal(string(value))
+		return quoted
+	case jsonNumber:
+		var text string
+		if original == jsonString && json.Unmarshal(value, &text) == nil && isJsonNumber(text) {
+			return []byte(text)
+		}
+		number := rand.Intn(10000)
+		if original == jsonBool && value[0] == 't' {
+			number = 1
+		} else if original == jsonBool {
+			number = 0
+		}
+		// clients that expect an int can choke on a float just as badly as on a string
+		if rand.Intn(2) == 0 {
+			return []byte(strconv.Itoa(number))
+		}
+		if original == jsonBool {
+			return []byte(strconv.Itoa(number) + ".0")
+		}
+		return []byte(strconv.FormatFloat(float64(number)+rand.Float64(), 'f', 2, 64))
+	case jsonBool:
+		return []byte(strconv.FormatBool(rand.Intn(2) == 0))
+	case jsonNull:
+		return null
+	case jsonArray:
+		return []byte("[" + string(value) + "]")
+	default:
+		return []byte(`{"value":` + string(value) + "}")
+	}
+}
+
+// isJsonNumber checks that text could be written as a JSON number
+func isJsonNumber(text string) bool {
+	var number json.Number
+	return text != "" && jsonTypeOf([]byte(text)) == jsonNumber && json.Unmarshal([]byte(text), &number) == nil
+}
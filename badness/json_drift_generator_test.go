@@ -0,0 +1,104 @@
+package badness
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDriftedValues(test *testing.T) {
+	values := []string{`42`, `-1.5`, `"abc"`, `"42"`, `true`, `false`, `null`, `[1,2]`, `{"a":1}`, `""`}
+	for _, value := range values {
+		for count := 0; count < 100; count++ {
+			drifted := driftedValue([]byte(value))
+			if !json.Valid(drifted) {
+				test.Errorf("%s drifted to invalid JSON %s", value, drifted)
+			}
+			if jsonTypeOf(drifted) == jsonTypeOf([]byte(value)) {
+				test.Errorf("%s drifted to %s, which is the same type", value, drifted)
+			}
+		}
+	}
+
+	// strings holding a number drift to the number, and numbers drift to the string
+	seen := map[string]bool{}
+	for count := 0; count < 200; count++ {
+		seen[string(driftedValue([]byte(`"42"`)))] = true
+		seen[string(driftedValue([]byte(`42`)))] = true
+	}
+	if !seen[`42`] || !seen[`"42"`] || !seen[`[42]`] || !seen[`{"value":42}`] {
+		test.Errorf("Expected realistic drift between 42 and \"42\", got %v", seen)
+	}
+
+	// bools become 1 or 0 as ints or floats, and other values can become either kind of number
+	seen = map[string]bool{}
+	floats := 0
+	for count := 0; count < 200; count++ {
+		seen[string(driftedValue([]byte(`true`)))] = true
+		if drifted := driftedValue([]byte(`"abc"`)); jsonTypeOf(drifted) == jsonNumber && strings.Contains(string(drifted), ".") {
+			floats++
+		}
+	}
+	if !seen[`1`] || !seen[`1.0`] || seen[`0`] || seen[`0.0`] {
+		test.Errorf("Expected true to drift to 1 and 1.0, got %v", seen)
+	}
+	if floats == 0 {
+		test.Errorf("Expected strings to sometimes drift to floats")
+	}
+}
+
+// generateWithDrift generates template, returning what drifted along with the decoded JSON
+func generateWithDrift(test *testing.T, template string) (interface{}, string) {
+	generator, err := createJsonTemplate(template)
+	if err != nil {
+		test.Fatalf("Could not build %s: %v", template, err)
+	}
+	reporting, drifts := generator.(driftReportingGenerator)
+	if !drifts {
+		test.Fatalf("Expected %s to report drift", template)
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(generatedString(generator)), &value); err != nil {
+		test.Fatalf("%s generated invalid JSON: %v", template, err)
+	}
+	return value, fmt.Sprint(reporting.report.take())
+}
+
+func TestDrift(test *testing.T) {
+	users, report := generateWithDrift(test, "[user]:1000;user=age/int^30,name/string")
+	drifted := 0
+	for _, user := range users.([]interface{}) {
+		member := user.(map[string]interface{})
+		if _, isNumber := member["age"].(float64); !isNumber {
+			drifted++
+		}
+		if _, isString := member["name"].(string); !isString {
+			test.Errorf("Expected name to stay a string, got %v", member["name"])
+		}
+	}
+	if drifted < 230 || drifted > 370 {
+		test.Errorf("Expected about 300 ages to drift, got %d", drifted)
+	}
+	// ints never drift back to a number, so every drifted age is counted
+	if expected := fmt.Sprintf("map[user.age:%d]", drifted); report != expected {
+		test.Errorf("Expected the report %s, got %s", expected, report)
+	}
+
+	// the template's drift applies to every member that doesn't set its own
+	_, report = generateWithDrift(test, "[user]:10;^100;user=age/int,name/string^0,tags/[{id/int}]:1")
+	if report != "map[user.age:10 user.tags:10 user.tags[].id:10]" {
+		test.Errorf("Unexpected drift report %s", report)
+	}
+
+	_, report = generateWithDrift(test, "[{id/int^100}]:2")
+	if report != "map[$[].id:2]" {
+		test.Errorf("Unexpected drift report %s", report)
+	}
+
+	if generator, _ := createJsonTemplate("[user]:10;user=age/int"); generator != nil {
+		if _, drifts := generator.(driftReportingGenerator); drifts {
+			test.Errorf("Expected a template without drift not to report it")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package badness
+
+// Explain output for json_template. With X-Json-Explain, each document generated from the template is
+// wrapped in an object that says what went into it, so tests can check what their client was sent
+// without having to work it out from the JSON itself.
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// JsonExplain asks for X-Random-Json documents to be wrapped in the explain output
+const JsonExplain = "X-Json-Explain"
+
+// ---- explain generator -----
+// writes its generator's value inside an object that explains it, such as
+// {"template":"[user]:2;user=age/int^50","body":[{"age":"42"},{"age":7}],"drift":{"user.age":1}}
+type explainGenerator struct {
+	generator jsonElementGenerator
+	template  string
+	// counts the values that drift. nil if nothing can
+	drift *driftReport
+}
+
+func (generator explainGenerator) generate(writer io.Writer) (int, error) {
+	template, _ := json.Marshal(generator.template)
+	bytesTotal, err := fmt.Fprintf(writer, `{"template":%s,"body":`, template)
+	if err != nil {
+		return bytesTotal, err
+	}
+
+	bytes, err := generator.generator.generate(writer)
+	bytesTotal += bytes
+	if err != nil {
+		return bytesTotal, err
+	}
+
+	// each document reports only what drifted while it was written
+	drifted := make(map[string]int)
+	if generator.drift != nil {
+		drifted = generator.drift.take()
+	}
+	encoded, _ := json.Marshal(drifted)
+	bytes, err = fmt.Fprintf(writer, `,"drift":%s}`, encoded)
+	return bytesTotal + bytes, err
+}
+
+func newExplainGenerator(generator jsonElementGenerator, template string) jsonElementGenerator {
+	var drift *driftReport
+	if reporting, drifts := generator.(driftReportingGenerator); drifts {
+		drift = reporting.report
+	}
+	return explainGenerator{generator, template, drift}
+}
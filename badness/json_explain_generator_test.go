@@ -0,0 +1,86 @@
+package badness
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// explained is the explain output for one document
+type explained struct {
+	Template string
+	Body     []map[string]interface{}
+	Drift    map[string]int
+}
+
+func TestJsonExplain(test *testing.T) {
+	server := newPipelineServer()
+	defer server.Close()
+
+	requests := []map[string]string{
+		{},
+		{CodeByHistogram: "503=100"},
+		{EventStream: "events=2,interval=1ms,noretry"},
+	}
+	for _, headers := range requests {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		request.Header.Set(RandomJson, "response_template=[user]:5;user=age/int^100,name/string")
+		request.Header.Set(JsonExplain, "")
+		for header, value := range headers {
+			request.Header.Set(header, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			test.Fatalf("Request failed: %v", err)
+		}
+
+		// event streams explain each event's data
+		documents := make([]string, 0)
+		scanner := bufio.NewScanner(response.Body)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			if headers[EventStream] == "" {
+				documents = append(documents, scanner.Text())
+			} else if strings.HasPrefix(scanner.Text(), "data: ") {
+				documents = append(documents, strings.TrimPrefix(scanner.Text(), "data: "))
+			}
+		}
+		response.Body.Close()
+
+		expectedDocuments := 1
+		if headers[EventStream] != "" {
+			expectedDocuments = 2
+		}
+		if len(documents) != expectedDocuments {
+			test.Fatalf("%v: Expected %d documents, got %v", headers, expectedDocuments, documents)
+		}
+		for _, document := range documents {
+			var explanation explained
+			if err := json.Unmarshal([]byte(document), &explanation); err != nil {
+				test.Fatalf("%v: Expected the explain output to be JSON, got %s: %v", headers, document, err)
+			}
+			if explanation.Template != "[user]:5;user=age/int^100,name/string" || len(explanation.Body) != 5 {
+				test.Errorf("%v: Unexpected explain output %s", headers, document)
+			}
+			if len(explanation.Drift) != 1 || explanation.Drift["user.age"] != 5 {
+				test.Errorf("%v: Expected every age to drift, got %v", headers, explanation.Drift)
+			}
+		}
+	}
+
+	// templates without drift are explained too, and bad templates are reported as they are without it
+	generator, _ := createJsonTemplate("[int]:2")
+	output := generatedString(newExplainGenerator(generator, "[int]:2"))
+	if !strings.HasPrefix(output, `{"template":"[int]:2","body":[`) || !strings.HasSuffix(output, `],"drift":{}}`) {
+		test.Errorf("Unexpected explain output %s", output)
+	}
+
+	request := makeTestRequest()
+	request.Header[RandomJson] = []string{"response_template=[nonsense]:2"}
+	request.Header[JsonExplain] = []string{""}
+	if output := generatedString(getJsonTemplateGenerator(request)); strings.Contains(output, `"template"`) {
+		test.Errorf("Expected the error without explain output, got %s", output)
+	}
+}
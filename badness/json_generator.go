@@ -3,6 +3,7 @@ package badness
 import (
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"strconv"
 
@@ -33,27 +34,73 @@ func createJsonTemplate(input string) (jsonElementGenerator, error) {
 		return nil, fmt.Errorf("No json template definitions found")
 	}
 
-	return generatorFromDataDeclaration(template, template.Declarations[0])
+	builder, err := newTemplateBuilder(template)
+	if err != nil {
+		return nil, err
+	}
+	generator, err := generatorFromDataDeclaration(builder, template.Declarations[0])
+	if err != nil {
+		return nil, err
+	}
+	if builder.drift != nil {
+		return driftReportingGenerator{generator, builder.drift}, nil
+	}
+	return generator, nil
+}
+
+// templateBuilder holds what's needed while a template is turned into generators
+type templateBuilder struct {
+	template *json_template.Template
+	// each custom type is built once and shared by everything that uses it. A type that contains
+	// itself is used inside its own object, so its generators form a loop
+	customTypes map[string]*customType
+	// the values written for each custom type member that a ref repeats, keyed by type.member
+	pools map[string]*valuePool
+	// where in the template the generator being built is, such as user.tags[], for naming fields that drift
+	field string
+	// counts the values that drift. nil if nothing can
+	drift *driftReport
+}
+
+func newTemplateBuilder(template *json_template.Template) (*templateBuilder, error) {
+	pools, err := referencePools(template)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReferenceOrder(template); err != nil {
+		return nil, err
+	}
+	return &templateBuilder{template: template, customTypes: make(map[string]*customType), pools: pools, field: "$"}, nil
+}
+
+// driftProbability returns the chance (0-1) of a member's value drifting to another type
+func (builder *templateBuilder) driftProbability(member json_template.KeyValueDataType) float64 {
+	if member.DriftPercentage >= 0 {
+		return member.DriftPercentage / 100
+	}
+	return builder.template.DriftPercentage / 100
 }
 
 // generatorFromDataDeclaration takes a json_template DataDeclaration and converts it
 // to the appropriate json generator.
-func generatorFromDataDeclaration(template *json_template.Template, declaration json_template.DataDeclaration) (jsonElementGenerator, error) {
+func generatorFromDataDeclaration(builder *templateBuilder, declaration json_template.DataDeclaration) (jsonElementGenerator, error) {
 	switch declaration.(type) {
 	case json_template.PrimitiveDataType:
 		return primitiveGeneratorFromDataType(declaration.(json_template.PrimitiveDataType))
 	case json_template.ArrayDataType:
-		return arrayGeneratorFromDataType(template, declaration.(json_template.ArrayDataType))
+		return arrayGeneratorFromDataType(builder, declaration.(json_template.ArrayDataType))
 	case json_template.KeyValueDataType:
-		return keyValueGeneratorFromDataType(template, declaration.(json_template.KeyValueDataType))
+		return keyValueGeneratorFromDataType(builder, declaration.(json_template.KeyValueDataType))
 	case json_template.KeyNameDataType:
-		// ensure parser has an object of the given type
-		key := declaration.(json_template.KeyNameDataType).Literal
-		object, found := template.CustomTypes[key]
-		if !found {
-			return nil, fmt.Errorf("Unknown data type: %s", key)
-		}
-		return objectGeneratorFromDataType(template, object.(json_template.ObjectDataType))
+		return customTypeGeneratorFromName(builder, declaration.(json_template.KeyNameDataType).Literal, "")
+	case json_template.ObjectDataType:
+		return objectGeneratorFromDataType(builder, declaration.(json_template.ObjectDataType), "")
+	case json_template.UnionDataType:
+		return unionGeneratorFromDataType(builder, declaration.(json_template.UnionDataType))
+	case json_template.ReferenceDataType:
+		reference := declaration.(json_template.ReferenceDataType)
+		pool := builder.pools[referencePoolKey(reference.Type, reference.Member)]
+		return newReferenceGenerator(pool, reference.DanglingPercentage/100), nil
 	case json_template.EnumStringDataType:
 		return enumGeneratorFromStringEnumDataType(declaration.(json_template.EnumStringDataType))
 	case json_template.EnumIntDataType:
@@ -65,99 +112,263 @@ func generatorFromDataDeclaration(template *json_template.Template, declaration
 	}
 }
 
-func objectGeneratorFromDataType(template *json_template.Template, object json_template.ObjectDataType) (jsonElementGenerator, error) {
+// objectGeneratorFromDataType builds object's members. typeName is the custom type the object belongs to,
+// or empty if it's inline
+func objectGeneratorFromDataType(builder *templateBuilder, object json_template.ObjectDataType, typeName string) (jsonElementGenerator, error) {
+	// members that are mirrored keep hold of their values for the mirrors to repeat
+	sources := make(map[string]*mirrorSource)
+	for _, keyValueData := range object.Members {
+		if mirror, isMirror := keyValueData.Value.(json_template.MirrorDataType); isMirror {
+			sources[mirror.Member] = &mirrorSource{}
+		}
+	}
+
+	objectField := builder.field
+	defer func() { builder.field = objectField }()
+
 	keyValues := make([]keyValueGenerator, 0, len(object.Members))
 	for _, keyValueData := range object.Members {
-		generator, err := keyValueGeneratorFromDataType(template, keyValueData)
+		builder.field = objectField + "." + keyValueData.Key
+		var generator jsonElementGenerator
+		if mirror, isMirror := keyValueData.Value.(json_template.MirrorDataType); isMirror {
+			generator = newOptionalKeyValueGenerator(keyValueData.Key, newMirrorGenerator(sources[mirror.Member]),
+				keyValueData.NullPercentage/100, keyValueData.AbsentPercentage/100)
+		} else {
+			var err error
+			if generator, err = keyValueGeneratorFromDataType(builder, keyValueData); err != nil {
+				return nil, err
+			}
+		}
+
+		// refs and mirrors repeat the value as it was generated, before it has a chance to drift
+		keyValue := generator.(keyValueGenerator)
+		if pool, referenced := builder.pools[referencePoolKey(typeName, keyValueData.Key)]; referenced && typeName != "" {
+			pool.generator = keyValue.value
+			keyValue.value = newPooledGenerator(keyValue.value, pool)
+		}
+		if source, mirrored := sources[keyValueData.Key]; mirrored {
+			keyValue.value = newRecordingGenerator(keyValue.value, source)
+		}
+		if probability := builder.driftProbability(keyValueData); probability > 0 {
+			if builder.drift == nil {
+				builder.drift = newDriftReport()
+			}
+			keyValue.value = newDriftGenerator(keyValue.value, probability, builder.field, builder.drift)
+		}
+		keyValues = append(keyValues, keyValue)
+	}
+
+	if len(sources) == 0 {
+		return newObjectGenerator(keyValues), nil
+	}
+	sourceList := make([]*mirrorSource, 0, len(sources))
+	for _, source := range sources {
+		sourceList = append(sourceList, source)
+	}
+	return newMirroringObjectGenerator(keyValues, sourceList), nil
+}
+
+// unionGeneratorFromDataType builds a generator for each of the union's types. If the union has a
+// discriminator, each type's objects start with a member naming the type
+func unionGeneratorFromDataType(builder *templateBuilder, union json_template.UnionDataType) (jsonElementGenerator, error) {
+	alternatives := make([]jsonElementGenerator, 0, len(union.Types))
+	for _, customType := range union.Types {
+		generator, err := customTypeGeneratorFromName(builder, customType.Literal, union.Discriminator)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, generator)
+	}
+	return newUnionGenerator(alternatives), nil
+}
+
+// customTypeGeneratorFromName returns a generator for the named custom type, building the type the first
+// time it's used. discriminator is the key of a member naming the type, or empty if there isn't one
+func customTypeGeneratorFromName(builder *templateBuilder, name string, discriminator string) (jsonElementGenerator, error) {
+	definition, found := builder.customTypes[name]
+	if !found {
+		declaration, found := builder.template.CustomTypes[name]
+		if !found {
+			return nil, fmt.Errorf("Unknown data type: %s", name)
+		}
+
+		// the type is registered before its members are built, so that members using the type find it
+		definition = &customType{name: name, maxDepth: builder.template.MaxDepth(name)}
+		builder.customTypes[name] = definition
+		// the type is shared wherever it's used, so its fields are named after the type
+		field := builder.field
+		builder.field = name
+		object, err := objectGeneratorFromDataType(builder, declaration.(json_template.ObjectDataType), name)
+		builder.field = field
 		if err != nil {
 			return nil, err
 		}
-		keyValues = append(keyValues, generator.(keyValueGenerator))
+		definition.object = object.(objectGenerator)
 	}
-	return newObjectGenerator(keyValues), nil
+	return newCustomTypeGenerator(definition, discriminator), nil
 }
 
-func keyValueGeneratorFromDataType(template *json_template.Template, declaration json_template.KeyValueDataType) (jsonElementGenerator, error) {
-	valueGenerator, err := generatorFromDataDeclaration(template, declaration.Value)
+func keyValueGeneratorFromDataType(builder *templateBuilder, declaration json_template.KeyValueDataType) (jsonElementGenerator, error) {
+	valueGenerator, err := generatorFromDataDeclaration(builder, declaration.Value)
 	if err != nil {
 		return nil, err
 	}
-	return newKeyValueGenerator(declaration.Key, valueGenerator), nil
+	return newOptionalKeyValueGenerator(declaration.Key, valueGenerator, declaration.NullPercentage/100, declaration.AbsentPercentage/100), nil
 }
 
-func arrayGeneratorFromDataType(template *json_template.Template, declaration json_template.ArrayDataType) (jsonElementGenerator, error) {
-	nestedGenerator, err := generatorFromDataDeclaration(template, declaration.NestedType)
+func arrayGeneratorFromDataType(builder *templateBuilder, declaration json_template.ArrayDataType) (jsonElementGenerator, error) {
+	field := builder.field
+	builder.field += "[]"
+	nestedGenerator, err := generatorFromDataDeclaration(builder, declaration.NestedType)
+	builder.field = field
 	if err != nil {
 		return nil, err
 	}
-	return newArrayGenerator(declaration.Length, nestedGenerator), nil
+	if len(declaration.Lengths) == 0 {
+		return newArrayGenerator(declaration.Length, nestedGenerator), nil
+	}
+
+	weights := make([]float64, 0, len(declaration.Lengths))
+	for _, length := range declaration.Lengths {
+		weights = append(weights, length.Weight)
+	}
+	buckets := weightsToBuckets(weights)
+	lengths := make([]arrayLength, 0, len(declaration.Lengths))
+	for index, length := range declaration.Lengths {
+		lengths = append(lengths, arrayLength{buckets[index], length.Min, length.Max})
+	}
+	return newVariableArrayGenerator(lengths, nestedGenerator), nil
 }
 
 func primitiveGeneratorFromDataType(declaration json_template.PrimitiveDataType) (jsonElementGenerator, error) {
-	switch declaration.TokenLiteral() {
+	bounds := declaration.Range
+	switch declaration.Literal {
 	case "string":
-		return newRandomStringGenerator(), nil
+		minLength, maxLength := 30, 30
+		if bounds != nil {
+			minLength, maxLength = int(bounds.Min), int(bounds.Max)
+		}
+		if charset, found := stringCharsetsByName[declaration.Format]; found {
+			return newCharsetStringGenerator(minLength, maxLength, charset), nil
+		}
+		return newRandomStringRangeGenerator(minLength, maxLength), nil
 	case "int":
-		return newIntGenerator(10000), nil
+		if bounds == nil {
+			return newIntGenerator(10000), nil
+		}
+		return newIntRangeGenerator(int64(bounds.Min), int64(bounds.Max)), nil
 	case "bool":
 		return newBooleanGenerator(), nil
 	case "increment":
 		return newIncrementGenerator(1), nil
 	case "float":
-		return newFloatGenerator(1.0), nil
+		if bounds == nil {
+			return newFloatGenerator(1.0), nil
+		}
+		return newFloatRangeGenerator(bounds.Min, bounds.Max, bounds.Precision), nil
 	default:
+		if generator, found := semanticGeneratorFromDataType(declaration); found {
+			return generator, nil
+		}
 		return nil, fmt.Errorf("Unknown primitive type: %s", declaration.TokenLiteral())
 	}
 }
 
 func enumGeneratorFromStringEnumDataType(declaration json_template.EnumStringDataType) (jsonElementGenerator, error) {
-	return newStringFromSetGenerator(declaration.Values), nil
+	return newWeightedStringFromSetGenerator(declaration.Values, declaration.Weights), nil
 }
 
 func enumGeneratorFromIntEnumDataType(declaration json_template.EnumIntDataType) (jsonElementGenerator, error) {
-	return newIntFromSetGenerator(declaration.Values), nil
+	return newWeightedIntFromSetGenerator(declaration.Values, declaration.Weights), nil
 }
 
 func enumGeneratorFromFloatEnumDataType(declaration json_template.EnumFloatDataType) (jsonElementGenerator, error) {
-	return newFloatFromSetGenerator(declaration.Values), nil
+	return newWeightedFloatFromSetGenerator(declaration.Values, declaration.Weights), nil
+}
+
+// weightsToBuckets converts percentage weights, which might not add up to 100, to histogram buckets.
+// nil weights give nil buckets
+func weightsToBuckets(weights []float64) []histogramBucket {
+	if weights == nil {
+		return nil
+	}
+
+	totalWeight := 0.0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+	buckets := make([]histogramBucket, 0, len(weights))
+	for _, weight := range weights {
+		buckets = append(buckets, histogramBucket{weight / totalWeight})
+	}
+	return buckets
+}
+
+// pickFromSet picks an index into a set of count values. Without buckets, every value is as likely
+func pickFromSet(count int, buckets []histogramBucket) int {
+	if buckets == nil {
+		return rand.Intn(count)
+	}
+	index := bucketForProbability(rand.Float64(), buckets)
+	if index == bucketNotFound {
+		// rounding can leave the cumulative probability a hair under 1
+		index = count - 1
+	}
+	return index
 }
 
 type stringFromSetGenerator struct {
-	values []string
+	values  []string
+	buckets []histogramBucket
 }
 
 func (generator stringFromSetGenerator) generate(writer io.Writer) (int, error) {
-	index := rand.Intn(len(generator.values))
+	index := pickFromSet(len(generator.values), generator.buckets)
 	return newFixedStringGenerator(generator.values[index]).generate(writer)
 }
 
 func newStringFromSetGenerator(values []string) jsonElementGenerator {
-	return &stringFromSetGenerator{values}
+	return newWeightedStringFromSetGenerator(values, nil)
+}
+
+// newWeightedStringFromSetGenerator picks values according to weights, which are percentages
+func newWeightedStringFromSetGenerator(values []string, weights []float64) jsonElementGenerator {
+	return &stringFromSetGenerator{values, weightsToBuckets(weights)}
 }
 
 type intFromSetGenerator struct {
-	values []int
+	values  []int
+	buckets []histogramBucket
 }
 
 func (generator intFromSetGenerator) generate(writer io.Writer) (int, error) {
-	index := rand.Intn(len(generator.values))
+	index := pickFromSet(len(generator.values), generator.buckets)
 	return newFixedIntGenerator(generator.values[index]).generate(writer)
 }
 
 func newIntFromSetGenerator(values []int) jsonElementGenerator {
-	return &intFromSetGenerator{values}
+	return newWeightedIntFromSetGenerator(values, nil)
+}
+
+func newWeightedIntFromSetGenerator(values []int, weights []float64) jsonElementGenerator {
+	return &intFromSetGenerator{values, weightsToBuckets(weights)}
 }
 
 type floatFromSetGenerator struct {
-	values []float64
+	values  []float64
+	buckets []histogramBucket
 }
 
 func (generator floatFromSetGenerator) generate(writer io.Writer) (int, error) {
-	index := rand.Intn(len(generator.values))
+	index := pickFromSet(len(generator.values), generator.buckets)
 	return fixedFloatGenerator{generator.values[index]}.generate(writer)
 }
 func newFloatFromSetGenerator(values []float64) jsonElementGenerator {
-	return floatFromSetGenerator{values}
+	return newWeightedFloatFromSetGenerator(values, nil)
+}
+
+func newWeightedFloatFromSetGenerator(values []float64, weights []float64) jsonElementGenerator {
+	return floatFromSetGenerator{values, weightsToBuckets(weights)}
 }
 
 // writeGeneratorsInList concatenates the output of the generators into the writer with the given character
@@ -202,26 +413,48 @@ func newNoItemGenerator() jsonElementGenerator {
 var quote = []byte{'"'}
 
 type randomStringGenerator struct {
-	length int
+	minLength int
+	maxLength int
+	// characters to use in place of ASCII letters, if set
+	charset stringCharset
 }
 
 func (generator randomStringGenerator) generate(writer io.Writer) (int, error) {
-	buffer := make([]byte, generator.length+2)
+	length := generator.minLength + rand.Intn(generator.maxLength-generator.minLength+1)
+	if generator.charset != nil {
+		content := generator.charset(length)
+		buffer := make([]byte, 0, len(content)+2)
+		buffer = append(append(append(buffer, '"'), content...), '"')
+		return writer.Write(buffer)
+	}
+
+	buffer := make([]byte, length+2)
 	buffer[0] = '"'
 
-	for current := 0; current < generator.length; current++ {
+	for current := 0; current < length; current++ {
 		randomIndex := rand.Intn(len(stringCharacters))
 		buffer[current+1] = stringCharacters[randomIndex]
 	}
 	// terminal quote is the full length - 1
-	buffer[generator.length+2-1] = '"'
+	buffer[length+2-1] = '"'
 
-	bytesWritten, err := writer.Write(buffer[0 : generator.length+2])
+	bytesWritten, err := writer.Write(buffer[0 : length+2])
 	return bytesWritten, err
 }
 
 func newRandomStringGenerator() jsonElementGenerator {
-	return randomStringGenerator{30}
+	return randomStringGenerator{30, 30, nil}
+}
+
+// newRandomStringRangeGenerator generates strings between minLength and maxLength characters long
+func newRandomStringRangeGenerator(minLength, maxLength int) jsonElementGenerator {
+	return randomStringGenerator{minLength, maxLength, nil}
+}
+
+// newCharsetStringGenerator generates strings between minLength and maxLength characters long, made up
+// of characters from charset
+func newCharsetStringGenerator(minLength, maxLength int, charset stringCharset) jsonElementGenerator {
+	return randomStringGenerator{minLength, maxLength, charset}
 }
 
 // ---- Generate constant strings -----
@@ -265,32 +498,65 @@ func newBooleanGenerator() jsonElementGenerator {
 	return &booleanGenerator{}
 }
 
-// --------- int generator. generates a random number up to the max
+// --------- int generator. generates a random number between min and max, inclusive
 type intGenerator struct {
-	maxNumber int
+	min int64
+	max int64
 }
 
 func (generator intGenerator) generate(writer io.Writer) (int, error) {
-	intToWrite := rand.Intn(generator.maxNumber)
-	nestedGenerator := fixedIntGenerator{intToWrite}
-	return nestedGenerator.generate(writer)
+	intToWrite := generator.min
+	// counted unsigned, since a range can be wider than the biggest int64. The subtraction and addition
+	// wrap around to the right values
+	span := uint64(generator.max-generator.min) + 1
+	switch {
+	case span == 0:
+		// a range covering every int64 is too big to count, but any int64 will do for it
+		intToWrite = int64(rand.Uint64())
+	case span <= math.MaxInt64:
+		intToWrite += rand.Int63n(int64(span))
+	default:
+		// more than half of all uint64s are in the span, so this doesn't take long
+		offset := rand.Uint64()
+		for offset >= span {
+			offset = rand.Uint64()
+		}
+		intToWrite += int64(offset)
+	}
+	return writer.Write([]byte(strconv.FormatInt(intToWrite, 10)))
 }
 
+// newIntGenerator generates numbers from 0 up to (but not including) maxNum
 func newIntGenerator(maxNum int) jsonElementGenerator {
-	return intGenerator{maxNum}
+	return intGenerator{0, int64(maxNum) - 1}
+}
+
+func newIntRangeGenerator(min, max int64) jsonElementGenerator {
+	return intGenerator{min, max}
 }
 
-// ----------------- float generates a random float up to the max
+// ----------------- float generates a random float between min and max
 type floatGenerator struct {
-	maxNumber float64
+	min float64
+	max float64
+	// decimal places to write. Negative uses fixedFloatGenerator's format
+	precision int
 }
 
 func (generator floatGenerator) generate(writer io.Writer) (int, error) {
-	return fixedFloatGenerator{rand.Float64() * generator.maxNumber}.generate(writer)
+	value := generator.min + rand.Float64()*(generator.max-generator.min)
+	if generator.precision < 0 {
+		return fixedFloatGenerator{value}.generate(writer)
+	}
+	return writer.Write([]byte(strconv.FormatFloat(value, 'f', generator.precision, 64)))
 }
 
 func newFloatGenerator(max float64) jsonElementGenerator {
-	return floatGenerator{max}
+	return floatGenerator{0, max, -1}
+}
+
+func newFloatRangeGenerator(min, max float64, precision int) jsonElementGenerator {
+	return floatGenerator{min, max, precision}
 }
 
 type fixedFloatGenerator struct {
@@ -340,44 +606,86 @@ var rightBracket = []byte{']'}
 var comma = []byte{','}
 
 type arrayGenerator struct {
-	length            int
+	length int
+	// if set, the length is picked from these each time the array is generated
+	lengths           []arrayLength
 	generatorToRepeat jsonElementGenerator
 }
 
+// arrayLength is an inclusive range of lengths, along with the chance of an array's length being in it
+type arrayLength struct {
+	histogramBucket
+	min int
+	max int
+}
+
 func (generator arrayGenerator) generate(writer io.Writer) (int, error) {
 	bytesTotal, err := writer.Write(leftBracket)
 	if err != nil {
 		return bytesTotal, err
 	}
 
-	// make a list of generators to conform to writeGenerators spec
-	generators := make([]jsonElementGenerator, 0)
-	for index := 0; index < generator.length; index++ {
-		generators = append(generators, generator.generatorToRepeat)
+	length := 0
+	// arrays of a type that's nested as deep as it can go are left empty, which is where its tree ends
+	if !isAtMaxDepth(generator.generatorToRepeat) {
+		length = generator.pickLength()
 	}
+	for index := 0; index < length; index++ {
+		if index > 0 {
+			bytes, err := writer.Write(comma)
+			bytesTotal += bytes
+			if err != nil {
+				return bytesTotal, err
+			}
+		}
 
-	bytes, err := writeGeneratorsInList(generators, writer, ",")
-	bytesTotal += bytes
-	if err != nil {
-		return bytesTotal, err
+		bytes, err := generator.generatorToRepeat.generate(writer)
+		bytesTotal += bytes
+		if err != nil {
+			return bytesTotal, err
+		}
 	}
 
-	bytes, err = writer.Write(rightBracket)
+	bytes, err := writer.Write(rightBracket)
 	bytesTotal += bytes
 	return bytesTotal, err
 }
 
+// pickLength decides how many items go in the array this time
+func (generator arrayGenerator) pickLength() int {
+	if len(generator.lengths) == 0 {
+		return generator.length
+	}
+
+	buckets := make([]histogramBucket, 0, len(generator.lengths))
+	for _, length := range generator.lengths {
+		buckets = append(buckets, length.histogramBucket)
+	}
+	chosen := generator.lengths[pickFromSet(len(buckets), buckets)]
+	return chosen.min + rand.Intn(chosen.max-chosen.min+1)
+}
+
 func newArrayGenerator(length int, generator jsonElementGenerator) jsonElementGenerator {
-	return arrayGenerator{length, generator}
+	return arrayGenerator{length: length, generatorToRepeat: generator}
+}
+
+// newVariableArrayGenerator generates arrays whose lengths are picked from lengths
+func newVariableArrayGenerator(lengths []arrayLength, generator jsonElementGenerator) jsonElementGenerator {
+	return arrayGenerator{lengths: lengths, generatorToRepeat: generator}
 }
 
 // -------------------- keyvalue generator -------------------
 type keyValueGenerator struct {
 	key   fixedStringGenerator
 	value jsonElementGenerator
+	// the chance (0-1) of writing null instead of the value
+	nullProbability float64
+	// the chance (0-1) of the object leaving this member out
+	absentProbability float64
 }
 
 var colon = []byte{':'}
+var null = []byte("null")
 
 func (generator keyValueGenerator) generate(writer io.Writer) (int, error) {
 	bytesTotal, err := generator.key.generate(writer)
@@ -391,13 +699,28 @@ func (generator keyValueGenerator) generate(writer io.Writer) (int, error) {
 		return bytesTotal, err
 	}
 
-	bytes, err = generator.value.generate(writer)
+	if generator.nullProbability > 0 && rand.Float64() < generator.nullProbability {
+		bytes, err = writer.Write(null)
+	} else {
+		bytes, err = generator.value.generate(writer)
+	}
 	bytesTotal += bytes
 	return bytesTotal, err
 }
 
+// isAbsent decides whether to leave the member out this time
+func (generator keyValueGenerator) isAbsent() bool {
+	return generator.absentProbability > 0 && rand.Float64() < generator.absentProbability
+}
+
 func newKeyValueGenerator(key string, value jsonElementGenerator) jsonElementGenerator {
-	return keyValueGenerator{newFixedStringGenerator(key).(fixedStringGenerator), value}
+	return newOptionalKeyValueGenerator(key, value, 0, 0)
+}
+
+// newOptionalKeyValueGenerator builds a keyValueGenerator whose value is sometimes null, or that's sometimes
+// left out of its object. Probabilities are 0-1
+func newOptionalKeyValueGenerator(key string, value jsonElementGenerator, nullProbability, absentProbability float64) jsonElementGenerator {
+	return keyValueGenerator{newFixedStringGenerator(key).(fixedStringGenerator), value, nullProbability, absentProbability}
 }
 
 // -------------- object generator
@@ -406,18 +729,37 @@ var rightBrace = []byte{'}'}
 
 type objectGenerator struct {
 	generators []keyValueGenerator
+	// the values of members that mirrors repeat
+	sources []*mirrorSource
 }
 
 func (generator objectGenerator) generate(writer io.Writer) (int, error) {
+	// mirrored members start out unwritten. The values are put back afterwards, in case this object is
+	// nested inside another of the same type that still has mirrors to write
+	if len(generator.sources) > 0 {
+		saved := make([][]byte, len(generator.sources))
+		for index, source := range generator.sources {
+			saved[index], source.value = source.value, nil
+		}
+		defer func() {
+			for index, source := range generator.sources {
+				source.value = saved[index]
+			}
+		}()
+	}
+
 	bytesTotal, err := writer.Write(leftBrace)
 	if err != nil {
 		return bytesTotal, err
 	}
 
-	// convert generator list  to jsonElementGenerator
+	// convert generator list  to jsonElementGenerator, leaving out absent members so
+	// the commas only go between the ones that are written
 	generators := make([]jsonElementGenerator, 0)
 	for _, generator := range generator.generators {
-		generators = append(generators, jsonElementGenerator(generator))
+		if !generator.isAbsent() {
+			generators = append(generators, jsonElementGenerator(generator))
+		}
 	}
 
 	bytes, err := writeGeneratorsInList(generators, writer, ",")
@@ -432,5 +774,113 @@ func (generator objectGenerator) generate(writer io.Writer) (int, error) {
 }
 
 func newObjectGenerator(generators []keyValueGenerator) jsonElementGenerator {
-	return objectGenerator{generators}
+	return objectGenerator{generators, nil}
+}
+
+// newMirroringObjectGenerator builds an object with members whose values are kept in sources for mirrors
+func newMirroringObjectGenerator(generators []keyValueGenerator, sources []*mirrorSource) jsonElementGenerator {
+	return objectGenerator{generators, sources}
+}
+
+// withDiscriminator returns a copy of object whose first member is key, holding typeName. A member
+// the object already had with that key is left out, so the key isn't written twice
+func withDiscriminator(object objectGenerator, key string, typeName string) jsonElementGenerator {
+	discriminator := newKeyValueGenerator(key, newFixedStringGenerator(typeName)).(keyValueGenerator)
+	generators := []keyValueGenerator{discriminator}
+	for _, generator := range object.generators {
+		if generator.key.fixedString != key {
+			generators = append(generators, generator)
+		}
+	}
+	return newMirroringObjectGenerator(generators, object.sources)
+}
+
+// -------------- custom type generator
+// customType is shared by every generator that writes the type. depth counts how many of its objects are
+// being written right now, one inside the other
+type customType struct {
+	name     string
+	object   objectGenerator
+	depth    int
+	maxDepth int
+}
+
+// depthLimited generators write null once they're nested too deep
+type depthLimited interface {
+	atMaxDepth() bool
+}
+
+func isAtMaxDepth(generator jsonElementGenerator) bool {
+	limited, isLimited := generator.(depthLimited)
+	return isLimited && limited.atMaxDepth()
+}
+
+// writes a custom type's object, or null once the type is nested maxDepth deep inside itself
+type customTypeGenerator struct {
+	definition *customType
+	// if set, the key of a member naming the type, which is written first
+	discriminator string
+	// the object to write. It's worked out the first time it's needed, since the type may still have
+	// been being built when this generator was created
+	object jsonElementGenerator
+}
+
+func (generator *customTypeGenerator) generate(writer io.Writer) (int, error) {
+	if generator.atMaxDepth() {
+		return writer.Write(null)
+	}
+
+	definition := generator.definition
+	if generator.object == nil {
+		generator.object = definition.object
+		if generator.discriminator != "" {
+			generator.object = withDiscriminator(definition.object, generator.discriminator, definition.name)
+		}
+	}
+
+	definition.depth++
+	defer func() { definition.depth-- }()
+	return generator.object.generate(writer)
+}
+
+func (generator *customTypeGenerator) atMaxDepth() bool {
+	return generator.definition.depth >= generator.definition.maxDepth
+}
+
+func newCustomTypeGenerator(definition *customType, discriminator string) jsonElementGenerator {
+	return &customTypeGenerator{definition: definition, discriminator: discriminator}
+}
+
+// -------------- union generator
+// writes one of its alternatives, picked at random each time
+type unionGenerator struct {
+	alternatives []jsonElementGenerator
+}
+
+func (generator unionGenerator) generate(writer io.Writer) (int, error) {
+	alternatives := generator.available()
+	if len(alternatives) == 0 {
+		return writer.Write(null)
+	}
+	return alternatives[pickFromSet(len(alternatives), nil)].generate(writer)
+}
+
+// available returns the alternatives that aren't nested as deep as they can go, so that a recursive
+// union ends with its other types
+func (generator unionGenerator) available() []jsonElementGenerator {
+	available := make([]jsonElementGenerator, 0, len(generator.alternatives))
+	for _, alternative := range generator.alternatives {
+		if !isAtMaxDepth(alternative) {
+			available = append(available, alternative)
+		}
+	}
+	return available
+}
+
+func (generator unionGenerator) atMaxDepth() bool {
+	return len(generator.available()) == 0
+}
+
+func newUnionGenerator(alternatives []jsonElementGenerator) jsonElementGenerator {
+	return unionGenerator{alternatives}
 }
@@ -2,9 +2,14 @@ package badness
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"regexp"
+	"strconv"
 	"testing"
+
+	"bad-server/badness/json_template"
 )
 
 // expectations when there are not errors midstream
@@ -132,11 +137,18 @@ func TestInterruptedJson(test *testing.T) {
 func TestTemplateDefinitionToJson(test *testing.T) {
 	// template language strings to expected json regex
 	tests := map[string]string{
-		"string":                 "^\"[a-zA-Z]{30}\"$",
-		"int":                    "^[0-9]+$",
-		"bool":                   "^(true|false)$",
-		"[string]:1":             "^\\[\"[a-zA-Z]{30}\"\\]",
-		"test;test=title/string": "^{\"title\":\"[a-zA-Z]{30}\"}$",
+		"string":                   "^\"[a-zA-Z]{30}\"$",
+		"int":                      "^[0-9]+$",
+		"bool":                     "^(true|false)$",
+		"[string]:1":               "^\\[\"[a-zA-Z]{30}\"\\]",
+		"test;test=title/string":   "^{\"title\":\"[a-zA-Z]{30}\"}$",
+		"int:-5..-5":               "^-5$",
+		"float:1..1:2":             "^1.00$",
+		"string:3":                 "^\"[a-zA-Z]{3}\"$",
+		"[string:0..2]:2":          "^\\[\"[a-zA-Z]{0,2}\",\"[a-zA-Z]{0,2}\"\\]$",
+		"[[int:1]:2]:2":            "^\\[\\[1,1\\],\\[1,1\\]\\]$",
+		"{id/int:7,tags/[bool]:1}": "^{\"id\":7,\"tags\":\\[(true|false)\\]}$",
+		"[{a/{b/int:2}}]:1":        "^\\[{\"a\":{\"b\":2}}\\]$",
 	}
 
 	for input, expected := range tests {
@@ -153,6 +165,248 @@ func TestTemplateDefinitionToJson(test *testing.T) {
 	}
 }
 
+func TestUnions(test *testing.T) {
+	generator, err := createJsonTemplate("[circle|square@kind]:200;circle=radius/int:1,kind/int;square=side/int:2")
+	if err != nil {
+		test.Fatalf("Could not build template: %v", err)
+	}
+	var shapes []map[string]interface{}
+	if err := json.Unmarshal([]byte(generatedString(generator)), &shapes); err != nil {
+		test.Fatalf("Union generated invalid JSON: %v", err)
+	}
+
+	counts := map[string]int{}
+	for _, shape := range shapes {
+		kind, _ := shape["kind"].(string)
+		counts[kind]++
+		// the discriminator replaces circle's own kind member
+		if len(shape) != 2 || (kind == "circle" && shape["radius"] != 1.0) || (kind == "square" && shape["side"] != 2.0) {
+			test.Errorf("Unexpected shape %v", shape)
+		}
+	}
+	if counts["circle"] < 60 || counts["square"] < 60 {
+		test.Errorf("Expected about as many circles as squares, got %v", counts)
+	}
+
+	// without a discriminator, the objects are written as they are
+	generator, _ = createJsonTemplate("[circle|square]:1;circle=radius/int:1;square=radius/int:1")
+	if generated := generatedString(generator); generated != "[{\"radius\":1}]" {
+		test.Errorf("Expected [{\"radius\":1}], got %s", generated)
+	}
+
+	if _, err := createJsonTemplate("drawing;drawing=shape/circle|hexagon@kind;circle=radius/int"); err == nil {
+		test.Errorf("Expected an error for a union of an unknown type")
+	}
+}
+
+// generatedJson generates template and decodes the result
+func generatedJson(test *testing.T, template string) interface{} {
+	generator, err := createJsonTemplate(template)
+	if err != nil {
+		test.Fatalf("Could not build %s: %v", template, err)
+	}
+	var value interface{}
+	generated := generatedString(generator)
+	if err := json.Unmarshal([]byte(generated), &value); err != nil {
+		test.Fatalf("%s generated invalid JSON %s: %v", template, generated, err)
+	}
+	return value
+}
+
+// treeDepth returns how many objects with a member named key are nested inside each other in value
+func treeDepth(value interface{}, key string) int {
+	deepest := 0
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for _, member := range typed {
+			if depth := treeDepth(member, key); depth > deepest {
+				deepest = depth
+			}
+		}
+		if _, found := typed[key]; found {
+			deepest++
+		}
+	case []interface{}:
+		for _, item := range typed {
+			if depth := treeDepth(item, key); depth > deepest {
+				deepest = depth
+			}
+		}
+	}
+	return deepest
+}
+
+func TestRecursiveTypes(test *testing.T) {
+	// every comment has two replies, until the third level where the replies are empty
+	comment := generatedJson(test, "comment;comment:3=text/string:1,replies/[comment]:2")
+	if treeDepth(comment, "replies") != 3 {
+		test.Errorf("Expected comments 3 deep, got %v", comment)
+	}
+	replies := comment.(map[string]interface{})["replies"].([]interface{})
+	deepest := replies[1].(map[string]interface{})["replies"].([]interface{})[0]
+	if len(replies) != 2 || len(deepest.(map[string]interface{})["replies"].([]interface{})) != 0 {
+		test.Errorf("Expected two replies, and none at the deepest level, got %v", comment)
+	}
+
+	// a reference that isn't in an array is null at the maximum depth
+	node := generatedJson(test, "node;node:2=id/int:1,next/node")
+	expected := map[string]interface{}{"id": 1.0, "next": map[string]interface{}{"id": 1.0, "next": nil}}
+	if !reflect.DeepEqual(node, expected) {
+		test.Errorf("Expected %v, got %v", expected, node)
+	}
+
+	// types that contain each other use the default depth
+	employee := generatedJson(test, "employee;employee=name/string:1,reports/[team]:1;team=members/[employee]:1")
+	if depth := treeDepth(employee, "name"); depth != json_template.DefaultMaxDepth {
+		test.Errorf("Expected employees %d deep, got %d", json_template.DefaultMaxDepth, depth)
+	}
+
+	// once tree can't go any deeper, the union only picks leaves
+	for count := 0; count < 20; count++ {
+		tree := generatedJson(test, "tree;tree:3=children/[leaf|tree@kind]:3;leaf=value/int:1")
+		if depth := treeDepth(tree, "children"); depth > 3 {
+			test.Errorf("Expected trees at most 3 deep, got %d", depth)
+		}
+	}
+
+	// branching comes from the array's lengths
+	for count := 0; count < 20; count++ {
+		if depth := treeDepth(generatedJson(test, "comment;comment:4=replies/[comment]:0=30,1..3"), "replies"); depth > 4 {
+			test.Errorf("Expected comments at most 4 deep, got %d", depth)
+		}
+	}
+}
+
+func TestPrimitiveRanges(test *testing.T) {
+	ints, _ := createJsonTemplate("int:-3..3")
+	floats, _ := createJsonTemplate("float:10..20:1")
+	strings, _ := createJsonTemplate("string:2..4")
+
+	seenInts := make(map[int]bool)
+	for attempt := 0; attempt < 500; attempt++ {
+		number, err := strconv.Atoi(generatedString(ints))
+		if err != nil || number < -3 || number > 3 {
+			test.Fatalf("Expected an int between -3 and 3, got %d (%v)", number, err)
+		}
+		seenInts[number] = true
+
+		float := generatedString(floats)
+		if !regexp.MustCompile("^(1[0-9]|20)\\.[0-9]$").MatchString(float) {
+			test.Fatalf("Expected a float between 10 and 20 with one decimal place, got %s", float)
+		}
+
+		if length := len(generatedString(strings)) - 2; length < 2 || length > 4 {
+			test.Fatalf("Expected a string 2-4 characters long, got %d", length)
+		}
+	}
+	if len(seenInts) != 7 {
+		test.Errorf("Expected every int in the range to come up, got %v", seenInts)
+	}
+
+	// wider than the biggest int64, so the span has to be counted unsigned
+	wide, _ := createJsonTemplate("int:-5e18..5e18")
+	negatives := 0
+	for attempt := 0; attempt < 1000; attempt++ {
+		number, err := strconv.ParseInt(generatedString(wide), 10, 64)
+		if err != nil || number < -5e18 || number > 5e18 {
+			test.Fatalf("Expected an int between -5e18 and 5e18, got %d (%v)", number, err)
+		}
+		if number < 0 {
+			negatives++
+		}
+	}
+	if negatives < 400 || negatives > 600 {
+		test.Errorf("Expected about half the wide ints to be negative, got %d", negatives)
+	}
+}
+
+func TestVariableArrayLengths(test *testing.T) {
+	generator, err := createJsonTemplate("[int:1]:0=20,1..3=70,6=10")
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+
+	counts := make(map[int]int)
+	for attempt := 0; attempt < 2000; attempt++ {
+		var values []int
+		if err := json.Unmarshal([]byte(generatedString(generator)), &values); err != nil {
+			test.Fatalf("Generated invalid JSON: %v", err)
+		}
+		counts[len(values)]++
+	}
+
+	if len(counts) != 5 || counts[4] > 0 || counts[5] > 0 {
+		test.Fatalf("Expected lengths 0, 1, 2, 3 and 6, got %v", counts)
+	}
+	// roughly 400 empty arrays, 1400 short ones and 200 long ones
+	short := counts[1] + counts[2] + counts[3]
+	if counts[0] < 300 || counts[0] > 500 || short < 1250 || short > 1550 || counts[6] < 120 || counts[6] > 280 {
+		test.Errorf("Lengths don't follow their weights: %v", counts)
+	}
+}
+
+func TestNullAndAbsentMembers(test *testing.T) {
+	generator, err := createJsonTemplate("user;user=first/int~50,name/string?50,last/int~50")
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+
+	nulls, firsts, lasts := 0, 0, 0
+	for attempt := 0; attempt < 1000; attempt++ {
+		generated := generatedString(generator)
+		var user map[string]interface{}
+		if err := json.Unmarshal([]byte(generated), &user); err != nil {
+			test.Fatalf("Generated invalid JSON %s: %v", generated, err)
+		}
+
+		name, found := user["name"]
+		if !found {
+			test.Fatalf("Expected name to always be there, got %s", generated)
+		}
+		if name == nil {
+			nulls++
+		}
+		if _, found := user["first"]; found {
+			firsts++
+		}
+		if _, found := user["last"]; found {
+			lasts++
+		}
+	}
+
+	for description, count := range map[string]int{"null names": nulls, "first members": firsts, "last members": lasts} {
+		if count < 400 || count > 600 {
+			test.Errorf("Expected about 500 %s, got %d", description, count)
+		}
+	}
+}
+
+func TestWeightedEnums(test *testing.T) {
+	generator, err := createJsonTemplate("string|active=90,suspended=9,deleted=1")
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for attempt := 0; attempt < 5000; attempt++ {
+		counts[generatedString(generator)]++
+	}
+	if counts["\"active\""] < 4400 || counts["\"suspended\""] < 350 || counts["\"suspended\""] > 550 || counts["\"deleted\""] < 20 || counts["\"deleted\""] > 90 {
+		test.Errorf("Values don't follow their weights: %v", counts)
+	}
+
+	ints := newWeightedIntFromSetGenerator([]int{1, 2}, []float64{0, 100})
+	floats := newWeightedFloatFromSetGenerator([]float64{1, 2}, []float64{100, 0})
+	for attempt := 0; attempt < 100; attempt++ {
+		if generated := generatedString(ints); generated != "2" {
+			test.Fatalf("Expected only the weighted int, got %s", generated)
+		}
+		if generated := generatedString(floats); generated != "1.000000" {
+			test.Fatalf("Expected only the weighted float, got %s", generated)
+		}
+	}
+}
+
 // Refactored method for generating a string from the generator's output
 func generatedString(generator jsonElementGenerator) string {
 	var buffer bytes.Buffer
@@ -0,0 +1,410 @@
+package badness
+
+// JSON mutation. Random noise almost always breaks JSON outright, which clients reject straight away.
+// X-Json-Mutate damages the document's contents instead: it stream-parses the body and drops keys,
+// nulls out values, changes types and so on, while keeping the result syntactically valid.
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const JsonMutate = "X-Json-Mutate"
+
+// the prefix for keys added by the unknown mutation
+const unknownFieldPrefix = "bad_server_unknown_"
+
+type jsonMutateSettings struct {
+	// probabilities (0-1) of each mutation happening. drop and duplicate apply to each object member,
+	// null and retype to each value below the top level, unknown to each object and truncate to each array
+	dropProbability      float64
+	nullProbability      float64
+	retypeProbability    float64
+	duplicateProbability float64
+	unknownProbability   float64
+	truncateProbability  float64
+}
+
+// parseJsonMutateSettings reads the comma-separated key=value options in the X-Json-Mutate header.
+// percentages are passed in as 0-100
+func parseJsonMutateSettings(headerValues []string) (jsonMutateSettings, error) {
+	settings := jsonMutateSettings{}
+
+	for key, value := range parseHeadersWithKeyValues(headerValues, ",") {
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "":
+			continue
+		case "drop":
+			settings.dropProbability, err = parsePercentage(value)
+		case "null":
+			settings.nullProbability, err = parsePercentage(value)
+		case "retype":
+			settings.retypeProbability, err = parsePercentage(value)
+		case "duplicate":
+			settings.duplicateProbability, err = parsePercentage(value)
+		case "unknown":
+			settings.unknownProbability, err = parsePercentage(value)
+		case "truncate":
+			settings.truncateProbability, err = parsePercentage(value)
+		default:
+			err = fmt.Errorf("Unknown option")
+		}
+
+		if err != nil {
+			return settings, fmt.Errorf("Invalid %s option %s=%s: %v", JsonMutate, key, value, err)
+		}
+	}
+	return settings, nil
+}
+
+type jsonMutator struct {
+	settings jsonMutateSettings
+	decoder  *json.Decoder
+	writer   *bufio.Writer
+}
+
+// getJsonMutateAffector returns a reader that mutates the JSON read from reader. Bodies that don't
+// start out as JSON are passed along untouched
+func getJsonMutateAffector(request *http.Request, reader io.Reader) (io.Reader, error) {
+	settings, err := parseJsonMutateSettings(request.Header[JsonMutate])
+	if err != nil {
+		return nil, err
+	}
+
+	// the mutator stops once the client has gone, rather than waiting forever for someone to read what
+	// it writes
+	ctx := request.Context()
+	reader = contextReader{ctx, reader}
+	pipeReader, pipeWriter := io.Pipe()
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pipeReader.CloseWithError(ctx.Err())
+		case <-finished:
+		}
+	}()
+
+	// everything the decoder reads is kept until it's clear the body is JSON
+	consumed := &recordingReader{reader: reader, recording: true}
+	decoder := json.NewDecoder(consumed)
+	decoder.UseNumber()
+
+	go func() {
+		defer close(finished)
+		writer := bufio.NewWriter(pipeWriter)
+		mutator := &jsonMutator{settings, decoder, writer}
+
+		first, err := decoder.Token()
+		if err != nil && err != io.EOF {
+			// not JSON, so send it on as it came in
+			writer.Write(consumed.buffer.Bytes())
+			_, err = io.Copy(writer, reader)
+			writer.Flush()
+			pipeWriter.CloseWithError(err)
+			return
+		}
+
+		consumed.stopRecording()
+		for values := 0; err == nil; values++ {
+			// a stream of several documents stays one per line
+			if values > 0 {
+				writer.WriteString("\n")
+			}
+			// the top-level value keeps its type, only its contents change
+			err = mutator.copyToken(first)
+			if err == nil {
+				first, err = decoder.Token()
+			}
+		}
+		writer.Flush()
+		if err == io.EOF {
+			pipeWriter.Close()
+			return
+		}
+		// what's been written so far isn't valid JSON on its own, so the client is cut off rather than
+		// being sent a response that looks complete
+		log.Printf("Stopped mutating JSON: %v", err)
+		pipeWriter.CloseWithError(errAbortResponse)
+	}()
+	return pipeReader, nil
+}
+
+// contextReader reads from reader until ctx is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (reader contextReader) Read(buf []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.reader.Read(buf)
+}
+
+// recordingReader keeps a copy of what's read from reader while recording is set
+type recordingReader struct {
+	reader    io.Reader
+	buffer    bytes.Buffer
+	recording bool
+}
+
+func (recorder *recordingReader) Read(buf []byte) (int, error) {
+	bytesRead, err := recorder.reader.Read(buf)
+	if recorder.recording {
+		recorder.buffer.Write(buf[0:bytesRead])
+	}
+	return bytesRead, err
+}
+
+func (recorder *recordingReader) stopRecording() {
+	recorder.recording = false
+	recorder.buffer.Reset()
+}
+
+func (mutator *jsonMutator) chance(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
+
+// copyToken writes out the value that starts with token, mutating what's inside it
+func (mutator *jsonMutator) copyToken(token json.Token) error {
+	switch token {
+	case json.Delim('{'):
+		return mutator.copyObject(false)
+	case json.Delim('['):
+		return mutator.copyArray(false)
+	default:
+		return mutator.writeScalar(token)
+	}
+}
+
+// mutateValue reads the next value and writes it out, possibly nulled or with a different type
+func (mutator *jsonMutator) mutateValue() error {
+	token, err := mutator.decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if mutator.chance(mutator.settings.nullProbability) {
+		mutator.writer.WriteString("null")
+		return mutator.skipRest(token)
+	}
+
+	if mutator.chance(mutator.settings.retypeProbability) {
+		switch token {
+		case json.Delim('{'):
+			return mutator.copyObject(true)
+		case json.Delim('['):
+			return mutator.copyArray(true)
+		default:
+			return mutator.writeScalar(retypeScalar(token))
+		}
+	}
+	return mutator.copyToken(token)
+}
+
+// copyObject copies the rest of an object. If asArray is set, only its values are written, in an array
+func (mutator *jsonMutator) copyObject(asArray bool) error {
+	settings := mutator.settings
+	opening, closing := "{", "}"
+	if asArray {
+		opening, closing = "[", "]"
+	}
+	mutator.writer.WriteString(opening)
+
+	written := 0
+	separate := func() {
+		if written > 0 {
+			mutator.writer.WriteString(",")
+		}
+		written++
+	}
+
+	for mutator.decoder.More() {
+		keyToken, err := mutator.decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := keyToken.(string)
+
+		if mutator.chance(settings.dropProbability) {
+			if err := mutator.skipValue(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		separate()
+		if !asArray {
+			mutator.writeKey(key)
+		}
+		if err := mutator.mutateValue(); err != nil {
+			return err
+		}
+
+		if !asArray && mutator.chance(settings.duplicateProbability) {
+			// the same key again, with a value that probably doesn't match the first one
+			separate()
+			mutator.writeKey(key)
+			mutator.writer.WriteString(randomJsonScalar())
+		}
+	}
+
+	if !asArray && mutator.chance(settings.unknownProbability) {
+		separate()
+		mutator.writeKey(unknownFieldPrefix + strconv.Itoa(rand.Intn(1000)))
+		mutator.writer.WriteString(randomJsonScalar())
+	}
+
+	// the closing brace
+	if _, err := mutator.decoder.Token(); err != nil {
+		return err
+	}
+	mutator.writer.WriteString(closing)
+	return nil
+}
+
+// copyArray copies the rest of an array. If asObject is set, it's written as an object keyed by index
+func (mutator *jsonMutator) copyArray(asObject bool) error {
+	opening, closing := "[", "]"
+	if asObject {
+		opening, closing = "{", "}"
+	}
+	mutator.writer.WriteString(opening)
+
+	// truncated arrays keep at most a couple of elements
+	limit := -1
+	if mutator.chance(mutator.settings.truncateProbability) {
+		limit = rand.Intn(3)
+	}
+
+	written := 0
+	for mutator.decoder.More() {
+		if limit >= 0 && written >= limit {
+			if err := mutator.skipValue(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if written > 0 {
+			mutator.writer.WriteString(",")
+		}
+		if asObject {
+			mutator.writeKey(strconv.Itoa(written))
+		}
+		written++
+		if err := mutator.mutateValue(); err != nil {
+			return err
+		}
+	}
+
+	// the closing bracket
+	if _, err := mutator.decoder.Token(); err != nil {
+		return err
+	}
+	mutator.writer.WriteString(closing)
+	return nil
+}
+
+// skipValue reads the next value without writing anything
+func (mutator *jsonMutator) skipValue() error {
+	token, err := mutator.decoder.Token()
+	if err != nil {
+		return err
+	}
+	return mutator.skipRest(token)
+}
+
+// skipRest reads the rest of the value that starts with token, if it's an object or array
+func (mutator *jsonMutator) skipRest(token json.Token) error {
+	if token != json.Delim('{') && token != json.Delim('[') {
+		return nil
+	}
+
+	for depth := 1; depth > 0; {
+		token, err := mutator.decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return nil
+}
+
+func (mutator *jsonMutator) writeKey(key string) {
+	mutator.writer.Write(encodeJsonString(key))
+	mutator.writer.WriteString(":")
+}
+
+// writeScalar writes a string, number, bool or null token
+func (mutator *jsonMutator) writeScalar(token json.Token) error {
+	switch value := token.(type) {
+	case string:
+		mutator.writer.Write(encodeJsonString(value))
+	case json.Number:
+		mutator.writer.WriteString(value.String())
+	case bool:
+		mutator.writer.WriteString(strconv.FormatBool(value))
+	case nil:
+		mutator.writer.WriteString("null")
+	default:
+		return fmt.Errorf("Unexpected token %v", token)
+	}
+	return nil
+}
+
+// retypeScalar converts a scalar token to one of a different JSON type
+func retypeScalar(token json.Token) json.Token {
+	switch value := token.(type) {
+	case string:
+		return json.Number(strconv.Itoa(len(value)))
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return json.Number("0")
+	}
+}
+
+// randomJsonScalar returns a random string, number, bool or null
+func randomJsonScalar() string {
+	switch rand.Intn(4) {
+	case 0:
+		return strconv.Quote("bad-server-" + strconv.Itoa(rand.Intn(1000)))
+	case 1:
+		return strconv.Itoa(rand.Intn(10000))
+	case 2:
+		return strconv.FormatBool(rand.Intn(2) == 0)
+	default:
+		return "null"
+	}
+}
+
+// encodeJsonString quotes value as a JSON string, without escaping HTML characters
+func encodeJsonString(value string) []byte {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	return bytes.TrimRight(buffer.Bytes(), "\n")
+}
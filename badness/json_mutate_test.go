@@ -0,0 +1,164 @@
+package badness
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mutateInput = `{"id": 12, "name": "widget <b>", "tags": ["a", "b", "c", "d"], "owner": {"id": 3, "active": true}, "notes": null}`
+
+// mutate runs input through X-Json-Mutate with the given options
+func mutate(test *testing.T, options string, input string) string {
+	request := makeTestRequest()
+	request.Header[JsonMutate] = []string{options}
+	reader, err := getJsonMutateAffector(request, strings.NewReader(input))
+	if err != nil {
+		test.Fatalf("Could not build affector: %v", err)
+	}
+	output, err := ioutil.ReadAll(reader)
+	if err != nil {
+		test.Fatalf("Could not read mutated output: %v", err)
+	}
+	return string(output)
+}
+
+func TestJsonMutateUnchanged(test *testing.T) {
+	output := mutate(test, "", mutateInput)
+	var expected, actual interface{}
+	json.Unmarshal([]byte(mutateInput), &expected)
+	if err := json.Unmarshal([]byte(output), &actual); err != nil {
+		test.Fatalf("Expected valid JSON, got %s: %v", output, err)
+	}
+	if !strings.Contains(output, "widget <b>") {
+		test.Errorf("Expected strings not to be HTML escaped, got %s", output)
+	}
+
+	expectedJson, _ := json.Marshal(expected)
+	actualJson, _ := json.Marshal(actual)
+	if string(expectedJson) != string(actualJson) {
+		test.Errorf("Expected no mutations, got %s", output)
+	}
+}
+
+func TestJsonMutateAlwaysValid(test *testing.T) {
+	options := "drop=20,null=20,retype=20,duplicate=20,unknown=50,truncate=50"
+	for attempt := 0; attempt < 200; attempt++ {
+		output := mutate(test, options, mutateInput+"\n"+mutateInput)
+		for _, line := range strings.Split(output, "\n") {
+			var parsed interface{}
+			if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+				test.Fatalf("Expected valid JSON, got %s: %v", line, err)
+			}
+			if _, isObject := parsed.(map[string]interface{}); !isObject {
+				test.Fatalf("Expected the top level to stay an object, got %s", line)
+			}
+		}
+	}
+}
+
+func TestJsonMutations(test *testing.T) {
+	var parsed map[string]interface{}
+
+	json.Unmarshal([]byte(mutate(test, "drop=100", mutateInput)), &parsed)
+	if len(parsed) != 0 {
+		test.Errorf("Expected every key to be dropped, got %v", parsed)
+	}
+
+	json.Unmarshal([]byte(mutate(test, "null=100", mutateInput)), &parsed)
+	for key, value := range parsed {
+		if value != nil {
+			test.Errorf("Expected %s to be null, got %v", key, value)
+		}
+	}
+
+	parsed = nil
+	json.Unmarshal([]byte(mutate(test, "retype=100", mutateInput)), &parsed)
+	if _, isString := parsed["id"].(string); !isString {
+		test.Errorf("Expected id to become a string, got %v", parsed["id"])
+	}
+	if _, isNumber := parsed["name"].(float64); !isNumber {
+		test.Errorf("Expected name to become a number, got %v", parsed["name"])
+	}
+	if _, isObject := parsed["tags"].(map[string]interface{}); !isObject {
+		test.Errorf("Expected tags to become an object, got %v", parsed["tags"])
+	}
+	if _, isArray := parsed["owner"].([]interface{}); !isArray {
+		test.Errorf("Expected owner to become an array, got %v", parsed["owner"])
+	}
+
+	if output := mutate(test, "duplicate=100", `{"id": 1}`); strings.Count(output, `"id"`) != 2 {
+		test.Errorf("Expected id to be duplicated, got %s", output)
+	}
+
+	if output := mutate(test, "unknown=100", `{"id": 1}`); !strings.Contains(output, unknownFieldPrefix) {
+		test.Errorf("Expected an unknown field, got %s", output)
+	}
+
+	parsed = nil
+	json.Unmarshal([]byte(mutate(test, "truncate=100", mutateInput)), &parsed)
+	if tags, _ := parsed["tags"].([]interface{}); len(tags) > 2 {
+		test.Errorf("Expected tags to be truncated, got %v", tags)
+	}
+}
+
+func TestJsonMutateNotJson(test *testing.T) {
+	if output := mutate(test, "drop=100", "<html>not json</html>"); output != "<html>not json</html>" {
+		test.Errorf("Expected non-JSON to pass through, got %s", output)
+	}
+	if _, err := parseJsonMutateSettings([]string{"explode=10"}); err == nil {
+		test.Errorf("Expected an error for an unknown option")
+	}
+}
+
+func TestJsonMutateInvalidLater(test *testing.T) {
+	request := makeTestRequest()
+	request.Header[JsonMutate] = []string{""}
+	reader, _ := getJsonMutateAffector(request, strings.NewReader(`{"id": 12, "tags": ["a", }`))
+	// the response is cut off rather than ending with JSON that's missing its end
+	if output, err := ioutil.ReadAll(reader); err != errAbortResponse {
+		test.Errorf("Expected the response to be aborted, got %s %v", output, err)
+	}
+}
+
+// endlessJson reads as an array of 1s that never ends
+type endlessJson struct {
+	started bool
+}
+
+func (reader *endlessJson) Read(buf []byte) (int, error) {
+	if !reader.started {
+		reader.started = true
+		return copy(buf, "["), nil
+	}
+	for index := 0; index+1 < len(buf); index += 2 {
+		buf[index], buf[index+1] = '1', ','
+	}
+	return len(buf) / 2 * 2, nil
+}
+
+func TestJsonMutateClientGone(test *testing.T) {
+	before := runtime.NumGoroutine()
+	for count := 0; count < 20; count++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		request := makeTestRequest().WithContext(ctx)
+		request.Header[JsonMutate] = []string{"null=10"}
+		if _, err := getJsonMutateAffector(request, &endlessJson{}); err != nil {
+			test.Fatalf("Could not build affector: %v", err)
+		}
+		// nothing ever reads the mutated body, the way it goes when the client disconnects
+		cancel()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		test.Errorf("Expected the mutators to stop once the client was gone, but there are %d more goroutines", after-before)
+	}
+}
@@ -0,0 +1,302 @@
+package badness
+
+// Generators for json_template values that repeat other values in the same response. A ref such as
+// ref:customer.id repeats the id of a customer that's already been written, so clients can be tested
+// joining records together, and a mirror such as mirror:email repeats a member of the same object.
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+
+	"bad-server/badness/json_template"
+)
+
+// how many times a dangling ref tries to come up with a value that hasn't been written
+const danglingAttempts = 10
+
+// valuePool collects the values written for one member of a custom type, so that refs can repeat them
+type valuePool struct {
+	values  [][]byte
+	written map[string]bool
+	// writes new values for the member. nil until the custom type is built
+	generator jsonElementGenerator
+}
+
+func newValuePool() *valuePool {
+	return &valuePool{written: make(map[string]bool)}
+}
+
+func (pool *valuePool) add(value []byte) {
+	if !pool.written[string(value)] {
+		pool.written[string(value)] = true
+		pool.values = append(pool.values, value)
+	}
+}
+
+// referencePoolKey names the pool for a custom type's member
+func referencePoolKey(typeName string, member string) string {
+	return typeName + "." + member
+}
+
+// referencePools makes an empty pool for every member that's referred to somewhere in template. It's an
+// error to refer to a type or member that doesn't exist
+func referencePools(template *json_template.Template) (map[string]*valuePool, error) {
+	pools := make(map[string]*valuePool)
+	for _, declaration := range template.Declarations {
+		for _, reference := range referencesIn(declaration) {
+			object, found := template.CustomTypes[reference.Type]
+			if !found {
+				return nil, fmt.Errorf("Unknown data type in %s: %s", reference.TokenLiteral(), reference.Type)
+			}
+			if !hasMember(object.(json_template.ObjectDataType), reference.Member) {
+				return nil, fmt.Errorf("%s has no member %s for %s", reference.Type, reference.Member, reference.TokenLiteral())
+			}
+			pools[referencePoolKey(reference.Type, reference.Member)] = newValuePool()
+		}
+	}
+	return pools, nil
+}
+
+// referencesIn finds every ref in declaration
+func referencesIn(declaration json_template.DataDeclaration) []json_template.ReferenceDataType {
+	switch typed := declaration.(type) {
+	case json_template.ReferenceDataType:
+		return []json_template.ReferenceDataType{typed}
+	case json_template.ArrayDataType:
+		return referencesIn(typed.NestedType)
+	case json_template.ObjectDataType:
+		references := make([]json_template.ReferenceDataType, 0)
+		for _, member := range typed.Members {
+			references = append(references, referencesIn(member.Value)...)
+		}
+		return references
+	}
+	return nil
+}
+
+func hasMember(object json_template.ObjectDataType, key string) bool {
+	for _, member := range object.Members {
+		if member.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReferenceOrder makes sure every ref comes after at least one value it can repeat, wherever it's
+// generated. Otherwise the ref would have nothing in its pool and would dangle every time. Members that
+// can be null or left out, arrays that can be empty, and all but one type of a union might not be
+// written, so only the values that are always written before a ref count
+func checkReferenceOrder(template *json_template.Template) error {
+	checker := referenceOrderChecker{template: template, building: make(map[string]bool)}
+	_, err := checker.check(template.Declarations[0], make(map[string]bool))
+	return err
+}
+
+// referenceOrderChecker walks a template in the order it's generated
+type referenceOrderChecker struct {
+	template *json_template.Template
+	// the custom types being walked. A type nested inside itself might not be written, since it stops
+	// at its max depth, and anything it could write has already been checked
+	building map[string]bool
+}
+
+// check returns the pools that are always written to once declaration is, given the ones in written
+// that already have been
+func (checker referenceOrderChecker) check(declaration json_template.DataDeclaration, written map[string]bool) (map[string]bool, error) {
+	switch typed := declaration.(type) {
+	case json_template.ReferenceDataType:
+		if key := referencePoolKey(typed.Type, typed.Member); !written[key] {
+			return nil, fmt.Errorf("%s can be written before any %s", typed.TokenLiteral(), key)
+		}
+	case json_template.ArrayDataType:
+		// the first item has nothing but what came before the array
+		afterItem, err := checker.check(typed.NestedType, copyWritten(written))
+		if err != nil {
+			return nil, err
+		}
+		if minArrayLength(typed) > 0 {
+			return afterItem, nil
+		}
+	case json_template.ObjectDataType:
+		return checker.checkObject(typed, "", written)
+	case json_template.KeyNameDataType:
+		return checker.checkCustomType(typed.Literal, written)
+	case json_template.UnionDataType:
+		// only what every type writes is sure to be written
+		var always map[string]bool
+		for _, customType := range typed.Types {
+			afterType, err := checker.checkCustomType(customType.Literal, copyWritten(written))
+			if err != nil {
+				return nil, err
+			}
+			if always == nil {
+				always = afterType
+				continue
+			}
+			for key := range always {
+				if !afterType[key] {
+					delete(always, key)
+				}
+			}
+		}
+		return always, nil
+	}
+	return written, nil
+}
+
+// checkObject checks object's members in order. typeName is the custom type the object belongs to, or
+// empty if it's inline
+func (checker referenceOrderChecker) checkObject(object json_template.ObjectDataType, typeName string, written map[string]bool) (map[string]bool, error) {
+	for _, member := range object.Members {
+		optional := member.NullPercentage > 0 || member.AbsentPercentage > 0
+		afterMember, err := checker.check(member.Value, copyWritten(written))
+		if err != nil {
+			return nil, err
+		}
+		if optional {
+			continue
+		}
+		written = afterMember
+		if typeName != "" {
+			written[referencePoolKey(typeName, member.Key)] = true
+		}
+	}
+	return written, nil
+}
+
+func (checker referenceOrderChecker) checkCustomType(name string, written map[string]bool) (map[string]bool, error) {
+	if checker.building[name] {
+		return written, nil
+	}
+	declaration, found := checker.template.CustomTypes[name]
+	if !found {
+		return nil, fmt.Errorf("Unknown data type: %s", name)
+	}
+	checker.building[name] = true
+	defer delete(checker.building, name)
+	return checker.checkObject(declaration.(json_template.ObjectDataType), name, written)
+}
+
+// minArrayLength returns the fewest items array can have
+func minArrayLength(array json_template.ArrayDataType) int {
+	if len(array.Lengths) == 0 {
+		return array.Length
+	}
+	min := array.Lengths[0].Min
+	for _, length := range array.Lengths[1:] {
+		if length.Min < min {
+			min = length.Min
+		}
+	}
+	return min
+}
+
+func copyWritten(written map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(written))
+	for key := range written {
+		copied[key] = true
+	}
+	return copied
+}
+
+// ---- pooled generator -----
+// writes its generator's values, adding each one to the pool
+type pooledGenerator struct {
+	generator jsonElementGenerator
+	pool      *valuePool
+}
+
+func (generator pooledGenerator) generate(writer io.Writer) (int, error) {
+	var buffer bytes.Buffer
+	if _, err := generator.generator.generate(&buffer); err != nil {
+		return 0, err
+	}
+	generator.pool.add(buffer.Bytes())
+	return writer.Write(buffer.Bytes())
+}
+
+func newPooledGenerator(generator jsonElementGenerator, pool *valuePool) jsonElementGenerator {
+	return pooledGenerator{generator, pool}
+}
+
+// ---- reference generator -----
+// writes one of the values in its pool. Some of the time it writes a new value that isn't in the pool
+// instead. Templates are checked so that something's always in the pool first, but if it's empty anyway
+// a new value is written too
+type referenceGenerator struct {
+	pool *valuePool
+	// the chance (0-1) of writing a value that isn't in the pool
+	danglingProbability float64
+}
+
+func (generator referenceGenerator) generate(writer io.Writer) (int, error) {
+	pool := generator.pool
+	if len(pool.values) == 0 || (generator.danglingProbability > 0 && rand.Float64() < generator.danglingProbability) {
+		return generator.generateDangling(writer)
+	}
+	return writer.Write(pool.values[rand.Intn(len(pool.values))])
+}
+
+// generateDangling writes a value like the ones in the pool, but that isn't one of them. If the pool's
+// generator keeps coming up with values that are already in the pool, the last one is used anyway
+func (generator referenceGenerator) generateDangling(writer io.Writer) (int, error) {
+	var buffer bytes.Buffer
+	for attempt := 0; attempt < danglingAttempts; attempt++ {
+		buffer.Reset()
+		if _, err := generator.pool.generator.generate(&buffer); err != nil {
+			return 0, err
+		}
+		if !generator.pool.written[buffer.String()] {
+			break
+		}
+	}
+	return writer.Write(buffer.Bytes())
+}
+
+func newReferenceGenerator(pool *valuePool, danglingProbability float64) jsonElementGenerator {
+	return referenceGenerator{pool, danglingProbability}
+}
+
+// ---- mirror generators -----
+// mirrorSource holds the value written for a member of the object being generated, or nil if the member
+// was null or left out
+type mirrorSource struct {
+	value []byte
+}
+
+// writes its generator's values, keeping each one in the source for mirrors to repeat
+type recordingGenerator struct {
+	generator jsonElementGenerator
+	source    *mirrorSource
+}
+
+func (generator recordingGenerator) generate(writer io.Writer) (int, error) {
+	var buffer bytes.Buffer
+	if _, err := generator.generator.generate(&buffer); err != nil {
+		return 0, err
+	}
+	generator.source.value = buffer.Bytes()
+	return writer.Write(generator.source.value)
+}
+
+func newRecordingGenerator(generator jsonElementGenerator, source *mirrorSource) jsonElementGenerator {
+	return recordingGenerator{generator, source}
+}
+
+// writes the value in its source, or null if there isn't one
+type mirrorGenerator struct {
+	source *mirrorSource
+}
+
+func (generator mirrorGenerator) generate(writer io.Writer) (int, error) {
+	if generator.source.value == nil {
+		return writer.Write(null)
+	}
+	return writer.Write(generator.source.value)
+}
+
+func newMirrorGenerator(source *mirrorSource) jsonElementGenerator {
+	return mirrorGenerator{source}
+}
@@ -0,0 +1,115 @@
+package badness
+
+import (
+	"testing"
+)
+
+// storeIds returns the customer ids in a generated store, and the customers its orders refer to
+func storeIds(test *testing.T, template string) (map[interface{}]bool, []interface{}) {
+	store := generatedJson(test, template).(map[string]interface{})
+	ids := make(map[interface{}]bool)
+	for _, customer := range store["customers"].([]interface{}) {
+		ids[customer.(map[string]interface{})["id"]] = true
+	}
+	references := make([]interface{}, 0)
+	for _, order := range store["orders"].([]interface{}) {
+		references = append(references, order.(map[string]interface{})["customer"])
+	}
+	return ids, references
+}
+
+func TestReferences(test *testing.T) {
+	ids, references := storeIds(test, "store;store=customers/[customer]:5,orders/[order]:50;customer=id/uuid;order=customer/ref:customer.id")
+	if len(ids) != 5 || len(references) != 50 {
+		test.Fatalf("Expected 5 customers and 50 orders, got %d and %d", len(ids), len(references))
+	}
+	for _, reference := range references {
+		if !ids[reference] {
+			test.Errorf("Order refers to customer %v, which isn't one of %v", reference, ids)
+		}
+	}
+
+	// dangling refs use up increments, so no customer ends up with their ids
+	ids, references = storeIds(test, "store;store=customers/[customer]:5,orders/[order]:1000;customer=id/increment;order=customer/ref:customer.id%30")
+	dangling := 0
+	for _, reference := range references {
+		if !ids[reference] {
+			dangling++
+		}
+	}
+	if dangling < 230 || dangling > 370 {
+		test.Errorf("Expected about 300 dangling refs, got %d", dangling)
+	}
+
+	// a customer's id is written before the customer's own ref, so even the first one has something to repeat
+	customers := generatedJson(test, "[customer]:5;customer=id/uuid,referrer/ref:customer.id").([]interface{})
+	first := customers[0].(map[string]interface{})
+	if first["referrer"] != first["id"] {
+		test.Errorf("Expected the first customer to refer to themselves, got %v", first)
+	}
+
+	// refs repeat the value that was generated, not the one that drifted
+	store := generatedJson(test, "store;store=customers/[customer]:5,orders/[order]:50;customer=id/int^100;order=customer/ref:customer.id")
+	for _, order := range store.(map[string]interface{})["orders"].([]interface{}) {
+		reference := order.(map[string]interface{})["customer"]
+		if _, isNumber := reference.(float64); !isNumber {
+			test.Errorf("Expected an order to refer to an id that hadn't drifted, got %v", reference)
+		}
+	}
+}
+
+func TestReferenceErrors(test *testing.T) {
+	templates := []string{
+		"[ref:customer.id]:3",
+		"[ref:customer.name]:3;customer=id/int",
+		"[ref:customer.id]:3;customer=id/int",
+		// refs that can be written before anything they can repeat
+		"store;store=orders/[order]:10,customers/[customer]:3;customer=id/increment;order=customer/ref:customer.id",
+		"store;store=customers/[customer]:0..5,orders/[order]:5;customer=id/int;order=customer/ref:customer.id",
+		"store;store=customers/[customer]:0=10,1..5,orders/[order]:5;customer=id/int;order=customer/ref:customer.id",
+		"store;store=customers/[customer]:5,orders/[order]:5;customer=id/int?10;order=customer/ref:customer.id",
+		"store;store=customers/[customer]:5?10,orders/[order]:5;customer=id/int;order=customer/ref:customer.id",
+		"store;store=first/customer~10,orders/[order]:5;customer=id/int;order=customer/ref:customer.id",
+		"store;store=people/[customer|vendor]:5,orders/[order]:5;customer=id/int;vendor=name/string;order=customer/ref:customer.id",
+		"[customer]:5;customer=referrer/ref:customer.id,id/int",
+		"customer;customer=id/int,friends/[friend]:2;friend=best/ref:friend.id,id/int",
+	}
+	for _, template := range templates {
+		if _, err := createJsonTemplate(template); err == nil {
+			test.Errorf("Expected an error building %s", template)
+		}
+	}
+}
+
+func TestMirrors(test *testing.T) {
+	user := generatedJson(test, "user;user=email/email,login/mirror:email,backup/mirror:login").(map[string]interface{})
+	if user["login"] != user["email"] || user["backup"] != user["email"] {
+		test.Errorf("Expected login and backup to repeat email, got %v", user)
+	}
+
+	// mirrors repeat the value that was generated, not the one that drifted
+	user = generatedJson(test, "user;user=email/email^100,login/mirror:email").(map[string]interface{})
+	if _, isString := user["login"].(string); !isString {
+		test.Errorf("Expected login to repeat the email before it drifted, got %v", user)
+	}
+
+	// a mirror of a member that's null or left out is null
+	for _, template := range []string{"user;user=email/email?100,login/mirror:email", "user;user=email/email~100,login/mirror:email"} {
+		user := generatedJson(test, template).(map[string]interface{})
+		if login, found := user["login"]; !found || login != nil {
+			test.Errorf("Expected %s to have a null login, got %v", template, user)
+		}
+	}
+
+	// replies are written between a comment's author and its signature, and have authors of their own
+	var checkSignatures func(comment map[string]interface{})
+	checkSignatures = func(comment map[string]interface{}) {
+		if comment["signature"] != comment["author"] {
+			test.Errorf("Expected signature %v to repeat author %v", comment["signature"], comment["author"])
+		}
+		for _, reply := range comment["replies"].([]interface{}) {
+			checkSignatures(reply.(map[string]interface{}))
+		}
+	}
+	checkSignatures(generatedJson(test, "comment;comment:3=author/string:8,replies/[comment]:2,signature/mirror:author").(map[string]interface{}))
+}
@@ -0,0 +1,269 @@
+package badness
+
+// Generators for json_template's semantic types: strings (and a few numbers) in formats that clients
+// usually validate, such as uuids, timestamps and email addresses. Each one can be told to make a
+// fraction of its values subtly invalid, so the client's validation and error paths get exercised.
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"bad-server/badness/json_template"
+)
+
+// generated datetimes fall between these
+var earliestDatetime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+var latestDatetime = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// the number of bytes hex and base64 values encode when no range is given
+const defaultEncodedBytes = 16
+
+// semanticValue returns a value to write. If invalid is set, the value should look right at a glance
+// but fail validation
+type semanticValue func(invalid bool) string
+
+type semanticGenerator struct {
+	value semanticValue
+	// whether the value is written as a JSON string or a bare number
+	quoted             bool
+	invalidProbability float64
+}
+
+func (generator semanticGenerator) generate(writer io.Writer) (int, error) {
+	invalid := generator.invalidProbability > 0 && rand.Float64() < generator.invalidProbability
+	value := generator.value(invalid)
+	if generator.quoted {
+		return newFixedStringGenerator(value).generate(writer)
+	}
+	return writer.Write([]byte(value))
+}
+
+// semanticGeneratorFromDataType builds the generator for a semantic type. The second return value is
+// false if declaration isn't a semantic type
+func semanticGeneratorFromDataType(declaration json_template.PrimitiveDataType) (jsonElementGenerator, bool) {
+	if !json_template.IsSemanticDataType(declaration.Literal) {
+		return nil, false
+	}
+
+	minBytes, maxBytes := defaultEncodedBytes, defaultEncodedBytes
+	if declaration.Range != nil {
+		minBytes, maxBytes = int(declaration.Range.Min), int(declaration.Range.Max)
+	}
+
+	quoted := true
+	var value semanticValue
+	switch declaration.Literal {
+	case "uuid":
+		value = uuidValue
+	case "datetime":
+		switch declaration.Format {
+		case "epoch":
+			value, quoted = epochValue(time.Second), false
+		case "epochms":
+			value, quoted = epochValue(time.Millisecond), false
+		default:
+			value = rfc3339Value
+		}
+	case "date":
+		value = dateValue
+	case "email":
+		value = emailValue
+	case "url":
+		value = urlValue
+	case "ipv4":
+		value = ipv4Value
+	case "ipv6":
+		value = ipv6Value
+	case "hex":
+		value = encodedValue(minBytes, maxBytes, hexEncode)
+	case "base64":
+		value = encodedValue(minBytes, maxBytes, base64.StdEncoding.EncodeToString)
+	case "phone":
+		value = phoneValue
+	}
+	return semanticGenerator{value, quoted, declaration.InvalidPercentage / 100}, true
+}
+
+// randomLowercase returns length random lowercase letters
+func randomLowercase(length int) string {
+	letters := make([]byte, length)
+	for index := range letters {
+		letters[index] = byte('a' + rand.Intn(26))
+	}
+	return string(letters)
+}
+
+func randomDatetime() time.Time {
+	span := latestDatetime.Sub(earliestDatetime)
+	return earliestDatetime.Add(time.Duration(rand.Int63n(int64(span)))).Truncate(time.Second)
+}
+
+// replaceCharacter swaps the character at a random index in value for replacement
+func replaceCharacter(value string, replacement byte) string {
+	index := rand.Intn(len(value))
+	return value[:index] + string(replacement) + value[index+1:]
+}
+
+// uuidValue returns a version 4 uuid. Invalid ones have a character that isn't hex, or are a character short
+func uuidValue(invalid bool) string {
+	buffer := make([]byte, 16)
+	rand.Read(buffer)
+	buffer[6] = (buffer[6] & 0x0f) | 0x40
+	buffer[8] = (buffer[8] & 0x3f) | 0x80
+	value := fmt.Sprintf("%x-%x-%x-%x-%x", buffer[0:4], buffer[4:6], buffer[6:8], buffer[8:10], buffer[10:16])
+
+	if !invalid {
+		return value
+	}
+	if rand.Intn(2) == 0 {
+		// anywhere but a dash
+		index := rand.Intn(len(value))
+		for value[index] == '-' {
+			index = rand.Intn(len(value))
+		}
+		return value[:index] + "g" + value[index+1:]
+	}
+	return value[:len(value)-1]
+}
+
+// rfc3339Value returns a timestamp such as 2019-10-12T07:20:50Z. Invalid ones use a space instead of the T,
+// leave out the time zone or have a 13th month
+func rfc3339Value(invalid bool) string {
+	datetime := randomDatetime()
+	if !invalid {
+		return datetime.Format(time.RFC3339)
+	}
+	switch rand.Intn(3) {
+	case 0:
+		return datetime.Format("2006-01-02 15:04:05Z07:00")
+	case 1:
+		return datetime.Format("2006-01-02T15:04:05")
+	default:
+		return fmt.Sprintf("%d-13-%s", datetime.Year(), datetime.Format("02T15:04:05Z07:00"))
+	}
+}
+
+// epochValue returns timestamps counted in unit since the epoch. Invalid ones are counted in the
+// wrong unit, so they're off by a factor of a thousand
+func epochValue(unit time.Duration) semanticValue {
+	return func(invalid bool) string {
+		nanoseconds, counted := randomDatetime().UnixNano(), unit
+		if invalid && unit == time.Second {
+			counted = time.Millisecond
+		} else if invalid {
+			counted = time.Second
+		}
+		return strconv.FormatInt(nanoseconds/int64(counted), 10)
+	}
+}
+
+// dateValue returns a date such as 2019-10-12. Invalid ones have a day the month doesn't have
+func dateValue(invalid bool) string {
+	date := randomDatetime()
+	if !invalid {
+		return date.Format("2006-01-02")
+	}
+	return fmt.Sprintf("%s-%d", date.Format("2006-01"), 32+rand.Intn(68))
+}
+
+// emailValue returns an address such as abcdef@ghijk.com. Invalid ones are missing the @, have two of them,
+// or end in a dot
+func emailValue(invalid bool) string {
+	user, domain := randomLowercase(3+rand.Intn(8)), randomLowercase(3+rand.Intn(8))+".com"
+	if !invalid {
+		return user + "@" + domain
+	}
+	switch rand.Intn(3) {
+	case 0:
+		return user + domain
+	case 1:
+		return user + "@@" + domain
+	default:
+		return user + "@" + domain + "."
+	}
+}
+
+// urlValue returns a url such as https://abcdef.example.com/ghijk. Invalid ones have a misspelled scheme,
+// a space in the path or no scheme at all
+func urlValue(invalid bool) string {
+	host, path := randomLowercase(3+rand.Intn(8))+".example.com", randomLowercase(3+rand.Intn(8))
+	if !invalid {
+		return "https://" + host + "/" + path
+	}
+	switch rand.Intn(3) {
+	case 0:
+		return "htps://" + host + "/" + path
+	case 1:
+		return "https://" + host + "/" + path[:1] + " " + path[1:]
+	default:
+		return "://" + host + "/" + path
+	}
+}
+
+// ipv4Value returns an address such as 10.20.30.40. Invalid ones have an octet over 255, or only three octets
+func ipv4Value(invalid bool) string {
+	octets := []string{strconv.Itoa(rand.Intn(256)), strconv.Itoa(rand.Intn(256)), strconv.Itoa(rand.Intn(256)), strconv.Itoa(rand.Intn(256))}
+	if invalid {
+		if rand.Intn(2) == 0 {
+			octets[rand.Intn(4)] = strconv.Itoa(256 + rand.Intn(744))
+		} else {
+			octets = octets[:3]
+		}
+	}
+	return strings.Join(octets, ".")
+}
+
+// ipv6Value returns a full-length address. Invalid ones have a group with five digits, or nine groups
+func ipv6Value(invalid bool) string {
+	groups := make([]string, 8)
+	for index := range groups {
+		groups[index] = strconv.FormatInt(int64(rand.Intn(0x10000)), 16)
+	}
+	if invalid {
+		if rand.Intn(2) == 0 {
+			groups[rand.Intn(8)] = strconv.FormatInt(int64(0x10000+rand.Intn(0xf0000)), 16)
+		} else {
+			groups = append(groups, groups[0])
+		}
+	}
+	return strings.Join(groups, ":")
+}
+
+func hexEncode(buffer []byte) string {
+	return hex.EncodeToString(buffer)
+}
+
+// encodedValue returns random bytes, between minBytes and maxBytes of them, run through encode. Invalid
+// values have a character that isn't part of the encoding, or lose their last character
+func encodedValue(minBytes, maxBytes int, encode func([]byte) string) semanticValue {
+	return func(invalid bool) string {
+		buffer := make([]byte, minBytes+rand.Intn(maxBytes-minBytes+1))
+		rand.Read(buffer)
+		value := encode(buffer)
+		if !invalid || value == "" {
+			return value
+		}
+		if rand.Intn(2) == 0 {
+			return replaceCharacter(value, '*')
+		}
+		return value[:len(value)-1]
+	}
+}
+
+// phoneValue returns an E.164 number such as +15555550123. Invalid ones have too many digits, or a letter O
+// in place of a digit
+func phoneValue(invalid bool) string {
+	digits := strconv.Itoa(1+rand.Intn(99)) + fmt.Sprintf("%010d", rand.Int63n(10000000000))
+	if !invalid {
+		return "+" + digits
+	}
+	if rand.Intn(2) == 0 {
+		return "+" + digits + fmt.Sprintf("%05d", rand.Intn(100000))
+	}
+	return "+" + replaceCharacter(digits, 'O')
+}
@@ -0,0 +1,124 @@
+package badness
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validators for each semantic type, given the value without JSON quoting
+var semanticValidators = map[string]func(string) bool{
+	"uuid": regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$").MatchString,
+	"datetime": func(value string) bool {
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	},
+	"datetime:epoch": func(value string) bool {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		return err == nil && seconds >= earliestDatetime.Unix() && seconds < latestDatetime.Unix()
+	},
+	"datetime:epochms": func(value string) bool {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		return err == nil && millis >= earliestDatetime.Unix()*1000 && millis < latestDatetime.Unix()*1000
+	},
+	"date": func(value string) bool {
+		_, err := time.Parse("2006-01-02", value)
+		return err == nil
+	},
+	"email": regexp.MustCompile("^[a-z]+@[a-z]+\\.com$").MatchString,
+	"url": func(value string) bool {
+		parsed, err := url.Parse(value)
+		return err == nil && parsed.Scheme == "https" && parsed.Host != "" && !strings.Contains(value, " ")
+	},
+	"ipv4": func(value string) bool {
+		ip := net.ParseIP(value)
+		return ip != nil && ip.To4() != nil && strings.Count(value, ".") == 3
+	},
+	"ipv6": func(value string) bool {
+		ip := net.ParseIP(value)
+		return ip != nil && strings.Contains(value, ":")
+	},
+	"hex": func(value string) bool {
+		_, err := hex.DecodeString(value)
+		return err == nil
+	},
+	"base64": func(value string) bool {
+		_, err := base64.StdEncoding.DecodeString(value)
+		return err == nil
+	},
+	"phone": regexp.MustCompile("^\\+[1-9][0-9]{10,11}$").MatchString,
+}
+
+// generateSemanticValues generates count values from template, unquoting strings
+func generateSemanticValues(test *testing.T, template string, count int) []string {
+	generator, err := createJsonTemplate(template)
+	if err != nil {
+		test.Fatalf("Could not build %s: %v", template, err)
+	}
+
+	values := make([]string, 0, count)
+	for index := 0; index < count; index++ {
+		generated := generatedString(generator)
+		var value interface{}
+		if err := json.Unmarshal([]byte(generated), &value); err != nil {
+			test.Fatalf("%s generated invalid JSON %s: %v", template, generated, err)
+		}
+		if text, isString := value.(string); isString {
+			values = append(values, text)
+		} else {
+			values = append(values, generated)
+		}
+	}
+	return values
+}
+
+func TestSemanticValues(test *testing.T) {
+	for dataType, isValid := range semanticValidators {
+		for _, value := range generateSemanticValues(test, dataType, 200) {
+			if !isValid(value) {
+				test.Errorf("%s generated an invalid value %s", dataType, value)
+			}
+		}
+	}
+}
+
+func TestInvalidSemanticValues(test *testing.T) {
+	for dataType, isValid := range semanticValidators {
+		for _, value := range generateSemanticValues(test, dataType+"%100", 200) {
+			if isValid(value) {
+				test.Errorf("%s%%100 generated a valid value %s", dataType, value)
+			}
+		}
+	}
+
+	// the rest of the time, values are valid
+	invalid := 0
+	for _, value := range generateSemanticValues(test, "uuid%25", 1000) {
+		if !semanticValidators["uuid"](value) {
+			invalid++
+		}
+	}
+	if invalid < 180 || invalid > 320 {
+		test.Errorf("Expected about 250 invalid uuids, got %d", invalid)
+	}
+}
+
+func TestEncodedLengths(test *testing.T) {
+	for _, value := range generateSemanticValues(test, "hex:2..4", 100) {
+		if len(value) < 4 || len(value) > 8 {
+			test.Errorf("Expected 2-4 bytes of hex, got %s", value)
+		}
+	}
+	for _, value := range generateSemanticValues(test, "base64:3", 100) {
+		if len(value) != 4 {
+			test.Errorf("Expected 3 bytes of base64, got %s", value)
+		}
+	}
+}
@@ -12,9 +12,27 @@ type DataDeclaration interface {
 	TokenLiteral() string
 }
 
+// how many levels deep a custom type can be nested inside itself, unless the template says otherwise
+const DefaultMaxDepth = 5
+
+// the deepest a template can ask for. Every level is another few calls on the stack when the value is
+// generated, and a stack overflow can't be recovered from
+const MaxMaxDepth = 100
+
+// the longest a string can be, or the most bytes a hex or base64 value can encode. The whole value is
+// built in memory before it's written
+const MaxLength = 1000000
+
+// the most items an array can have
+const MaxArrayLength = 1000000
+
 type Template struct {
 	Declarations []DataDeclaration
 	CustomTypes  map[string]DataDeclaration
+	// custom types that were given their own maximum depth
+	MaxDepths map[string]int
+	// the percentage of the time object members are a different type, unless they set their own
+	DriftPercentage float64
 }
 
 func (template *Template) TokenLiteral() string {
@@ -33,13 +51,60 @@ func (template *Template) addCustomType(name string, definition DataDeclaration)
 	template.CustomTypes[name] = definition
 }
 
+// MaxDepth returns how many levels deep the named custom type can be nested inside itself
+func (template *Template) MaxDepth(name string) int {
+	if depth, found := template.MaxDepths[name]; found {
+		return depth
+	}
+	return DefaultMaxDepth
+}
+
 type PrimitiveDataType struct {
 	DataDeclaration
 	Literal string
+	// the values (or for strings, hex and base64, the lengths) to generate. nil uses the type's defaults
+	Range *NumberRange
+	// how a datetime is written, or the characters a string is made of. Empty uses the default
+	Format string
+	// the percentage of semantic values that are invalid
+	InvalidPercentage float64
 }
 
 func (primitive PrimitiveDataType) TokenLiteral() string {
-	return primitive.Literal
+	literal := primitive.Literal
+	if primitive.Range != nil {
+		literal += COLON + primitive.Range.TokenLiteral()
+	}
+	if primitive.Format != "" {
+		literal += COLON + primitive.Format
+	}
+	if primitive.InvalidPercentage > 0 {
+		literal += PERCENT + formatNumber(primitive.InvalidPercentage)
+	}
+	return literal
+}
+
+// NumberRange is an inclusive range of numbers
+type NumberRange struct {
+	Min float64
+	Max float64
+	// the number of decimal places for floats. -1 if it wasn't set
+	Precision int
+}
+
+func (numberRange NumberRange) TokenLiteral() string {
+	literal := formatNumber(numberRange.Min)
+	if numberRange.Max != numberRange.Min {
+		literal += RANGE + formatNumber(numberRange.Max)
+	}
+	if numberRange.Precision >= 0 {
+		literal += fmt.Sprintf(":%d", numberRange.Precision)
+	}
+	return literal
+}
+
+func formatNumber(number float64) string {
+	return strconv.FormatFloat(number, 'g', -1, 64)
 }
 
 type KeyNameDataType struct {
@@ -55,34 +120,78 @@ type ArrayDataType struct {
 	DataDeclaration
 	NestedType DataDeclaration
 	Length     int
+	// if set, each array picks its length from these instead of using Length
+	Lengths []ArrayLength
 }
 
 func (array ArrayDataType) TokenLiteral() string {
-	return fmt.Sprintf("[%s]:%d", array.NestedType.TokenLiteral(), array.Length)
+	if len(array.Lengths) == 0 {
+		return fmt.Sprintf("[%s]:%d", array.NestedType.TokenLiteral(), array.Length)
+	}
+
+	lengths := make([]string, 0, len(array.Lengths))
+	for _, length := range array.Lengths {
+		literal := strconv.Itoa(length.Min)
+		if length.Max != length.Min {
+			literal += RANGE + strconv.Itoa(length.Max)
+		}
+		if len(array.Lengths) > 1 {
+			literal += EQUAL + formatNumber(length.Weight)
+		}
+		lengths = append(lengths, literal)
+	}
+	return fmt.Sprintf("[%s]:%s", array.NestedType.TokenLiteral(), strings.Join(lengths, ","))
+}
+
+// ArrayLength is an inclusive range of lengths an array can have
+type ArrayLength struct {
+	Min int
+	Max int
+	// the percentage of arrays that have a length in this range
+	Weight float64
 }
 
 type KeyValueDataType struct {
 	DataDeclaration
 	Key   string
 	Value DataDeclaration
+	// the percentage of the time the value is null
+	NullPercentage float64
+	// the percentage of the time the member is left out of its object
+	AbsentPercentage float64
+	// the percentage of the time the value is a different type. -1 if the member uses the template's
+	DriftPercentage float64
 }
 
 func (keyValue KeyValueDataType) TokenLiteral() string {
-	return fmt.Sprintf("%s: %s", keyValue.Key, keyValue.Value.TokenLiteral())
+	literal := keyValue.Key + SLASH + keyValue.Value.TokenLiteral()
+	if keyValue.NullPercentage > 0 {
+		literal += QUESTION + formatNumber(keyValue.NullPercentage)
+	}
+	if keyValue.AbsentPercentage > 0 {
+		literal += TILDE + formatNumber(keyValue.AbsentPercentage)
+	}
+	if keyValue.DriftPercentage >= 0 {
+		literal += CARET + formatNumber(keyValue.DriftPercentage)
+	}
+	return literal
 }
 
 type EnumStringDataType struct {
 	DataDeclaration
 	Values []string
+	// the percentage of the time each value is picked. nil if they're all as likely
+	Weights []float64
 }
 
 func (enumString EnumStringDataType) TokenLiteral() string {
-	return fmt.Sprintf("(%s)", strings.Join(enumString.Values, "|"))
+	return enumLiteral("string", enumString.Values, enumString.Weights)
 }
 
 type EnumIntDataType struct {
 	DataDeclaration
-	Values []int
+	Values  []int
+	Weights []float64
 }
 
 func (enumInt EnumIntDataType) TokenLiteral() string {
@@ -91,21 +200,35 @@ func (enumInt EnumIntDataType) TokenLiteral() string {
 		stringValues = append(stringValues, strconv.Itoa(intValue))
 	}
 
-	return fmt.Sprintf("(%s)", strings.Join(stringValues, "|"))
+	return enumLiteral("int", stringValues, enumInt.Weights)
 }
 
 type EnumFloatDataType struct {
 	DataDeclaration
-	Values []float64
+	Values  []float64
+	Weights []float64
 }
 
 func (enumFloat EnumFloatDataType) TokenLiteral() string {
 	stringValues := make([]string, 0, len(enumFloat.Values))
 	for _, floatValue := range enumFloat.Values {
-		stringValues = append(stringValues, fmt.Sprintf("%v", floatValue))
+		stringValues = append(stringValues, formatNumber(floatValue))
 	}
 
-	return fmt.Sprintf("(%s)", strings.Join(stringValues, "|"))
+	return enumLiteral("float", stringValues, enumFloat.Weights)
+}
+
+// enumLiteral formats enum values as they're written in a template, along with their weights if they
+// have them, such as string|active=90,deleted=10
+func enumLiteral(dataType string, values []string, weights []float64) string {
+	if weights != nil {
+		weighted := make([]string, 0, len(values))
+		for index, value := range values {
+			weighted = append(weighted, value+EQUAL+formatNumber(weights[index]))
+		}
+		values = weighted
+	}
+	return dataType + PIPE + strings.Join(values, COMMA)
 }
 
 type ObjectDataType struct {
@@ -113,16 +236,58 @@ type ObjectDataType struct {
 	Members []KeyValueDataType
 }
 
+// TokenLiteral writes the object inline, which parses the same as a custom type with the same members
 func (object ObjectDataType) TokenLiteral() string {
-	returnString := "{"
+	members := make([]string, 0, len(object.Members))
+	for _, member := range object.Members {
+		members = append(members, member.TokenLiteral())
+	}
+	return LEFT_BRACE + strings.Join(members, COMMA) + RIGHT_BRACE
+}
 
-	for index, member := range object.Members {
-		returnString += member.TokenLiteral()
-		if index != len(object.Members)-1 {
-			returnString += ", "
-		}
+// UnionDataType is one of several custom types, picked at random each time
+type UnionDataType struct {
+	DataDeclaration
+	Types []KeyNameDataType
+	// if set, each object gets a member with this key that holds the name of its type
+	Discriminator string
+}
+
+func (union UnionDataType) TokenLiteral() string {
+	names := make([]string, 0, len(union.Types))
+	for _, customType := range union.Types {
+		names = append(names, customType.TokenLiteral())
+	}
+	literal := strings.Join(names, PIPE)
+	if union.Discriminator != "" {
+		literal += AT + union.Discriminator
+	}
+	return literal
+}
+
+// ReferenceDataType repeats a value written earlier for a member of a custom type, such as ref:customer.id
+type ReferenceDataType struct {
+	DataDeclaration
+	Type   string
+	Member string
+	// the percentage of the time the value doesn't match any that were written
+	DanglingPercentage float64
+}
+
+func (reference ReferenceDataType) TokenLiteral() string {
+	literal := REFERENCE_KEYWORD + COLON + reference.Type + PERIOD + reference.Member
+	if reference.DanglingPercentage > 0 {
+		literal += PERCENT + formatNumber(reference.DanglingPercentage)
 	}
+	return literal
+}
+
+// MirrorDataType repeats the value of an earlier member of the same object, such as mirror:email
+type MirrorDataType struct {
+	DataDeclaration
+	Member string
+}
 
-	returnString += "}"
-	return returnString
+func (mirror MirrorDataType) TokenLiteral() string {
+	return MIRROR_KEYWORD + COLON + mirror.Member
 }
@@ -39,14 +39,44 @@ func (lexer *Lexer) NextToken() Token {
 		token = newToken(LEFT_BRACKET, lexer.ch)
 	case ']':
 		token = newToken(RIGHT_BRACKET, lexer.ch)
+	case '{':
+		token = newToken(LEFT_BRACE, lexer.ch)
+	case '}':
+		token = newToken(RIGHT_BRACE, lexer.ch)
+	case '@':
+		token = newToken(AT, lexer.ch)
 	case ':':
 		token = newToken(COLON, lexer.ch)
 	case ',':
 		token = newToken(COMMA, lexer.ch)
 	case '|':
 		token = newToken(PIPE, lexer.ch)
+	case '?':
+		token = newToken(QUESTION, lexer.ch)
+	case '~':
+		token = newToken(TILDE, lexer.ch)
+	case '^':
+		token = newToken(CARET, lexer.ch)
+	case '%':
+		token = newToken(PERCENT, lexer.ch)
+	case '.':
+		if lexer.peekChar() == '.' {
+			lexer.readChar()
+			token = Token{RANGE, RANGE}
+		} else if isLetter(lexer.peekChar()) {
+			token = newToken(PERIOD, lexer.ch)
+		} else {
+			token.Type = NUMBER
+			token.Literal = lexer.readNumber()
+			return token
+		}
 	default:
-		if isLetter(lexer.ch) {
+		if lexer.ch == '-' && isDigit(lexer.peekChar()) {
+			// a negative number rather than a name
+			token.Type = NUMBER
+			token.Literal = lexer.readNumber()
+			return token
+		} else if isLetter(lexer.ch) {
 			fullString := lexer.readString()
 			token.Type = stringToToken(fullString)
 			token.Literal = fullString
@@ -65,19 +95,47 @@ func (lexer *Lexer) NextToken() Token {
 	return token
 }
 
+// readString reads a name. Names start with a letter, and can contain digits after that
 func (lexer *Lexer) readString() string {
 	position := lexer.position
-	for isLetter(lexer.ch) {
+	for isLetter(lexer.ch) || (lexer.position > position && isDigit(lexer.ch)) {
 		lexer.readChar()
 	}
 	return lexer.input[position:lexer.position]
 }
 
+// peekChar returns the character after the current one without advancing
+func (lexer *Lexer) peekChar() byte {
+	if lexer.readPosition >= len(lexer.input) {
+		return 0
+	}
+	return lexer.input[lexer.readPosition]
+}
+
+// readNumber reads a number such as 12, -3.5 or 1e6. It stops before a .., so 1..10 is read as 1
 func (lexer *Lexer) readNumber() string {
 	position := lexer.position
-	for isDigit(lexer.ch) || lexer.ch == '.' {
+	if lexer.ch == '-' {
+		lexer.readChar()
+	}
+	for isDigit(lexer.ch) || (lexer.ch == '.' && lexer.peekChar() != '.') {
 		lexer.readChar()
 	}
+	if lexer.ch == 'e' || lexer.ch == 'E' {
+		// only an exponent if there's a number to go with it
+		exponent := lexer.readPosition
+		if exponent < len(lexer.input) && (lexer.input[exponent] == '-' || lexer.input[exponent] == '+') {
+			exponent++
+		}
+		if exponent < len(lexer.input) && isDigit(lexer.input[exponent]) {
+			for lexer.position < exponent {
+				lexer.readChar()
+			}
+			for isDigit(lexer.ch) {
+				lexer.readChar()
+			}
+		}
+	}
 	return lexer.input[position:lexer.position]
 }
 
@@ -10,7 +10,7 @@ type tokenExpect struct {
 }
 
 func TestNextToken(test *testing.T) {
-	input := "=:,/[];string;bookcase;increment;int;bool;1234|1.234"
+	input := "=:,/[];string;bookcase;increment;int;bool;1234|1.234?~{}@customer.id^"
 
 	expects := []tokenExpect{
 		{EQUAL, "="},
@@ -33,6 +33,53 @@ func TestNextToken(test *testing.T) {
 		{NUMBER, "1234"},
 		{PIPE, "|"},
 		{NUMBER, "1.234"},
+		{QUESTION, "?"},
+		{TILDE, "~"},
+		{LEFT_BRACE, "{"},
+		{RIGHT_BRACE, "}"},
+		{AT, "@"},
+		{KEY_NAME, "customer"},
+		{PERIOD, "."},
+		{KEY_NAME, "id"},
+		{CARET, "^"},
+	}
+	lexer := newLexer(input)
+
+	for index, expect := range expects {
+		token := lexer.NextToken()
+
+		if token.Type != expect.expectedType {
+			test.Errorf("Test case %d: Expected %s but got %s", index, expect.expectedType, token.Type)
+		}
+
+		if token.Literal != expect.expectedLiteral {
+			test.Errorf("Test case %d: Expected %s but got %s", index, expect.expectedLiteral, token.Literal)
+		}
+	}
+}
+
+func TestRangeTokens(test *testing.T) {
+	input := "int:-500..500;float:.5..1e6:2;0..-2e-3"
+
+	expects := []tokenExpect{
+		{INT_DATA_TYPE, "int"},
+		{COLON, ":"},
+		{NUMBER, "-500"},
+		{RANGE, ".."},
+		{NUMBER, "500"},
+		{SEMICOLON, ";"},
+		{FLOAT_DATA_TYPE, "float"},
+		{COLON, ":"},
+		{NUMBER, ".5"},
+		{RANGE, ".."},
+		{NUMBER, "1e6"},
+		{COLON, ":"},
+		{NUMBER, "2"},
+		{SEMICOLON, ";"},
+		{NUMBER, "0"},
+		{RANGE, ".."},
+		{NUMBER, "-2e-3"},
+		{EOF, "\x00"},
 	}
 	lexer := newLexer(input)
 
@@ -113,7 +160,8 @@ func TestReadString(test *testing.T) {
 		"snake_case":        "snake_case",
 		"camelCase":         "camelCase",
 		"string]":           "string",
-		"number123sandwich": "number",
+		"number123sandwich": "number123sandwich",
+		"ipv4,":             "ipv4",
 	}
 
 	for input, expected := range tests {
@@ -130,6 +178,11 @@ func TestReadNumber(test *testing.T) {
 		"01234":      "01234",
 		"123456789]": "123456789",
 		"5678[901]":  "5678",
+		"-12.5,":     "-12.5",
+		"3..4":       "3",
+		"1e6]":       "1e6",
+		"2e+3;":      "2e+3",
+		"7each":      "7",
 	}
 	for input, expected := range tests {
 		lexer := newLexer(input)
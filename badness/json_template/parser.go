@@ -3,6 +3,7 @@ package json_template
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 )
 
@@ -38,9 +39,19 @@ func (parser *Parser) nextToken() {
 	}
 }
 
+// peekTokenAfter returns the token that comes skip tokens after peekToken, without advancing
+func (parser *Parser) peekTokenAfter(skip int) Token {
+	lexer := *parser.lexer
+	token := lexer.NextToken()
+	for ; skip > 1; skip-- {
+		token = lexer.NextToken()
+	}
+	return token
+}
+
 func (parser *Parser) ParseTemplate() (*Template, error) {
 
-	template := Template{make([]DataDeclaration, 0), make(map[string]DataDeclaration)}
+	template := Template{Declarations: make([]DataDeclaration, 0), CustomTypes: make(map[string]DataDeclaration), MaxDepths: make(map[string]int)}
 
 	for parser.curToken.Type != EOF {
 		if isDataType(parser.curToken.Literal) || parser.curToken.Type == KEY_NAME {
@@ -53,9 +64,21 @@ func (parser *Parser) ParseTemplate() (*Template, error) {
 				}
 				template.addDataDeclaration(enum)
 
-			} else if parser.curToken.Type == KEY_NAME && parser.peekToken.Type == EQUAL {
-				// this defines a custom object
+			} else if parser.curToken.Type == KEY_NAME && (parser.peekToken.Type == EQUAL || parser.peekToken.Type == COLON) {
+				// this defines a custom object, such as comment=text/string or, with a maximum depth
+				// for types that contain themselves, comment:3=replies/[comment]
 				objectName := parser.curToken.Literal
+				if parser.peekToken.Type == COLON {
+					parser.nextToken()
+					depth, err := parser.parseMaxDepth()
+					if err != nil {
+						return nil, err
+					}
+					template.MaxDepths[objectName] = depth
+					if err := parser.assertPeekType(EQUAL); err != nil {
+						return nil, err
+					}
+				}
 				parser.nextToken()
 				objectDeclaration, err := parser.parseObject()
 				if err != nil {
@@ -73,13 +96,20 @@ func (parser *Parser) ParseTemplate() (*Template, error) {
 				template.addDataDeclaration(dataDeclaration)
 			}
 
-		} else if parser.curToken.Type == LEFT_BRACKET {
-			// an array
-			dataDeclaration, err := parser.parseArray()
+		} else if parser.curToken.Type == LEFT_BRACKET || parser.curToken.Type == LEFT_BRACE {
+			// an array or an inline object
+			dataDeclaration, err := parser.parseValue()
 			if err != nil {
 				return nil, err
 			}
 			template.addDataDeclaration(dataDeclaration)
+		} else if parser.curToken.Type == CARET {
+			// how often every object member drifts to a different type
+			percentage, err := parser.parsePercentage()
+			if err != nil {
+				return nil, err
+			}
+			template.DriftPercentage = percentage
 		} else if parser.curToken.Type == SEMICOLON {
 			// proceed
 			parser.nextToken()
@@ -97,13 +127,20 @@ func (parser *Parser) ParseTemplate() (*Template, error) {
 	return &template, nil
 }
 
-// parses enum values into the appropriate Enum*DataType
-func (parser *Parser) parseEnum(dataType string, stringValues []string) (DataDeclaration, error) {
+// parses enum values into the appropriate Enum*DataType. weights holds the weight given to each
+// value, or an empty string if it didn't have one
+func (parser *Parser) parseEnum(dataType string, stringValues []string, weightValues []string) (DataDeclaration, error) {
+	weights, err := parseEnumWeights(weightValues)
+	if err != nil {
+		return nil, err
+	}
+
 	// depending on the data type, create the appropriate Enum*DataType struct
 	switch dataType {
 	case "string":
 		enum := EnumStringDataType{}
 		enum.Values = stringValues
+		enum.Weights = weights
 		return enum, nil
 	case "int":
 		enum := EnumIntDataType{}
@@ -117,6 +154,7 @@ func (parser *Parser) parseEnum(dataType string, stringValues []string) (DataDec
 			}
 		}
 		enum.Values = enumValueInts
+		enum.Weights = weights
 		return enum, nil
 	case "float":
 		enum := EnumFloatDataType{}
@@ -130,6 +168,7 @@ func (parser *Parser) parseEnum(dataType string, stringValues []string) (DataDec
 			}
 		}
 		enum.Values = enumValueFloats
+		enum.Weights = weights
 		return enum, nil
 	default:
 		// unlikely, given we have logic above ensuring it's a data type
@@ -137,19 +176,84 @@ func (parser *Parser) parseEnum(dataType string, stringValues []string) (DataDec
 	}
 }
 
-// pulls enum string values out of a string by iterating on tokens and commas. It assumes
-// the parser is sitting on the |
-func (parser *Parser) extractEnumData() []string {
+// parseEnumWeights converts enum weights to numbers. If none of the values had a weight, it returns nil
+// so that every value is equally likely
+func parseEnumWeights(weightValues []string) ([]float64, error) {
+	weights := make([]float64, len(weightValues))
+	weighted := make([]bool, len(weightValues))
+	anyWeighted := false
+	for index, weightValue := range weightValues {
+		if weightValue == "" {
+			continue
+		}
+		weight, err := strconv.ParseFloat(weightValue, 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Invalid weight in enum: %v", weightValue)
+		}
+		weights[index], weighted[index], anyWeighted = weight, true, true
+	}
+
+	if !anyWeighted {
+		return nil, nil
+	}
+	if err := distributeWeights(weights, weighted); err != nil {
+		return nil, fmt.Errorf("Invalid enum weights: %v", err)
+	}
+	return weights, nil
+}
+
+// distributeWeights gives the weights that weren't set (according to weighted) an even share of
+// whatever's left of 100
+func distributeWeights(weights []float64, weighted []bool) error {
+	totalWeight, unweighted := 0.0, 0
+	for index, weight := range weights {
+		if weighted[index] {
+			totalWeight += weight
+		} else {
+			unweighted++
+		}
+	}
+	if totalWeight > 100 {
+		return fmt.Errorf("weights add up to more than 100")
+	}
+	if unweighted > 0 {
+		for index := range weights {
+			if !weighted[index] {
+				weights[index] = (100 - totalWeight) / float64(unweighted)
+			}
+		}
+	} else if totalWeight == 0 {
+		return fmt.Errorf("weights are all 0")
+	}
+	return nil
+}
+
+// pulls enum string values out of a string by iterating on tokens and commas, along with each value's
+// weight (an empty string if it doesn't have one). It assumes the parser is sitting on the |
+func (parser *Parser) extractEnumData() ([]string, []string) {
 	enumValues := make([]string, 0)
+	enumWeights := make([]string, 0)
 
 	// we need to use KEY_NAME because we don't have another term for an arbitrary string
-	for parser.peekToken.Type == COMMA || parser.peekToken.Type == KEY_NAME || parser.peekToken.Type == NUMBER {
+	for parser.peekToken.Type == KEY_NAME || parser.peekToken.Type == NUMBER || isDataType(parser.peekToken.Literal) {
 		parser.nextToken() // advances
-		if parser.curToken.Type != COMMA {
-			enumValues = append(enumValues, parser.curToken.Literal)
+		enumValues = append(enumValues, parser.curToken.Literal)
+
+		weight := ""
+		if parser.peekToken.Type == EQUAL && parser.peekTokenAfter(1).Type == NUMBER {
+			parser.nextToken()
+			parser.nextToken()
+			weight = parser.curToken.Literal
+		}
+		enumWeights = append(enumWeights, weight)
+
+		// in an object, a comma followed by key/ starts the next member rather than another value
+		if parser.peekToken.Type != COMMA || parser.peekTokenAfter(2).Type == SLASH {
+			break
 		}
+		parser.nextToken()
 	}
-	return enumValues
+	return enumValues, enumWeights
 
 }
 
@@ -160,30 +264,274 @@ func (parser *Parser) parseRawString() (DataDeclaration, error) {
 		if parser.peekToken.Type == PIPE {
 			dataType := parser.curToken.Literal
 			parser.nextToken()
-			if err := parser.assertPeekTypeOneOf([]TokenType{KEY_NAME, NUMBER}); err != nil {
+			if err := parser.assertPeekTypeOneOf([]TokenType{KEY_NAME, NUMBER}); err != nil && !isDataType(parser.peekToken.Literal) {
 				return nil, errors.New(fmt.Sprintf("No values found for enum"))
 			}
-			enumValues := parser.extractEnumData()
-			return parser.parseEnum(dataType, enumValues)
+			enumValues, enumWeights := parser.extractEnumData()
+			return parser.parseEnum(dataType, enumValues, enumWeights)
 		}
 
-		return PrimitiveDataType{Literal: parser.curToken.Literal}, nil
+		primitive := PrimitiveDataType{Literal: parser.curToken.Literal}
+		if parser.peekToken.Type == COLON {
+			parser.nextToken()
+			var err error
+			switch {
+			case primitive.Literal == "datetime":
+				primitive.Format, err = parser.parseFormat(primitive.Literal, datetimeFormats)
+			case primitive.Literal == "string" && parser.peekToken.Type == KEY_NAME:
+				primitive.Format, err = parser.parseFormat(primitive.Literal, stringCharsets)
+			default:
+				numberRange, rangeErr := parser.parseRange(primitive.Literal)
+				if rangeErr != nil {
+					return nil, rangeErr
+				}
+				primitive.Range = &numberRange
+
+				// strings can have a character set after their range
+				if primitive.Literal == "string" && parser.peekToken.Type == COLON {
+					parser.nextToken()
+					primitive.Format, err = parser.parseFormat(primitive.Literal, stringCharsets)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if parser.peekToken.Type == PERCENT {
+			if !IsSemanticDataType(primitive.Literal) {
+				return nil, fmt.Errorf("Position %d: %s values can't be made invalid", parser.lexer.position, primitive.Literal)
+			}
+			parser.nextToken()
+			percentage, err := parser.parsePercentage()
+			if err != nil {
+				return nil, err
+			}
+			primitive.InvalidPercentage = percentage
+		}
+		return primitive, nil
+	} else if parser.peekToken.Type == PIPE {
+		return parser.parseUnion()
 	} else {
 		return KeyNameDataType{Literal: parser.curToken.Literal}, nil
 	}
 }
 
+// parsePercentage reads the percentage after the parser's current token, such as the 5 in uuid%5
+func (parser *Parser) parsePercentage() (float64, error) {
+	if err := parser.assertPeekType(NUMBER); err != nil {
+		return 0, err
+	}
+	parser.nextToken()
+
+	percentage, err := strconv.ParseFloat(parser.curToken.Literal, 64)
+	if err != nil || percentage < 0 || percentage > 100 {
+		return 0, fmt.Errorf("Position %d: invalid percentage %s", parser.lexer.position, parser.curToken.Literal)
+	}
+	return percentage, nil
+}
+
+// parses a reference to another custom type's member, such as ref:customer.id or ref:customer.id%5.
+// The parser is at ref
+func (parser *Parser) parseReference() (DataDeclaration, error) {
+	reference := ReferenceDataType{}
+	parser.nextToken()
+	if err := parser.assertPeekType(KEY_NAME); err != nil {
+		return nil, err
+	}
+	parser.nextToken()
+	reference.Type = parser.curToken.Literal
+
+	if err := parser.assertPeekType(PERIOD); err != nil {
+		return nil, err
+	}
+	parser.nextToken()
+	if err := parser.assertPeekIsKey(); err != nil {
+		return nil, err
+	}
+	parser.nextToken()
+	reference.Member = parser.curToken.Literal
+
+	if parser.peekToken.Type == PERCENT {
+		parser.nextToken()
+		percentage, err := parser.parsePercentage()
+		if err != nil {
+			return nil, err
+		}
+		reference.DanglingPercentage = percentage
+	}
+	return reference, nil
+}
+
+// parses a mirror of an earlier member, such as mirror:email. keys are the members that came before it.
+// The parser is at mirror
+func (parser *Parser) parseMirror(keys []string) (DataDeclaration, error) {
+	parser.nextToken()
+	if err := parser.assertPeekIsKey(); err != nil {
+		return nil, err
+	}
+	parser.nextToken()
+
+	mirror := MirrorDataType{Member: parser.curToken.Literal}
+	for _, key := range keys {
+		if key == mirror.Member {
+			return mirror, nil
+		}
+	}
+	return nil, fmt.Errorf("Position %d: mirror:%s has to come after the %s member it repeats", parser.lexer.position, mirror.Member, mirror.Member)
+}
+
+// parses a union of custom types, such as circle|square, and the @key that can follow it.
+// The parser is at the first type
+func (parser *Parser) parseUnion() (DataDeclaration, error) {
+	union := UnionDataType{Types: []KeyNameDataType{{Literal: parser.curToken.Literal}}}
+	for parser.peekToken.Type == PIPE {
+		parser.nextToken()
+		if err := parser.assertPeekType(KEY_NAME); err != nil {
+			return nil, err
+		}
+		parser.nextToken()
+		union.Types = append(union.Types, KeyNameDataType{Literal: parser.curToken.Literal})
+	}
+
+	if parser.peekToken.Type == AT {
+		parser.nextToken()
+		if err := parser.assertPeekIsKey(); err != nil {
+			return nil, err
+		}
+		parser.nextToken()
+		union.Discriminator = parser.curToken.Literal
+	}
+	return union, nil
+}
+
+// valueTokens lists the tokens a value can start with
+func valueTokens() []TokenType {
+	return append([]TokenType{LEFT_BRACKET, LEFT_BRACE, KEY_NAME}, dataTypeTokens()...)
+}
+
+// parses whatever value the parser is at: an array, an inline object, or a data type or custom type
+func (parser *Parser) parseValue() (DataDeclaration, error) {
+	switch {
+	case parser.curToken.Type == LEFT_BRACKET:
+		return parser.parseArray()
+	case parser.curToken.Type == LEFT_BRACE:
+		return parser.parseInlineObject()
+	case parser.curToken.Literal == REFERENCE_KEYWORD && parser.peekToken.Type == COLON:
+		return parser.parseReference()
+	case parser.curToken.Literal == MIRROR_KEYWORD && parser.peekToken.Type == COLON:
+		return nil, fmt.Errorf("Position %d: mirror can only be the value of an object member", parser.lexer.position)
+	case parser.curToken.Type == KEY_NAME || isDataType(parser.curToken.Literal):
+		return parser.parseRawString()
+	default:
+		return nil, fmt.Errorf("Position %d: Unexpected token %s", parser.lexer.position, parser.curToken.Type)
+	}
+}
+
+// parses the range after a primitive, such as int:-5..5, string:10 or float:0..1:2.
+// The parser is at the colon after the data type
+func (parser *Parser) parseRange(dataType string) (NumberRange, error) {
+	numberRange := NumberRange{Precision: -1}
+	// strings, hex and base64 take a range of lengths rather than values
+	isLength := dataType == "string" || dataType == "hex" || dataType == "base64"
+	if dataType != "int" && dataType != "float" && !isLength {
+		return numberRange, fmt.Errorf("Position %d: %s doesn't take a range", parser.lexer.position, dataType)
+	}
+	// ints and lengths have to be whole numbers
+	wholeNumbers := dataType != "float"
+
+	var err error
+	if numberRange.Min, err = parser.parseRangeNumber(wholeNumbers); err != nil {
+		return numberRange, err
+	}
+	numberRange.Max = numberRange.Min
+	if parser.peekToken.Type == RANGE {
+		parser.nextToken()
+		if numberRange.Max, err = parser.parseRangeNumber(wholeNumbers); err != nil {
+			return numberRange, err
+		}
+	}
+
+	if numberRange.Min > numberRange.Max {
+		return numberRange, fmt.Errorf("Position %d: range %s starts after it ends", parser.lexer.position, numberRange.TokenLiteral())
+	}
+	if isLength && numberRange.Min < 0 {
+		return numberRange, fmt.Errorf("Position %d: %s lengths can't be negative", parser.lexer.position, dataType)
+	}
+	if isLength && numberRange.Max > MaxLength {
+		return numberRange, fmt.Errorf("Position %d: %s lengths can't be more than %d", parser.lexer.position, dataType, MaxLength)
+	}
+
+	// floats can also have a number of decimal places
+	if dataType == "float" && parser.peekToken.Type == COLON {
+		parser.nextToken()
+		if err := parser.assertPeekType(NUMBER); err != nil {
+			return numberRange, err
+		}
+		parser.nextToken()
+		precision, err := strconv.Atoi(parser.curToken.Literal)
+		if err != nil || precision < 0 {
+			return numberRange, fmt.Errorf("Position %d: invalid precision %s", parser.lexer.position, parser.curToken.Literal)
+		}
+		numberRange.Precision = precision
+	}
+	return numberRange, nil
+}
+
+// parses a format that's one of formats, such as the epoch in datetime:epoch. The parser is at the colon
+func (parser *Parser) parseFormat(dataType string, formats []string) (string, error) {
+	if err := parser.assertPeekType(KEY_NAME); err != nil {
+		return "", err
+	}
+	parser.nextToken()
+
+	for _, format := range formats {
+		if parser.curToken.Literal == format {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("Position %d: unknown %s format %s. Use one of %v", parser.lexer.position, dataType, parser.curToken.Literal, formats)
+}
+
+// parseRangeNumber reads the number after the parser's current token
+func (parser *Parser) parseRangeNumber(wholeNumber bool) (float64, error) {
+	if err := parser.assertPeekType(NUMBER); err != nil {
+		return 0, err
+	}
+	parser.nextToken()
+
+	number, err := strconv.ParseFloat(parser.curToken.Literal, 64)
+	if err != nil || (wholeNumber && (number != math.Trunc(number) || math.Abs(number) >= math.MaxInt64)) {
+		return 0, fmt.Errorf("Position %d: invalid number %s in range", parser.lexer.position, parser.curToken.Literal)
+	}
+	return number, nil
+}
+
+// parses the maximum depth of a custom type. The parser is at the colon after the type's name
+func (parser *Parser) parseMaxDepth() (int, error) {
+	if err := parser.assertPeekType(NUMBER); err != nil {
+		return 0, err
+	}
+	parser.nextToken()
+
+	depth, err := strconv.Atoi(parser.curToken.Literal)
+	if err != nil || depth < 1 || depth > MaxMaxDepth {
+		return 0, fmt.Errorf("Position %d: invalid maximum depth %s, must be 1-%d", parser.lexer.position, parser.curToken.Literal, MaxMaxDepth)
+	}
+	return depth, nil
+}
+
 // parses an array. parser is currently at [
 func (parser *Parser) parseArray() (DataDeclaration, error) {
 	array := ArrayDataType{Length: 10000}
-	if err := parser.assertPeekTypeOneOf([]TokenType{KEY_NAME, STRING_DATA_TYPE, BOOL_DATA_TYPE, INT_DATA_TYPE, INCREMENT_DATA_TYPE, FLOAT_DATA_TYPE}); err != nil {
+	if err := parser.assertPeekTypeOneOf(valueTokens()); err != nil {
 		return nil, err
 	}
 	parser.nextToken()
 
-	// figure out the nested data declaration
+	// figure out the nested data declaration, which can be another array or an object.
 	// note that parseRawString will return an enum type if that's what it is
-	dataDeclaration, err := parser.parseRawString()
+	dataDeclaration, err := parser.parseValue()
 	if err != nil {
 		return nil, err
 	}
@@ -199,32 +547,119 @@ func (parser *Parser) parseArray() (DataDeclaration, error) {
 	// if there's a colon, we need to parse the length. Otherwise we can return
 	if parser.peekToken.Type == COLON {
 		parser.nextToken()
-
-		// check there's a number there
-		if err = parser.assertPeekType(NUMBER); err != nil {
+		if err = parser.parseArrayLengths(&array); err != nil {
 			return nil, err
 		}
+	}
 
-		parser.nextToken()
-		length, err := strconv.Atoi(parser.curToken.Literal)
-		if err != nil {
-			return nil, err
-		} else {
-			array.Length = length
+	return array, nil
+}
+
+// parses the lengths after an array's colon: a single length such as 10, a range such as 0..50,
+// or a weighted set such as 0=20,1..10=70,1000=10. The parser is at the colon
+func (parser *Parser) parseArrayLengths(array *ArrayDataType) error {
+	lengths := make([]ArrayLength, 0)
+	weighted := make([]bool, 0)
+	for {
+		length := ArrayLength{}
+		var err error
+		if length.Min, err = parser.parseArrayLength(); err != nil {
+			return err
+		}
+		length.Max = length.Min
+		if parser.peekToken.Type == RANGE {
+			parser.nextToken()
+			if length.Max, err = parser.parseArrayLength(); err != nil {
+				return err
+			}
+			if length.Min > length.Max {
+				return fmt.Errorf("Position %d: length range %d..%d starts after it ends", parser.lexer.position, length.Min, length.Max)
+			}
+		}
+
+		hasWeight := parser.peekToken.Type == EQUAL
+		if hasWeight {
+			parser.nextToken()
+			if err := parser.assertPeekType(NUMBER); err != nil {
+				return err
+			}
+			parser.nextToken()
+			length.Weight, err = strconv.ParseFloat(parser.curToken.Literal, 64)
+			if err != nil || length.Weight < 0 {
+				return fmt.Errorf("Position %d: invalid weight %s", parser.lexer.position, parser.curToken.Literal)
+			}
+		}
+		lengths = append(lengths, length)
+		weighted = append(weighted, hasWeight)
+
+		// another length follows a comma, as opposed to the next member of an object
+		if parser.peekToken.Type != COMMA || parser.peekTokenAfter(1).Type != NUMBER {
+			break
 		}
+		parser.nextToken()
 	}
 
-	return array, nil
+	if len(lengths) == 1 && lengths[0].Min == lengths[0].Max && !weighted[0] {
+		array.Length = lengths[0].Min
+		return nil
+	}
+
+	// lengths without a weight share whatever's left of 100
+	weights := make([]float64, 0, len(lengths))
+	for _, length := range lengths {
+		weights = append(weights, length.Weight)
+	}
+	if err := distributeWeights(weights, weighted); err != nil {
+		return fmt.Errorf("Position %d: invalid array length weights: %v", parser.lexer.position, err)
+	}
+	for index := range lengths {
+		lengths[index].Weight = weights[index]
+	}
+
+	array.Lengths = lengths
+	return nil
+}
+
+// parseArrayLength reads the length after the parser's current token
+func (parser *Parser) parseArrayLength() (int, error) {
+	if err := parser.assertPeekType(NUMBER); err != nil {
+		return 0, err
+	}
+	parser.nextToken()
+
+	length, err := strconv.Atoi(parser.curToken.Literal)
+	if err != nil || length < 0 || length > MaxArrayLength {
+		return 0, fmt.Errorf("Position %d: invalid array length %s, must be 0-%d", parser.lexer.position, parser.curToken.Literal, MaxArrayLength)
+	}
+	return length, nil
 }
 
 // the parser is at an = when this is called
 func (parser *Parser) parseObject() (DataDeclaration, error) {
+	return parser.parseMembers([]TokenType{SEMICOLON, EOF})
+}
+
+// parses an object written in place, such as {street/string,zip/int}. The parser is at the {
+func (parser *Parser) parseInlineObject() (DataDeclaration, error) {
+	object, err := parser.parseMembers([]TokenType{RIGHT_BRACE})
+	if err != nil {
+		return nil, err
+	}
+	// past the }
+	parser.nextToken()
+	return object, nil
+}
+
+// parses an object's members up to (but not including) one of the end tokens. The parser is at the
+// token before the first key
+func (parser *Parser) parseMembers(ends []TokenType) (DataDeclaration, error) {
 	// format is key/value,key/value
-	if err := parser.assertPeekType(KEY_NAME); err != nil {
+	if err := parser.assertPeekIsKey(); err != nil {
 		return nil, err
 	}
 
 	keyValues := make([]KeyValueDataType, 0)
+	keys := make([]string, 0)
 
 	parser.nextToken()
 
@@ -238,53 +673,87 @@ func (parser *Parser) parseObject() (DataDeclaration, error) {
 
 		parser.nextToken()
 
-		if err := parser.assertPeekTypeOneOf([]TokenType{LEFT_BRACKET, KEY_NAME, STRING_DATA_TYPE, INT_DATA_TYPE, BOOL_DATA_TYPE, INCREMENT_DATA_TYPE}); err != nil {
+		if err := parser.assertPeekTypeOneOf(valueTokens()); err != nil {
 			return nil, err
 		}
 		parser.nextToken()
 
 		var valueData DataDeclaration
 		var parseErr error
-
-		switch parser.curToken.Type {
-		case LEFT_BRACKET:
-			valueData, parseErr = parser.parseArray()
-		case KEY_NAME, STRING_DATA_TYPE, INT_DATA_TYPE, BOOL_DATA_TYPE, INCREMENT_DATA_TYPE:
-			valueData, parseErr = parser.parseRawString()
-		default:
-			valueData = nil
-			parseErr = fmt.Errorf("Position %d: Unexpected token %s", parser.lexer.position, parser.curToken.Type)
+		if parser.curToken.Literal == MIRROR_KEYWORD && parser.peekToken.Type == COLON {
+			valueData, parseErr = parser.parseMirror(keys)
+		} else {
+			valueData, parseErr = parser.parseValue()
 		}
-
 		if parseErr != nil {
 			return nil, parseErr
 		}
 
-		if err := parser.assertPeekTypeOneOf([]TokenType{COMMA, SEMICOLON, EOF}); err != nil {
+		keyValue := KeyValueDataType{Key: key, Value: valueData, DriftPercentage: -1}
+		if err := parser.parseMemberModifiers(&keyValue); err != nil {
+			return nil, err
+		}
+
+		if err := parser.assertPeekTypeOneOf(append([]TokenType{COMMA}, ends...)); err != nil {
 			return nil, err
 		}
 
-		keyValues = append(keyValues, KeyValueDataType{Key: key, Value: valueData})
+		keyValues = append(keyValues, keyValue)
+		keys = append(keys, key)
 
-		// exit early if a semicolon/eof is upcoming
-		if parser.peekToken.Type == SEMICOLON || parser.peekToken.Type == EOF {
+		// exit early if the end of the object is upcoming
+		if parser.peekToken.Type != COMMA {
 			return ObjectDataType{Members: keyValues}, nil
 		}
 
-		if parser.peekToken.Type == COMMA {
-			// advance again to get past the comma
-			parser.nextToken()
-			if err := parser.assertPeekType(KEY_NAME); err != nil {
-				return nil, err
-			}
-			parser.nextToken()
+		// advance again to get past the comma
+		parser.nextToken()
+		if err := parser.assertPeekIsKey(); err != nil {
+			return nil, err
 		}
-
+		parser.nextToken()
 	}
 
 	return ObjectDataType{Members: keyValues}, nil
 }
 
+// parses the ?percentage (null), ~percentage (absent) and ^percentage (drift) that can follow an object
+// member's value. The parser is at the end of the value
+func (parser *Parser) parseMemberModifiers(keyValue *KeyValueDataType) error {
+	for parser.peekToken.Type == QUESTION || parser.peekToken.Type == TILDE || parser.peekToken.Type == CARET {
+		parser.nextToken()
+		marker := parser.curToken.Type
+
+		if err := parser.assertPeekType(NUMBER); err != nil {
+			return err
+		}
+		parser.nextToken()
+		percentage, err := strconv.ParseFloat(parser.curToken.Literal, 64)
+		if err != nil || percentage < 0 || percentage > 100 {
+			return fmt.Errorf("Position %d: invalid percentage %s for %s", parser.lexer.position, parser.curToken.Literal, keyValue.Key)
+		}
+
+		switch marker {
+		case QUESTION:
+			keyValue.NullPercentage = percentage
+		case TILDE:
+			keyValue.AbsentPercentage = percentage
+		default:
+			keyValue.DriftPercentage = percentage
+		}
+	}
+	return nil
+}
+
+// assertPeekIsKey checks that the next token can be an object key. Names of data types, such as
+// date or url, make perfectly good keys
+func (parser *Parser) assertPeekIsKey() error {
+	if isDataType(parser.peekToken.Literal) {
+		return nil
+	}
+	return parser.assertPeekType(KEY_NAME)
+}
+
 func (parser *Parser) assertPeekTypeOneOf(tokenTypes []TokenType) error {
 	for _, tokenType := range tokenTypes {
 		err := parser.assertPeekType(tokenType)
@@ -1,6 +1,9 @@
 package json_template
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestPlainDataTypes(test *testing.T) {
 	input := "string;int;bool;increment"
@@ -55,22 +58,66 @@ type tokenLiteralTest struct {
 	expected string
 }
 
-func TestTokenLiterals(test *testing.T) {
-	tests := []tokenLiteralTest{
-		{"string", "string"},
-		{"int", "int"},
-		{"bool", "bool"},
-		{"increment", "increment"},
-		{"[string]", "[string]:10000"},
-		{"[string]:100", "[string]:100"},
-		{"book=title/string", "{title: string}"},
-		{"book=title/string,pages/[string]", "{title: string, pages: [string]:10000}"},
-		{"[string|a,b,c]", "[(a|b|c)]:10000"},
-		{"int|1,2,3", "(1|2|3)"},
-		{"float|1,2.3,3.4", "(1|2.3|3.4)"},
-	}
+var tokenLiteralTests = []tokenLiteralTest{
+	{"string", "string"},
+	{"int", "int"},
+	{"bool", "bool"},
+	{"increment", "increment"},
+	{"[string]", "[string]:10000"},
+	{"[string]:100", "[string]:100"},
+	{"book=title/string", "{title/string}"},
+	{"book=title/string,pages/[string]", "{title/string,pages/[string]:10000}"},
+	{"[string|a,b,c]", "[string|a,b,c]:10000"},
+	{"int|1,2,3", "int|1,2,3"},
+	{"float|1,2.3,3.4", "float|1,2.3,3.4"},
+	{"int:-500..500", "int:-500..500"},
+	{"float:0..1e6:2", "float:0..1e+06:2"},
+	{"float:-1.5..2.5", "float:-1.5..2.5"},
+	{"string:5..200", "string:5..200"},
+	{"string:10", "string:10"},
+	{"[int:1..6]:3", "[int:1..6]:3"},
+	{"order=price/float:0..100:2,count/int:1..9", "{price/float:0..100:2,count/int:1..9}"},
+	{"int|-1,0,1", "int|-1,0,1"},
+	{"[string]:0..50", "[string]:0..50"},
+	{"[item]:0=20,1..10=70,1000=10", "[item]:0=20,1..10=70,1000=10"},
+	{"[item]:0=20,1..10", "[item]:0=20,1..10=80"},
+	{"[int]:0..2=50,5", "[int]:0..2=50,5=50"},
+	{"list=items/[int]:0=50,3=50,name/string", "{items/[int]:0=50,3=50,name/string}"},
+	{"user=name/string?30,nickname/string~50", "{name/string?30,nickname/string~50}"},
+	{"user=age/int:0..120~10?5,tags/[string]:1..3?12.5", "{age/int:0..120?5~10,tags/[string]:1..3?12.5}"},
+	{"[uuid%5]:10", "[uuid%5]:10"},
+	{"datetime:epochms%0.5", "datetime:epochms%0.5"},
+	{"hex:4..8%10", "hex:4..8%10"},
+	{"string:emoji", "string:emoji"},
+	{"[[int]:3]:100", "[[int]:3]:100"},
+	{"[[[bool]:1..2]:2]:0", "[[[bool]:1..2]:2]:0"},
+	{"[{id/int,tags/[string]:2}]:5", "[{id/int,tags/[string]:2}]:5"},
+	{"{id/int,address/{street/string,zip/int:5}?10,city/string}", "{id/int,address/{street/string,zip/int:5}?10,city/string}"},
+	{"drawing=shape/circle|square@kind,id/int;circle=r/float;square=s/float", "{shape/circle|square@kind,id/int}"},
+	{"[circle|square|triangle]:3", "[circle|square|triangle]:3"},
+	{"shape|circle@url", "shape|circle@url"},
+	{"[ref:customer.id]:3", "[ref:customer.id]:3"},
+	{"user=age/int^5,name/string?10~20^0.5", "{age/int^5,name/string?10~20^0.5}"},
+	{"user=tags/[string]:2^0", "{tags/[string]:2^0}"},
+	{"order=customer/ref:customer.id%5?10,total/float", "{customer/ref:customer.id%5?10,total/float}"},
+	{"user=email/email,login/mirror:email,backup/mirror:login~50", "{email/email,login/mirror:email,backup/mirror:login~50}"},
+	{"user=ref/string,mirror/ref,other/mirror:ref", "{ref/string,mirror/ref,other/mirror:ref}"},
+	{"order=placed/ref:customer.date", "{placed/ref:customer.date}"},
+	{"[string:5..20:quotes]:3", "[string:5..20:quotes]:3"},
+	{"user=bio/string:0..500:rtl?10", "{bio/string:0..500:rtl?10}"},
+	{"host=ip/ipv4,ip6/ipv6?5,site/url,mail/email,phone/phone,day/date,key/base64", "{ip/ipv4,ip6/ipv6?5,site/url,mail/email,phone/phone,day/date,key/base64}"},
+	{"string|red,date,url", "string|red,date,url"},
+	{"string|date,red", "string|date,red"},
+	{"string|active=90,suspended=9,deleted=1", "string|active=90,suspended=9,deleted=1"},
+	{"string|active=90,suspended,deleted", "string|active=90,suspended=5,deleted=5"},
+	{"int|200=95,500=5", "int|200=95,500=5"},
+	{"float|0.5=25,1.5", "float|0.5=25,1.5=75"},
+	{"user=status/string|active=90,deleted=10,name/string", "{status/string|active=90,deleted=10,name/string}"},
+	{"user=code/int|1,2,3,name/string?5", "{code/int|1,2,3,name/string?5}"},
+}
 
-	for testNumber, testCase := range tests {
+func TestTokenLiterals(test *testing.T) {
+	for testNumber, testCase := range tokenLiteralTests {
 		lexer := newLexer(testCase.input)
 		parser := NewParser(lexer)
 		template, err := parser.ParseTemplate()
@@ -89,11 +136,44 @@ func TestTokenLiterals(test *testing.T) {
 	}
 }
 
+// parseFirstDeclaration parses input, returning the TokenLiteral of its first declaration
+func parseFirstDeclaration(input string) (string, error) {
+	template, err := NewParserWithString(input).ParseTemplate()
+	if err != nil {
+		return "", err
+	}
+	if len(template.Declarations) == 0 {
+		return "", fmt.Errorf("Template %s is empty", input)
+	}
+	return template.Declarations[0].TokenLiteral(), nil
+}
+
+// TokenLiteral writes template syntax, so parsing its output gives back the same declaration
+func TestTokenLiteralsRoundTrip(test *testing.T) {
+	inputs := []string{"{id/int,a/{b/int}}", "user=name/string?30", "[string|a,b]", "float|1e6,0.25", "[float:0..1e6:2]:1..3=40,7"}
+	for _, testCase := range tokenLiteralTests {
+		inputs = append(inputs, testCase.input)
+	}
+
+	for _, input := range inputs {
+		literal, err := parseFirstDeclaration(input)
+		if err != nil {
+			test.Fatalf("Unexpected error parsing %s: %v", input, err)
+		}
+		reparsed, err := parseFirstDeclaration(literal)
+		if err != nil {
+			test.Errorf("Could not parse %s, the TokenLiteral of %s: %v", literal, input, err)
+		} else if reparsed != literal {
+			test.Errorf("Expected %s to parse back to itself, got %s", literal, reparsed)
+		}
+	}
+}
+
 func TestParseMulti(test *testing.T) {
 	tests := map[string][]string{
-		"book;book=title/string":                     []string{"book", "{title: string}"},
-		"book;book=pages/[page]:1;page=text/string":  []string{"book", "{pages: [page]:1}", "{text: string}"},
-		"book;book=pages/[page]:1;;page=text/string": []string{"book", "{pages: [page]:1}", "{text: string}"},
+		"book;book=title/string":                     []string{"book", "{title/string}"},
+		"book;book=pages/[page]:1;page=text/string":  []string{"book", "{pages/[page]:1}", "{text/string}"},
+		"book;book=pages/[page]:1;;page=text/string": []string{"book", "{pages/[page]:1}", "{text/string}"},
 	}
 
 	for input, expected := range tests {
@@ -113,6 +193,34 @@ func TestParseMulti(test *testing.T) {
 	}
 }
 
+func TestMaxDepths(test *testing.T) {
+	parser := NewParserWithString("comment;comment:3=text/string,replies/[comment]:0..2,author/user;user=name/string")
+	template, err := parser.ParseTemplate()
+	if err != nil {
+		test.Fatalf("Unexpected error in parsing: %v", err)
+	}
+	if template.Declarations[1].TokenLiteral() != "{text/string,replies/[comment]:0..2,author/user}" {
+		test.Errorf("Unexpected comment declaration %s", template.Declarations[1].TokenLiteral())
+	}
+	if template.MaxDepth("comment") != 3 {
+		test.Errorf("Expected comment to have a maximum depth of 3, got %d", template.MaxDepth("comment"))
+	}
+	if template.MaxDepth("user") != DefaultMaxDepth {
+		test.Errorf("Expected user to have the default maximum depth, got %d", template.MaxDepth("user"))
+	}
+}
+
+func TestTemplateDrift(test *testing.T) {
+	parser := NewParserWithString("[user]:3;^2.5;user=age/int")
+	template, err := parser.ParseTemplate()
+	if err != nil {
+		test.Fatalf("Unexpected error in parsing: %v", err)
+	}
+	if template.DriftPercentage != 2.5 || len(template.Declarations) != 2 || template.Declarations[0].TokenLiteral() != "[user]:3" {
+		test.Errorf("Expected 2.5%% drift and two declarations, got %v and %v", template.DriftPercentage, template.Declarations)
+	}
+}
+
 func TestParseErrors(test *testing.T) {
 	// all of these should generate errors
 	tests := []string{
@@ -127,6 +235,81 @@ func TestParseErrors(test *testing.T) {
 		"int|1,a,3",
 		"int|",
 		"int|1,1.2,3",
+		"int:5..1",
+		"int:1.5..3",
+		"int:1e30",
+		"int:",
+		"int:1..",
+		"string:-1..5",
+		"bool:1..2",
+		"int:1..2:3",
+		"float:0..1:x",
+		"[string]:5..1",
+		"[string]:-1",
+		"[string]:1=60,2=60",
+		"[string]:1=0,2=0",
+		"[string]:1=x",
+		"[string]:1,",
+		"user=name/string?",
+		"user=name/string?101",
+		"user=name/string~-1",
+		"user=name/string?x",
+		"datetime:iso",
+		"datetime:1..2",
+		"string:klingon",
+		"[{id/int]:5",
+		"{id/int",
+		"{id/int}}",
+		"{}",
+		"[[int]:3",
+		"shape/circle|",
+		"a=s/circle|string",
+		"a=s/circle|square@",
+		"a=s/circle@kind",
+		"a=s/circle|date",
+		"shape=circle|square",
+		"string:5..6:",
+		"string:5..6:epoch",
+		"uuid:1..2",
+		"string%5",
+		"uuid%101",
+		"uuid%",
+		"hex:-1",
+		"string:0..9e18",
+		"[int]:0..9223372036854775807",
+		"[int]:1000001",
+		"[int]:0=50,2000000",
+		"string:1000001",
+		"base64:2000000",
+		"string|a=60,b=50",
+		"string|a=0,b=0",
+		"string|a=-1",
+		"string|a=",
+		"comment:0=text/string",
+		"node;node:101=next/node",
+		"node;node:100000000=next/node",
+		"ref:customer.id",
+		"user=age/int^",
+		"user=age/int^101",
+		"[int^5]:3",
+		"^",
+		"^-1",
+		"^5^5",
+		"[ref:customer]:3",
+		"[ref:customer.]:3",
+		"[ref:.id]:3",
+		"[ref:customer.id%]:3",
+		"[ref:customer.id%101]:3",
+		"user=email/email,login/mirror:mail",
+		"user=login/mirror:email,email/email",
+		"user=login/mirror:login",
+		"[mirror:email]:3",
+		"user=emails/[mirror:email]:3",
+		"comment:-1=text/string",
+		"comment:2.5=text/string",
+		"comment:x=text/string",
+		"comment:3",
+		"comment:3:4=text/string",
 	}
 
 	for testNumber, testCase := range tests {
@@ -142,7 +325,7 @@ func TestParseErrors(test *testing.T) {
 func TestExtractEnumValues(test *testing.T) {
 	testString := "|1,a,c"
 	parser := NewParserWithString(testString)
-	values := parser.extractEnumData()
+	values, weights := parser.extractEnumData()
 	if len(values) != 3 {
 		test.Errorf("Expected 3 strings but got %v", len(values))
 	}
@@ -153,4 +336,29 @@ func TestExtractEnumValues(test *testing.T) {
 			test.Errorf("Expected string %v but got %v", expectedValues[index], extractedString)
 		}
 	}
+	for _, weight := range weights {
+		if weight != "" {
+			test.Errorf("Expected no weights but got %v", weights)
+		}
+	}
+}
+
+func TestExtractWeightedEnumValues(test *testing.T) {
+	parser := NewParserWithString("|active=90,suspended,deleted=1,name/string")
+	values, weights := parser.extractEnumData()
+
+	expectedValues := []string{"active", "suspended", "deleted"}
+	expectedWeights := []string{"90", "", "1"}
+	if len(values) != len(expectedValues) || len(weights) != len(expectedWeights) {
+		test.Fatalf("Expected %v and %v but got %v and %v", expectedValues, expectedWeights, values, weights)
+	}
+	for index := range values {
+		if values[index] != expectedValues[index] || weights[index] != expectedWeights[index] {
+			test.Errorf("Expected %v and %v but got %v and %v", expectedValues, expectedWeights, values, weights)
+		}
+	}
+	// the next member of the object is left alone
+	if parser.peekToken.Type != COMMA {
+		test.Errorf("Expected the parser to stop before the comma, but the next token is %v", parser.peekToken)
+	}
 }
@@ -8,6 +8,23 @@ package json_template
 // [string]:1000 will create an array of 1000 strings
 // [book]:1000;book=title/string,author/string will create an array of book objects
 // title/string,author/string,chapters/[string]:6 will return an object with a title and an author and a 6-item array of strings
+// [int:-500..500]:10 will create an array of 10 ints between -500 and 500
+// price/float:0..1e6:2 will return an object with a price between 0 and a million, with two decimal places
+// [string:5..20:emoji]:10 will create an array of 10 strings of emoji, each 5 to 20 characters long
+// [uuid%5]:10 will create an array of 10 uuids, 5% of which are subtly invalid
+// created/datetime:epochms will return an object with a timestamp in milliseconds since the epoch
+// name/string?30,nickname/string~50 will return an object whose name is null 30% of the time, and that's
+// missing its nickname half the time
+// [{id/int,tags/[[string]:2]:3}]:10 will create an array of 10 objects, each with a 3-item array of 2-item arrays of strings
+// [circle|square@kind]:10;circle=radius/float;square=side/float will create an array of 10 circles and
+// squares, each with a kind member that says which it is
+// comment;comment:3=text/string,replies/[comment]:0..2 will return a comment whose replies are nested up to 3 deep
+// store;store=customers/[customer]:5,orders/[order]:20;customer=id/uuid;order=customer/ref:customer.id%10 will return
+// orders for the customers in the same store, except for 10% of them whose customer doesn't exist
+// [user]:10;^2;user=id/int,age/int^20,name/string^0 will create an array of 10 users whose ages are some other type
+// 20% of the time, whose names are always strings, and whose other members are the wrong type 2% of the time
+
+import "sort"
 
 type TokenType string
 
@@ -22,6 +39,9 @@ const (
 	SLASH         = "/"
 	LEFT_BRACKET  = "["
 	RIGHT_BRACKET = "]"
+	// for objects written in place rather than declared as a custom type
+	LEFT_BRACE  = "{"
+	RIGHT_BRACE = "}"
 
 	// data types
 	STRING_DATA_TYPE    = "STRING"
@@ -29,8 +49,20 @@ const (
 	INCREMENT_DATA_TYPE = "INCREMENT"
 	BOOL_DATA_TYPE      = "BOOL"
 	FLOAT_DATA_TYPE     = "FLOAT"
-	// for use with floats
-	PERIOD = "PERIOD"
+	UUID_DATA_TYPE      = "UUID"
+	DATETIME_DATA_TYPE  = "DATETIME"
+	DATE_DATA_TYPE      = "DATE"
+	EMAIL_DATA_TYPE     = "EMAIL"
+	URL_DATA_TYPE       = "URL"
+	IPV4_DATA_TYPE      = "IPV4"
+	IPV6_DATA_TYPE      = "IPV6"
+	HEX_DATA_TYPE       = "HEX"
+	BASE64_DATA_TYPE    = "BASE64"
+	PHONE_DATA_TYPE     = "PHONE"
+	// separates a custom type from its member, as in ref:customer.id
+	PERIOD = "."
+	// separates the ends of a range, such as 1..10
+	RANGE = ".."
 
 	// keys or sizes
 	KEY_NAME = "KEY_NAME"
@@ -43,6 +75,17 @@ const (
 	SEMICOLON = ";"
 
 	PIPE = "|"
+	// names the member that says which of a union's types an object is
+	AT = "@"
+
+	// for object members that are sometimes null or missing
+	QUESTION = "?"
+	TILDE    = "~"
+	// for values that are sometimes a different type
+	CARET = "^"
+
+	// the percentage of values that are invalid
+	PERCENT = "%"
 )
 
 var dataTypes = map[string]TokenType{
@@ -51,8 +94,46 @@ var dataTypes = map[string]TokenType{
 	"increment": INCREMENT_DATA_TYPE,
 	"bool":      BOOL_DATA_TYPE,
 	"float":     FLOAT_DATA_TYPE,
+	"uuid":      UUID_DATA_TYPE,
+	"datetime":  DATETIME_DATA_TYPE,
+	"date":      DATE_DATA_TYPE,
+	"email":     EMAIL_DATA_TYPE,
+	"url":       URL_DATA_TYPE,
+	"ipv4":      IPV4_DATA_TYPE,
+	"ipv6":      IPV6_DATA_TYPE,
+	"hex":       HEX_DATA_TYPE,
+	"base64":    BASE64_DATA_TYPE,
+	"phone":     PHONE_DATA_TYPE,
+}
+
+// semantic data types are strings (or numbers) with a format that clients usually validate.
+// They can be made invalid some of the time with a percentage, such as uuid%5
+var semanticDataTypes = map[string]bool{
+	"uuid":     true,
+	"datetime": true,
+	"date":     true,
+	"email":    true,
+	"url":      true,
+	"ipv4":     true,
+	"ipv6":     true,
+	"hex":      true,
+	"base64":   true,
+	"phone":    true,
 }
 
+// words that start a value taken from elsewhere in the generated JSON. ref:customer.id repeats the id of
+// a customer written earlier, and mirror:email repeats the email member of the same object
+const (
+	REFERENCE_KEYWORD = "ref"
+	MIRROR_KEYWORD    = "mirror"
+)
+
+// the formats datetime can be written in. The first is the default
+var datetimeFormats = []string{"rfc3339", "epoch", "epochms"}
+
+// the sets of characters strings can be made from. The first is the default
+var stringCharsets = []string{"ascii", "unicode", "emoji", "rtl", "control", "quotes", "surrogates", "invalid"}
+
 // stringToToken decides if the passed-string is a known datatype or not
 // and returns the appropriate token
 func stringToToken(input string) TokenType {
@@ -67,3 +148,18 @@ func isDataType(input string) bool {
 	_, found := dataTypes[input]
 	return found
 }
+
+// dataTypeTokens lists the TokenType of every data type, in a consistent order
+func dataTypeTokens() []TokenType {
+	tokens := make([]TokenType, 0, len(dataTypes))
+	for _, token := range dataTypes {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(a, b int) bool { return tokens[a] < tokens[b] })
+	return tokens
+}
+
+// IsSemanticDataType determines if the given data type is one of the semantic types
+func IsSemanticDataType(input string) bool {
+	return semanticDataTypes[input]
+}
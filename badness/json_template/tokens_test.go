@@ -12,6 +12,9 @@ func TestStringToToken(test *testing.T) {
 		"increment": "INCREMENT",
 		"sniffle":   "KEY_NAME",
 		"float":     "FLOAT",
+		"ipv4":      "IPV4",
+		"base64":    "BASE64",
+		"datetime":  "DATETIME",
 	}
 
 	for input, expected := range tests {
@@ -39,3 +42,20 @@ func TestIsDataType(test *testing.T) {
 		}
 	}
 }
+
+func TestIsSemanticDataType(test *testing.T) {
+	tests := map[string]bool{
+		"uuid":     true,
+		"phone":    true,
+		"datetime": true,
+		"string":   false,
+		"sniffle":  false,
+	}
+
+	for input, expected := range tests {
+		actual := IsSemanticDataType(input)
+		if expected != actual {
+			test.Errorf("Test for %s: expected %v, got %v", input, expected, actual)
+		}
+	}
+}
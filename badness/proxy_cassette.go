@@ -0,0 +1,334 @@
+package badness
+
+// Record and replay for proxied traffic. With X-Proxy-Record, every upstream response is saved to a
+// cassette on disk. With X-Proxy-Replay, responses come from the cassette instead of the upstream, so
+// chaos tests can be run against a recording without the real service. Either way, the rest of the
+// pipeline treats the response as if it had just been proxied.
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ProxyRecord names the cassette that proxied responses are saved to
+const ProxyRecord = "X-Proxy-Record"
+
+// ProxyReplay names the cassette that responses are served from. No upstream is contacted
+const ProxyReplay = "X-Proxy-Replay"
+
+// ProxyMatch lists the parts of the request used to find a recorded response:
+// method, path, query and body. The default is method,path,query
+const ProxyMatch = "X-Proxy-Match"
+
+const interactionExtension = ".json"
+
+// the headers whose values are left out of cassettes, since cassettes tend to get shared and checked in
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// what credential headers are recorded as
+const redactedValue = "REDACTED"
+
+type recordedRequest struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header"`
+	BodyHash string      `json:"bodyHash"`
+}
+
+type recordedResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// interaction is one request/response pair as it's stored in a cassette
+type interaction struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type cassetteMatch struct {
+	method bool
+	path   bool
+	query  bool
+	body   bool
+}
+
+// parseCassetteMatch reads the comma-separated parts listed in the X-Proxy-Match header
+func parseCassetteMatch(headerValues []string) (cassetteMatch, error) {
+	if len(headerValues) == 0 {
+		return cassetteMatch{method: true, path: true, query: true}, nil
+	}
+
+	match := cassetteMatch{}
+	for part := range parseHeadersWithKeyValues(headerValues, ",") {
+		switch strings.TrimSpace(part) {
+		case "":
+			continue
+		case "method":
+			match.method = true
+		case "path":
+			match.path = true
+		case "query":
+			match.query = true
+		case "body":
+			match.body = true
+		default:
+			return match, fmt.Errorf("Unknown %s part %s", ProxyMatch, part)
+		}
+	}
+	return match, nil
+}
+
+// key builds the file name that an interaction for request is stored under
+func (match cassetteMatch) key(request *http.Request, bodyHash string) string {
+	hash := sha256.New()
+	if match.method {
+		fmt.Fprintf(hash, "method=%s\n", request.Method)
+	}
+	if match.path {
+		fmt.Fprintf(hash, "path=%s\n", request.URL.Path)
+	}
+	if match.query {
+		// Encode sorts the parameters, so their order doesn't matter
+		fmt.Fprintf(hash, "query=%s\n", request.URL.Query().Encode())
+	}
+	if match.body {
+		fmt.Fprintf(hash, "body=%s\n", bodyHash)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// cassettePath returns the directory for the named cassette
+func cassettePath(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("Invalid cassette name %q", name)
+	}
+	return filepath.Join(proxyConfig.CassetteDir, name), nil
+}
+
+// readRequestBody reads all of request's body so it can be hashed, and puts back a copy
+// so it can still be forwarded
+func readRequestBody(request *http.Request) (string, error) {
+	if request.Body == nil {
+		request.Body = http.NoBody
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return "", err
+	}
+	request.Body.Close()
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// cassetteRecorder saves an interaction once the upstream body has been read all the way through
+type cassetteRecorder struct {
+	io.ReadCloser
+	path        string
+	interaction interaction
+	body        bytes.Buffer
+	saved       bool
+}
+
+func (recorder *cassetteRecorder) Read(buf []byte) (int, error) {
+	bytesRead, err := recorder.ReadCloser.Read(buf)
+	recorder.body.Write(buf[0:bytesRead])
+	if err == io.EOF && !recorder.saved {
+		recorder.saved = true
+		recorder.interaction.Response.Body = recorder.body.Bytes()
+		if saveErr := saveInteraction(recorder.path, recorder.interaction); saveErr != nil {
+			log.Printf("Could not record to %s: %v", recorder.path, saveErr)
+		}
+	}
+	return bytesRead, err
+}
+
+// saveInteraction writes the interaction to path. It's written to a temporary file first so
+// a replay never sees half of it
+func saveInteraction(path string, recorded interaction) error {
+	encoded, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	directory := filepath.Dir(path)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(directory, ".recording")
+	if err != nil {
+		return err
+	}
+	if _, err := temporary.Write(encoded); err != nil {
+		temporary.Close()
+		os.Remove(temporary.Name())
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}
+
+// redactCredentials returns a copy of header with the values of credential headers replaced
+func redactCredentials(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, key := range credentialHeaders {
+		if values, found := redacted[key]; found {
+			replaced := make([]string, len(values))
+			for index := range replaced {
+				replaced[index] = redactedValue
+			}
+			redacted[key] = replaced
+		}
+	}
+	return redacted
+}
+
+// recordProxyResponse makes response's body save the interaction to the cassette at path
+// once it's been read
+func recordProxyResponse(path string, request *http.Request, bodyHash string, response *http.Response) {
+	response.Body = &cassetteRecorder{
+		ReadCloser: response.Body,
+		path:       path,
+		interaction: interaction{
+			Request: recordedRequest{
+				Method:   request.Method,
+				URL:      request.URL.String(),
+				Header:   redactCredentials(request.Header),
+				BodyHash: bodyHash,
+			},
+			Response: recordedResponse{
+				StatusCode: response.StatusCode,
+				Header:     redactCredentials(response.Header),
+			},
+		},
+	}
+}
+
+// buildReplayResponse serves request from the cassette named in X-Proxy-Replay
+func buildReplayResponse(request *http.Request) *proxiedResponse {
+	path, bodyHash, err := getInteractionPath(request, ProxyReplay)
+	if err != nil {
+		return newProxyError(http.StatusBadRequest, "%v", err)
+	}
+
+	encoded, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newProxyError(http.StatusNotFound, "No recorded response for %s %s (body %s)", request.Method, request.URL, bodyHash)
+	} else if err != nil {
+		return newProxyError(http.StatusInternalServerError, "Could not read recording: %v", err)
+	}
+
+	var recorded interaction
+	if err := json.Unmarshal(encoded, &recorded); err != nil {
+		return newProxyError(http.StatusInternalServerError, "Could not read recording: %v", err)
+	}
+	// net/http panics on a status it can't write, and a hand-edited recording could have anything
+	if status := recorded.Response.StatusCode; status < 100 || status > 999 {
+		return newProxyError(http.StatusInternalServerError, "Recording %s has an invalid status %d", path, status)
+	}
+
+	response := &http.Response{
+		StatusCode:    recorded.Response.StatusCode,
+		Header:        recorded.Response.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(recorded.Response.Body)),
+		ContentLength: int64(len(recorded.Response.Body)),
+	}
+	if response.Header == nil {
+		response.Header = make(http.Header)
+	}
+	return &proxiedResponse{response: response, cancel: func() {}}
+}
+
+// getInteractionPath works out which file in the cassette named by header request belongs to.
+// The request's body is read along the way, and its hash is returned as well
+func getInteractionPath(request *http.Request, header string) (string, string, error) {
+	directory, err := cassettePath(getFirstHeaderValue(request, header))
+	if err != nil {
+		return "", "", err
+	}
+	match, err := parseCassetteMatch(request.Header[ProxyMatch])
+	if err != nil {
+		return "", "", err
+	}
+	bodyHash, err := readRequestBody(request)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not read request body: %v", err)
+	}
+	return filepath.Join(directory, match.key(request, bodyHash)+interactionExtension), bodyHash, nil
+}
+
+// ListCassettes returns the names of all the recorded cassettes
+func ListCassettes() ([]string, error) {
+	entries, err := ioutil.ReadDir(proxyConfig.CassetteDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ExportCassette returns every interaction in the named cassette as a JSON array
+func ExportCassette(name string) ([]byte, error) {
+	directory, err := cassettePath(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(directory, "*"+interactionExtension))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		if _, err := os.Stat(directory); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+
+	interactions := make([]json.RawMessage, 0, len(files))
+	for _, file := range files {
+		encoded, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		interactions = append(interactions, json.RawMessage(encoded))
+	}
+	return json.Marshal(interactions)
+}
+
+// DeleteCassette removes the named cassette and everything recorded in it
+func DeleteCassette(name string) error {
+	directory, err := cassettePath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(directory); err != nil {
+		return err
+	}
+	return os.RemoveAll(directory)
+}
@@ -0,0 +1,192 @@
+package badness
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// useTemporaryCassetteDir points the proxy at an empty cassette directory. The returned function
+// puts everything back
+func useTemporaryCassetteDir(test *testing.T) func() {
+	directory, err := ioutil.TempDir("", "cassettes")
+	if err != nil {
+		test.Fatalf("Could not create cassette directory: %v", err)
+	}
+	config := DefaultProxyConfig()
+	config.CassetteDir = directory
+	ConfigureProxy(config)
+
+	return func() {
+		ConfigureProxy(DefaultProxyConfig())
+		os.RemoveAll(directory)
+	}
+}
+
+func TestRecordAndReplay(test *testing.T) {
+	defer useTemporaryCassetteDir(test)()
+
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		hits++
+		response.Header().Set("X-Upstream", "yes")
+		response.WriteHeader(http.StatusAccepted)
+		response.Write([]byte("recorded " + request.URL.Path))
+	}))
+	defer upstream.Close()
+
+	for _, id := range []string{"1", "2"} {
+		request := httptest.NewRequest("GET", "http://localhost/items/"+id, nil)
+		request.Header[ProxyRequest] = []string{upstream.URL}
+		request.Header[ProxyRecord] = []string{"items"}
+		runPipeline(request)
+	}
+	upstream.Close()
+
+	request := httptest.NewRequest("GET", "http://localhost/items/2", nil)
+	request.Header[ProxyReplay] = []string{"items"}
+	request.Header[CodeByHistogram] = []string{"0"}
+	request.Header[ProxyStatusMode] = []string{"hit"}
+	response := runPipeline(request)
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if response.StatusCode != http.StatusAccepted || string(body) != "recorded /items/2" {
+		test.Errorf("Expected the recorded response, got %d %s", response.StatusCode, body)
+	}
+	if response.Header.Get("X-Upstream") != "yes" {
+		test.Errorf("Expected the recorded headers, got %v", response.Header)
+	}
+	if hits != 2 {
+		test.Errorf("Expected the upstream to be hit twice, got %d", hits)
+	}
+
+	request = httptest.NewRequest("GET", "http://localhost/items/3", nil)
+	request.Header[ProxyReplay] = []string{"items"}
+	if response := runPipeline(request); response.StatusCode != http.StatusNotFound {
+		test.Errorf("Expected a 404 for a request that wasn't recorded, got %d", response.StatusCode)
+	}
+
+	// the query is part of the match by default
+	request = httptest.NewRequest("GET", "http://localhost/items/2?page=1", nil)
+	request.Header[ProxyReplay] = []string{"items"}
+	if response := runPipeline(request); response.StatusCode != http.StatusNotFound {
+		test.Errorf("Expected a 404 for a different query, got %d", response.StatusCode)
+	}
+
+	names, err := ListCassettes()
+	if err != nil || len(names) != 1 || names[0] != "items" {
+		test.Errorf("Expected one cassette, got %v %v", names, err)
+	}
+
+	exported, err := ExportCassette("items")
+	if err != nil {
+		test.Fatalf("Could not export cassette: %v", err)
+	}
+	var interactions []interaction
+	if err := json.Unmarshal(exported, &interactions); err != nil || len(interactions) != 2 {
+		test.Errorf("Expected two interactions, got %d %v", len(interactions), err)
+	}
+
+	if err := DeleteCassette("items"); err != nil {
+		test.Errorf("Could not delete cassette: %v", err)
+	}
+	if _, err := ExportCassette("items"); !os.IsNotExist(err) {
+		test.Errorf("Expected the cassette to be gone, got %v", err)
+	}
+}
+
+func TestReplayMatchesBody(test *testing.T) {
+	defer useTemporaryCassetteDir(test)()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		response.Write([]byte("got " + string(body)))
+	}))
+	defer upstream.Close()
+
+	request := httptest.NewRequest("POST", "http://localhost/echo", strings.NewReader("first"))
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[ProxyRecord] = []string{"bodies"}
+	request.Header[ProxyMatch] = []string{"method,path,body"}
+	body, _ := ioutil.ReadAll(runPipeline(request).Body)
+	if string(body) != "got first" {
+		test.Fatalf("Expected the body to be forwarded while recording, got %s", body)
+	}
+
+	request = httptest.NewRequest("POST", "http://localhost/echo", strings.NewReader("first"))
+	request.Header[ProxyReplay] = []string{"bodies"}
+	request.Header[ProxyMatch] = []string{"method,path,body"}
+	body, _ = ioutil.ReadAll(runPipeline(request).Body)
+	if string(body) != "got first" {
+		test.Errorf("Expected to replay the matching body, got %s", body)
+	}
+
+	request = httptest.NewRequest("POST", "http://localhost/echo", strings.NewReader("second"))
+	request.Header[ProxyReplay] = []string{"bodies"}
+	request.Header[ProxyMatch] = []string{"method,path,body"}
+	if response := runPipeline(request); response.StatusCode != http.StatusNotFound {
+		test.Errorf("Expected a different body not to match, got %d", response.StatusCode)
+	}
+
+	request = makeTestRequest()
+	request.Header[ProxyReplay] = []string{"../escape"}
+	if response := runPipeline(request); response.StatusCode != http.StatusBadRequest {
+		test.Errorf("Expected a bad cassette name to be rejected, got %d", response.StatusCode)
+	}
+}
+
+func TestRecordingRedactsCredentials(test *testing.T) {
+	defer useTemporaryCassetteDir(test)()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Set-Cookie", "session=secret")
+		response.Write([]byte(request.Header.Get("Authorization")))
+	}))
+	defer upstream.Close()
+
+	request := httptest.NewRequest("GET", "http://localhost/private", nil)
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[ProxyRecord] = []string{"private"}
+	request.Header.Set("Authorization", "Bearer secret")
+	request.Header.Set("Cookie", "session=secret")
+	request.Header.Set("Accept", "text/plain")
+	response := runPipeline(request)
+	body, _ := ioutil.ReadAll(response.Body)
+
+	// only what's written down is redacted
+	if string(body) != "Bearer secret" || response.Header.Get("Set-Cookie") != "session=secret" {
+		test.Errorf("Expected the credentials to reach the upstream and client, got %s %v", body, response.Header)
+	}
+
+	exported, _ := ExportCassette("private")
+	if strings.Contains(string(exported), "secret") {
+		test.Errorf("Expected credentials to be redacted, got %s", exported)
+	}
+	var interactions []interaction
+	json.Unmarshal(exported, &interactions)
+	if len(interactions) != 1 || interactions[0].Request.Header.Get("Authorization") != redactedValue ||
+		interactions[0].Request.Header.Get("Accept") != "text/plain" {
+		test.Errorf("Expected only the credentials to be redacted, got %+v", interactions)
+	}
+}
+
+func TestReplayRejectsBadStatus(test *testing.T) {
+	defer useTemporaryCassetteDir(test)()
+
+	for _, status := range []int{0, 42, 1000} {
+		request := httptest.NewRequest("GET", "http://localhost/broken", nil)
+		request.Header[ProxyReplay] = []string{"broken"}
+		path, _, _ := getInteractionPath(request, ProxyReplay)
+		if err := saveInteraction(path, interaction{Response: recordedResponse{StatusCode: status}}); err != nil {
+			test.Fatalf("Could not save interaction: %v", err)
+		}
+
+		if response := runPipeline(request); response.StatusCode != http.StatusInternalServerError {
+			test.Errorf("Expected a recording with status %d to be an error, got %d", status, response.StatusCode)
+		}
+	}
+}
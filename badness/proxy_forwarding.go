@@ -0,0 +1,114 @@
+package badness
+
+// Forwarding policy for proxied requests. bad-server's own control headers and the
+// hop-by-hop headers that only describe the client's connection are stripped before the
+// request goes upstream, and the usual X-Forwarded-For and Via headers are added.
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// ProxyForwardAllow limits the client's headers that are forwarded to the ones listed
+const ProxyForwardAllow = "X-Proxy-Forward-Allow"
+
+// ProxyForwardDeny lists headers that should never be forwarded, including the ones bad-server adds
+const ProxyForwardDeny = "X-Proxy-Forward-Deny"
+
+// ProxyHost decides the Host header sent upstream: upstream, original, or an explicit host
+const ProxyHost = "X-Proxy-Host"
+
+const proxyVia = "bad-server"
+
+// hopByHopHeaders only apply to a single connection, so they aren't forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type forwardingPolicy struct {
+	// if not nil, only these client headers are forwarded
+	allow map[string]bool
+	deny  map[string]bool
+	// the Host to send upstream. Empty uses the upstream's host
+	host string
+}
+
+// parseHeaderNameList reads comma-separated header names into a set of canonical names
+func parseHeaderNameList(headerValues []string) map[string]bool {
+	names := make(map[string]bool)
+	for _, value := range headerValues {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				names[textproto.CanonicalMIMEHeaderKey(name)] = true
+			}
+		}
+	}
+	return names
+}
+
+// parseForwardingPolicy reads the forwarding headers in request
+func parseForwardingPolicy(request *http.Request) (forwardingPolicy, error) {
+	policy := forwardingPolicy{deny: parseHeaderNameList(request.Header[ProxyForwardDeny])}
+	if requestHasHeader(request, ProxyForwardAllow) {
+		policy.allow = parseHeaderNameList(request.Header[ProxyForwardAllow])
+	}
+
+	switch hostMode := strings.TrimSpace(getFirstHeaderValue(request, ProxyHost)); hostMode {
+	case "", "upstream":
+	case "original":
+		policy.host = request.Host
+	default:
+		if strings.ContainsAny(hostMode, "/ ") {
+			return policy, fmt.Errorf("Invalid %s %s", ProxyHost, hostMode)
+		}
+		policy.host = hostMode
+	}
+	return policy, nil
+}
+
+// forwardedHeaders builds the headers to send upstream for request
+func (policy forwardingPolicy) forwardedHeaders(request *http.Request) http.Header {
+	stripped := make(map[string]bool)
+	for _, header := range controlHeaders {
+		stripped[header] = true
+	}
+	for _, header := range hopByHopHeaders {
+		stripped[header] = true
+	}
+	// Connection can name more headers that only apply to this hop
+	for header := range parseHeaderNameList(request.Header["Connection"]) {
+		stripped[header] = true
+	}
+
+	forwarded := make(http.Header)
+	for header, values := range request.Header {
+		if stripped[header] || (policy.allow != nil && !policy.allow[header]) {
+			continue
+		}
+		forwarded[header] = append([]string(nil), values...)
+	}
+
+	if clientIP, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		if previous := forwarded.Get("X-Forwarded-For"); previous != "" {
+			clientIP = previous + ", " + clientIP
+		}
+		forwarded.Set("X-Forwarded-For", clientIP)
+	}
+	forwarded.Add("Via", fmt.Sprintf("%d.%d %s", request.ProtoMajor, request.ProtoMinor, proxyVia))
+
+	for header := range policy.deny {
+		forwarded.Del(header)
+	}
+	return forwarded
+}
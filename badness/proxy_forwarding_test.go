@@ -0,0 +1,71 @@
+package badness
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyForwarding(test *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received = request
+	}))
+	defer upstream.Close()
+
+	request := makeTestRequest()
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[AddNoise] = []string{"0"}
+	request.Header.Set("Connection", "X-Hop")
+	request.Header.Set("X-Hop", "hop")
+	request.Header.Set("Te", "trailers")
+	request.Header.Set("Accept", "text/plain")
+	request.Header.Set("X-Forwarded-For", "10.0.0.1")
+	runPipeline(request)
+
+	for _, header := range []string{ProxyRequest, AddNoise, "Connection", "X-Hop", "Te"} {
+		if received.Header.Get(header) != "" {
+			test.Errorf("Expected %s to be stripped, got %s", header, received.Header.Get(header))
+		}
+	}
+	if received.Header.Get("Accept") != "text/plain" {
+		test.Errorf("Expected Accept to be forwarded, got %v", received.Header)
+	}
+	if received.Header.Get("X-Forwarded-For") != "10.0.0.1, 192.0.2.1" {
+		test.Errorf("Unexpected X-Forwarded-For %s", received.Header.Get("X-Forwarded-For"))
+	}
+	if received.Header.Get("Via") != "1.1 bad-server" {
+		test.Errorf("Unexpected Via %s", received.Header.Get("Via"))
+	}
+	if !strings.HasPrefix(upstream.URL, "http://"+received.Host) {
+		test.Errorf("Expected the upstream Host by default, got %s", received.Host)
+	}
+
+	request = makeTestRequest()
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[ProxyForwardAllow] = []string{"accept"}
+	request.Header[ProxyForwardDeny] = []string{"Via"}
+	request.Header[ProxyHost] = []string{"original"}
+	request.Header.Set("Accept", "text/plain")
+	request.Header.Set("Cookie", "a=b")
+	runPipeline(request)
+
+	if received.Header.Get("Cookie") != "" || received.Header.Get("Accept") != "text/plain" {
+		test.Errorf("Expected only allowed headers to be forwarded, got %v", received.Header)
+	}
+	if received.Header.Get("Via") != "" {
+		test.Errorf("Expected Via to be denied, got %s", received.Header.Get("Via"))
+	}
+	if received.Host != "localhost" {
+		test.Errorf("Expected the original Host, got %s", received.Host)
+	}
+
+	request = makeTestRequest()
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[ProxyHost] = []string{"api.example.com"}
+	runPipeline(request)
+	if received.Host != "api.example.com" {
+		test.Errorf("Expected an explicit Host, got %s", received.Host)
+	}
+}
@@ -1,54 +1,199 @@
 package badness
 
 // ProxyRequest is a specialized response generator that passes along the request
-// as-is to the host specified in the X-Proxy-To-Host header. That header is not passed along.
+// to the host specified in the X-Proxy-To-Host header. bad-server's control headers are not passed along.
 // The idea is that you can query existing web services but then add response affectors after the
 // fact.
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 const ProxyRequest = "X-Proxy-To-Host"
 
+// ProxyTimeout limits how long a single proxied request can take, including reading the body
+const ProxyTimeout = "X-Proxy-Timeout"
+
+// ProxyConfig tunes the client that's shared by all proxied requests
+type ProxyConfig struct {
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+	InsecureSkipVerify    bool
+	// the status sent to the client when the upstream request fails
+	ErrorStatus int
+	// the status sent to the client when the upstream request times out
+	TimeoutStatus int
+	// where X-Proxy-Record and X-Proxy-Replay keep their cassettes
+	CassetteDir string
+}
+
+// DefaultProxyConfig returns the settings used if ConfigureProxy is never called
+func DefaultProxyConfig() ProxyConfig {
+	return ProxyConfig{
+		ConnectTimeout:        10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   10,
+		ErrorStatus:           http.StatusBadGateway,
+		TimeoutStatus:         http.StatusGatewayTimeout,
+		CassetteDir:           "cassettes",
+	}
+}
+
+// Validate checks that config's settings can be used. net/http only writes status codes with three digits
+func (config ProxyConfig) Validate() error {
+	if config.ErrorStatus < 100 || config.ErrorStatus > 999 {
+		return fmt.Errorf("The proxy error status must be 100-999, got %d", config.ErrorStatus)
+	}
+	if config.TimeoutStatus < 100 || config.TimeoutStatus > 999 {
+		return fmt.Errorf("The proxy timeout status must be 100-999, got %d", config.TimeoutStatus)
+	}
+	return nil
+}
+
+var proxyConfig = DefaultProxyConfig()
+var proxyClient = newProxyClient(proxyConfig)
+
+// ConfigureProxy replaces the shared proxy client. It's meant to be called at startup,
+// before any requests are being served.
+func ConfigureProxy(config ProxyConfig) {
+	proxyConfig = config
+	proxyClient = newProxyClient(config)
+}
+
+// newProxyClient builds a pooling client from config. There's no overall client timeout,
+// since X-Proxy-Timeout handles that per request.
+func newProxyClient(config ProxyConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: config.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+	}
+	return &http.Client{Transport: transport}
+}
+
 type proxiedResponse struct {
 	response  *http.Response
 	errorText string
+	// the status to send when errorText is set
+	errorStatus int
+	// releases the upstream request's context once the response is finished
+	cancel context.CancelFunc
+	// closed once the fields above have been filled in by the upstream request. A nil channel
+	// means they were known up front
+	ready chan struct{}
+}
+
+// newProxyError builds a proxiedResponse that reports an error to the client
+func newProxyError(status int, format string, args ...interface{}) *proxiedResponse {
+	return &proxiedResponse{response: &http.Response{}, errorText: fmt.Sprintf(format, args...), errorStatus: status, cancel: func() {}}
+}
+
+// wait blocks until the upstream has responded, or failed to
+func (proxy *proxiedResponse) wait() {
+	if proxy.ready != nil {
+		<-proxy.ready
+	}
 }
 
-// buildHeaderGenerator uses the cached response to generate a ResponseHandler
-// function that can be used in the response pipeline
-func (proxy proxiedResponse) buildProxyHeaderGenerator() ResponseHandler {
+// fail reports err from the upstream request to the client
+func (proxy *proxiedResponse) fail(failed *proxiedResponse) {
+	proxy.response, proxy.errorText, proxy.errorStatus = failed.response, failed.errorText, failed.errorStatus
+}
+
+// upstreamStatus returns the status the upstream sent, or the error status if there wasn't a response
+func (proxy *proxiedResponse) upstreamStatus() int {
+	if proxy.errorText != "" {
+		return proxy.errorStatus
+	}
+	return proxy.response.StatusCode
+}
+
+// buildHeaderGenerator uses the upstream response to generate a ResponseHandler
+// function that can be used in the response pipeline. overrides are applied to the upstream
+// headers, and statusOverride (if not nil) can swap out the upstream status. If flush is set,
+// the headers are sent to the client as soon as the upstream's arrive, rather than with the body.
+// rewritesBody means an affector changes the body's length, so the upstream Content-Length can't be sent
+func (proxy *proxiedResponse) buildProxyHeaderGenerator(overrides headerOverrides, statusOverride func(int) int, flush bool, rewritesBody bool) ResponseHandler {
 	return func(response http.ResponseWriter) error {
+		proxy.wait()
+		if recorder, records := response.(upstreamStatusRecorder); records {
+			recorder.recordUpstreamStatus(proxy.upstreamStatus())
+		}
 		if proxy.errorText != "" {
-			response.WriteHeader(http.StatusBadRequest)
+			response.WriteHeader(proxy.errorStatus)
 		} else {
 			for header, values := range proxy.response.Header {
 				response.Header()[header] = values
 			}
-			response.WriteHeader(proxy.response.StatusCode)
+			if rewritesBody {
+				response.Header().Del("Content-Length")
+			}
+			overrides.apply(response.Header())
+
+			status := proxy.response.StatusCode
+			if statusOverride != nil {
+				status = statusOverride(status)
+			}
+			response.WriteHeader(status)
+		}
+
+		if flusher, canFlush := response.(http.Flusher); flush && canFlush {
+			flusher.Flush()
 		}
 		// nothing in this part returns an error
 		return nil
 	}
 }
 
-// getReader returns the Body of the response.
-func (proxy proxiedResponse) getProxyReader() io.Reader {
-	if proxy.errorText == "" {
-		return proxy.response.Body
-	} else {
-		return strings.NewReader(proxy.errorText)
+// getReader returns a reader for the Body of the response. It can be built before the upstream
+// has responded, and waits for it on the first Read
+func (proxy *proxiedResponse) getProxyReader() io.Reader {
+	return &proxyBodyReader{proxy: proxy}
+}
+
+type proxyBodyReader struct {
+	proxy  *proxiedResponse
+	reader io.Reader
+}
+
+func (body *proxyBodyReader) Read(buf []byte) (int, error) {
+	if body.reader == nil {
+		body.proxy.wait()
+		if body.proxy.errorText == "" {
+			body.reader = body.proxy.response.Body
+		} else {
+			body.reader = strings.NewReader(body.proxy.errorText)
+		}
 	}
+	return body.reader.Read(buf)
 }
 
 // this ResponseHandler is put into the pipeline to ensure the response body
 // is closed after all the response affectors come into play
-func (proxy proxiedResponse) buildProxyCloser() ResponseHandler {
+func (proxy *proxiedResponse) buildProxyCloser() ResponseHandler {
 	return func(response http.ResponseWriter) error {
+		// cancelling first means an upstream request that's still going gives up straight away
+		proxy.cancel()
+		proxy.wait()
 		if proxy.errorText == "" {
 			proxy.response.Body.Close()
 		}
@@ -58,30 +203,161 @@ func (proxy proxiedResponse) buildProxyCloser() ResponseHandler {
 
 // buildProxyResponse uses the input request as a template to use for making
 // a request to another service, and then returns a proxiedResponse object that has ResponseHandlers
-// for the various steps in the pipeline
+// for the various steps in the pipeline. The request is sent in the background, so the pipeline
+// can be built (and started) before the upstream responds. It carries the client's context, so
+// the upstream request is cancelled if the client goes away
 func buildProxyResponse(request *http.Request) *proxiedResponse {
+	if requestHasHeader(request, ProxyReplay) {
+		if requestHasHeader(request, ProxyRecord) {
+			return newProxyError(http.StatusBadRequest, "%s and %s can't both be used", ProxyRecord, ProxyReplay)
+		}
+		return buildReplayResponse(request)
+	}
+
 	newHost := getFirstHeaderValue(request, ProxyRequest)
 	url, err := urlFromHostAndUrl(newHost, request.URL)
 	if err != nil {
-		return &proxiedResponse{&http.Response{}, fmt.Sprintf("Could not calculate URL: %v", err)}
+		return newProxyError(http.StatusBadRequest, "Could not calculate URL: %v", err)
+	}
+
+	policy, err := parseForwardingPolicy(request)
+	if err != nil {
+		return newProxyError(http.StatusBadRequest, "%v", err)
+	}
+
+	var recordPath, bodyHash string
+	if requestHasHeader(request, ProxyRecord) {
+		recordPath, bodyHash, err = getInteractionPath(request, ProxyRecord)
+		if err != nil {
+			return newProxyError(http.StatusBadRequest, "%v", err)
+		}
 	}
 
-	newRequest, err := http.NewRequest(request.Method, url.String(), request.Body)
+	faults, err := parseOutboundFaults(request)
 	if err != nil {
-		return &proxiedResponse{&http.Response{}, fmt.Sprintf("%v", err)}
+		return newProxyError(http.StatusBadRequest, "%v", err)
 	}
 
-	for header, values := range request.Header {
-		newRequest.Header[header] = values
+	// the upstream request goes away if the client does
+	ctx, cancel := context.WithCancel(request.Context())
+	if requestHasHeader(request, ProxyTimeout) {
+		timeout, err := stringToDuration(getFirstHeaderValue(request, ProxyTimeout))
+		if err != nil {
+			cancel()
+			return newProxyError(http.StatusBadRequest, "Invalid %s: %v", ProxyTimeout, err)
+		}
+		// the timeout's context is derived from the first, so both need releasing
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		cancelRequest := cancel
+		cancel = func() {
+			cancelTimeout()
+			cancelRequest()
+		}
+	}
+
+	proxy := &proxiedResponse{cancel: cancel, ready: make(chan struct{})}
+	go func() {
+		defer close(proxy.ready)
+
+		newRequest, response, failed := sendUpstream(ctx, request, url, policy, faults)
+		if failed != nil {
+			cancel()
+			proxy.fail(failed)
+			return
+		}
+		if recordPath != "" {
+			recordProxyResponse(recordPath, newRequest, bodyHash, response)
+		}
+		proxy.response = response
+	}()
+	return proxy
+}
+
+// sendUpstream sends request to upstreamURL, with faults applied. It returns the request that was
+// sent and the upstream's response, or the error to report to the client
+func sendUpstream(ctx context.Context, request *http.Request, upstreamURL *url.URL, policy forwardingPolicy, faults outboundFaults) (*http.Request, *http.Response, *proxiedResponse) {
+	if err := faults.wait(ctx); err != nil {
+		return nil, nil, newUpstreamError(err)
+	}
+
+	body := io.Reader(request.Body)
+	if faults.repeat > 0 {
+		// a request that's sent more than once needs its body kept around
+		buffered, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			return nil, nil, newProxyError(http.StatusBadRequest, "Could not read request body: %v", err)
+		}
+		body = bytes.NewReader(buffered)
+
+		// only the response to the last request makes it back to the client
+		for repeat := 0; repeat < faults.repeat; repeat++ {
+			repeated, err := newUpstreamRequest(ctx, request, upstreamURL, policy, faults, bytes.NewReader(buffered))
+			if err != nil {
+				return nil, nil, newProxyError(http.StatusBadRequest, "%v", err)
+			}
+			if response, err := proxyClient.Do(repeated); err == nil {
+				io.Copy(ioutil.Discard, response.Body)
+				response.Body.Close()
+			}
+		}
+	}
+
+	newRequest, err := newUpstreamRequest(ctx, request, upstreamURL, policy, faults, body)
+	if err != nil {
+		return nil, nil, newProxyError(http.StatusBadRequest, "%v", err)
 	}
-	newRequest.ContentLength = request.ContentLength
 
-	client := &http.Client{}
-	response, err := client.Do(newRequest)
+	response, err := proxyClient.Do(newRequest)
 	if err != nil {
-		return &proxiedResponse{&http.Response{}, fmt.Sprintf("%v", err)}
+		return nil, nil, newUpstreamError(err)
+	}
+	return newRequest, response, nil
+}
+
+// newUpstreamRequest builds the request to send upstream for request
+func newUpstreamRequest(ctx context.Context, request *http.Request, upstreamURL *url.URL, policy forwardingPolicy, faults outboundFaults, body io.Reader) (*http.Request, error) {
+	// a body that's known to be empty can't be throttled or truncated, and wrapping it would
+	// make it look like a body of unknown length
+	if request.ContentLength != 0 {
+		body = faults.wrapBody(body)
+	}
+
+	newRequest, err := http.NewRequest(request.Method, upstreamURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	newRequest = newRequest.WithContext(ctx)
+
+	newRequest.Header = policy.forwardedHeaders(request)
+	if requestHasHeader(request, JsonMutate) {
+		// the body has to be decoded to be mutated. Without the client's Accept-Encoding, the transport
+		// asks for gzip itself and decompresses the response before it gets here
+		newRequest.Header.Del("Accept-Encoding")
+	}
+	faults.applyHeaders(newRequest.Header)
+	newRequest.Host = policy.host
+	newRequest.ContentLength = request.ContentLength
+	return newRequest, nil
+}
+
+// newUpstreamError reports a failed upstream request to the client
+func newUpstreamError(err error) *proxiedResponse {
+	if isTimeout(err) {
+		return newProxyError(proxyConfig.TimeoutStatus, "Upstream timed out: %v", err)
+	}
+	return newProxyError(proxyConfig.ErrorStatus, "Upstream request failed: %v", err)
+}
+
+// isTimeout determines if err came from a request timing out
+func isTimeout(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
 	}
-	return &proxiedResponse{response, ""}
+	return err == context.DeadlineExceeded
 }
 
 // urlFromHostAndUrl constructs a new URL by overlaying a parsed URL based on
@@ -1,8 +1,19 @@
 package badness
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type urlFromUrlTest struct {
@@ -47,3 +58,268 @@ func TestUrlFromHostAndUrl(test *testing.T) {
 		compareFunc(testCase.expectRawQuery, newURL.RawQuery, "raw query")
 	}
 }
+
+// runProxyPipeline sends a request through the pipeline with X-Proxy-To-Host pointing at upstream
+func runProxyPipeline(upstream string, headers map[string]string) *http.Response {
+	request := makeTestRequest()
+	request.Header[ProxyRequest] = []string{upstream}
+	for header, value := range headers {
+		request.Header.Set(header, value)
+	}
+	return runPipeline(request)
+}
+
+func TestProxyTimeout(test *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	response := runProxyPipeline(upstream.URL, map[string]string{ProxyTimeout: "20ms"})
+	if response.StatusCode != http.StatusGatewayTimeout {
+		test.Errorf("Expected 504 for a slow upstream but got %d", response.StatusCode)
+	}
+
+	response = runProxyPipeline(upstream.URL, map[string]string{ProxyTimeout: "never"})
+	if response.StatusCode != http.StatusBadRequest {
+		test.Errorf("Expected 400 for a bad timeout but got %d", response.StatusCode)
+	}
+}
+
+func TestProxyUpstreamFailure(test *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	address := upstream.URL
+	upstream.Close()
+
+	response := runProxyPipeline(address, nil)
+	if response.StatusCode != http.StatusBadGateway {
+		test.Errorf("Expected 502 for an unreachable upstream but got %d", response.StatusCode)
+	}
+
+	config := DefaultProxyConfig()
+	config.ErrorStatus = 599
+	ConfigureProxy(config)
+	defer ConfigureProxy(DefaultProxyConfig())
+
+	response = runProxyPipeline(address, nil)
+	if response.StatusCode != 599 {
+		test.Errorf("Expected the configured status for an unreachable upstream but got %d", response.StatusCode)
+	}
+}
+
+func TestProxyConfigValidate(test *testing.T) {
+	if err := DefaultProxyConfig().Validate(); err != nil {
+		test.Errorf("Expected the default config to be valid, got %v", err)
+	}
+	for _, status := range []int{0, 99, 1000, -502} {
+		config := DefaultProxyConfig()
+		config.ErrorStatus = status
+		if config.Validate() == nil {
+			test.Errorf("Expected an error status of %d to be rejected", status)
+		}
+		config = DefaultProxyConfig()
+		config.TimeoutStatus = status
+		if config.Validate() == nil {
+			test.Errorf("Expected a timeout status of %d to be rejected", status)
+		}
+	}
+}
+
+func TestProxyResponseHeaderTimeout(test *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	config := DefaultProxyConfig()
+	config.ResponseHeaderTimeout = 20 * time.Millisecond
+	ConfigureProxy(config)
+	defer ConfigureProxy(DefaultProxyConfig())
+
+	response := runProxyPipeline(upstream.URL, nil)
+	if response.StatusCode != http.StatusGatewayTimeout {
+		test.Errorf("Expected 504 when the upstream is slow to send headers but got %d", response.StatusCode)
+	}
+}
+
+func TestProxyOverrides(test *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "application/json")
+		response.Header().Set("Etag", "abc")
+		response.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	request := makeTestRequest()
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[CodeByHistogram] = []string{"503"}
+	request.Header[ForceHeader] = []string{"Content-Type: text/plain", "-Etag"}
+	response := runPipeline(request)
+
+	if response.StatusCode != http.StatusServiceUnavailable {
+		test.Errorf("Expected the histogram status, got %d", response.StatusCode)
+	}
+	if response.Header.Get("Content-Type") != "text/plain" || response.Header.Get("Etag") != "" {
+		test.Errorf("Expected upstream headers to be overridden, got %v", response.Header)
+	}
+
+	// in hit mode, the upstream status comes through when the histogram misses
+	statuses := make(map[int]bool)
+	for attempt := 0; attempt < 100; attempt++ {
+		request = makeTestRequest()
+		request.Header[ProxyRequest] = []string{upstream.URL}
+		request.Header[CodeByHistogram] = []string{"500=50"}
+		request.Header[ProxyStatusMode] = []string{"hit"}
+		statuses[runPipeline(request).StatusCode] = true
+	}
+	if len(statuses) != 2 || !statuses[http.StatusCreated] || !statuses[http.StatusInternalServerError] {
+		test.Errorf("Expected a mix of 201s and 500s, got %v", statuses)
+	}
+
+	request = makeTestRequest()
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[CodeByHistogram] = []string{"500=50"}
+	if response := runPipeline(request); response.StatusCode != http.StatusBadRequest {
+		test.Errorf("Expected an incomplete histogram to be rejected outside of hit mode, got %d", response.StatusCode)
+	}
+}
+
+func TestProxyStreamsResponse(test *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("X-Upstream", "yes")
+		response.Write([]byte("first\n"))
+		response.(http.Flusher).Flush()
+		<-release
+		response.Write([]byte("second\n"))
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	server := newPipelineServer()
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set(ProxyRequest, upstream.URL)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+	defer response.Body.Close()
+
+	// both of these arrive while the upstream is still holding the rest of its body back
+	if response.Header.Get("X-Upstream") != "yes" {
+		test.Errorf("Expected the upstream headers, got %v", response.Header)
+	}
+	line, err := bufio.NewReader(response.Body).ReadString('\n')
+	if err != nil || line != "first\n" {
+		test.Errorf("Expected the first line before the upstream finished, got %q and %v", line, err)
+	}
+}
+
+func TestProxyCancelledWithClient(test *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-request.Context().Done()
+		close(cancelled)
+	}))
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := makeTestRequest().WithContext(ctx)
+	request.Header[ProxyRequest] = []string{upstream.URL}
+
+	recorder := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		for _, handler := range GetResponsePipeline(request) {
+			handler(recorder)
+		}
+		close(finished)
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		test.Fatalf("Expected the upstream request to be cancelled along with the client's")
+	}
+	<-finished
+	if recorder.Code != http.StatusBadGateway {
+		test.Errorf("Expected a 502 for a cancelled request, got %d", recorder.Code)
+	}
+}
+
+func TestProxyPauseOverlapsUpstream(test *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		response.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+
+	start := time.Now()
+	response := runProxyPipeline(upstream.URL, map[string]string{PauseBeforeStart: "200ms"})
+	taken := time.Since(start)
+	if response.StatusCode != http.StatusOK {
+		test.Errorf("Expected a 200, got %d", response.StatusCode)
+	}
+	// the pause and the upstream run at the same time, rather than one after the other
+	if taken < 200*time.Millisecond || taken > 350*time.Millisecond {
+		test.Errorf("Expected the response to take about 200ms, took %v", taken)
+	}
+}
+
+func TestProxyJsonMutate(test *testing.T) {
+	const document = `{"id": 1, "name": "widget"}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "application/json")
+		if strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") {
+			var compressed bytes.Buffer
+			writer := gzip.NewWriter(&compressed)
+			writer.Write([]byte(document))
+			writer.Close()
+			response.Header().Set("Content-Encoding", "gzip")
+			response.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+			response.Write(compressed.Bytes())
+			return
+		}
+		response.Header().Set("Content-Length", strconv.Itoa(len(document)))
+		response.Write([]byte(document))
+	}))
+	defer upstream.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		for _, handler := range GetResponsePipeline(request) {
+			handler(response)
+		}
+	}))
+	defer server.Close()
+
+	// the client accepting gzip itself means its transport won't decompress the response
+	for _, acceptEncoding := range []string{"", "gzip"} {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		request.Header.Set(ProxyRequest, upstream.URL)
+		request.Header.Set(JsonMutate, "unknown=100")
+		if acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			test.Fatalf("Request failed: %v", err)
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			test.Fatalf("Accept-Encoding %q: could not read the mutated body: %v", acceptEncoding, err)
+		}
+		if encoding := response.Header.Get("Content-Encoding"); encoding != "" {
+			test.Errorf("Accept-Encoding %q: expected a decoded body, got Content-Encoding %s", acceptEncoding, encoding)
+		}
+		if !json.Valid(body) || !strings.Contains(string(body), unknownFieldPrefix) {
+			test.Errorf("Accept-Encoding %q: expected the whole mutated document, got %s", acceptEncoding, body)
+		}
+	}
+}
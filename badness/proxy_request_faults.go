@@ -0,0 +1,154 @@
+package badness
+
+// Outbound request faults. Everything else in bad-server damages the response, but when proxying,
+// the X-Proxy-Request-* headers damage the request that reaches the upstream instead.
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyRequestDelay waits before sending the request upstream
+const ProxyRequestDelay = "X-Proxy-Request-Delay"
+
+// ProxyRequestThrottle caps the bytes per second of the request body sent upstream
+const ProxyRequestThrottle = "X-Proxy-Request-Throttle"
+
+// ProxyRequestDropHeader lists request headers that aren't sent upstream
+const ProxyRequestDropHeader = "X-Proxy-Request-Drop-Header"
+
+// ProxyRequestSetHeader changes request headers sent upstream, in the same format as X-Return-Header
+const ProxyRequestSetHeader = "X-Proxy-Request-Set-Header"
+
+// ProxyRequestRepeat sends the request upstream this many extra times before the one whose response is used
+const ProxyRequestRepeat = "X-Proxy-Request-Repeat"
+
+// ProxyRequestTruncate cuts the request body off after this many bytes
+const ProxyRequestTruncate = "X-Proxy-Request-Truncate"
+
+// errTruncatedUpload is returned from the request body when X-Proxy-Request-Truncate cuts it off
+var errTruncatedUpload = fmt.Errorf("request body truncated by bad-server")
+
+type outboundFaults struct {
+	delay          time.Duration
+	bytesPerSecond int
+	dropHeaders    map[string]bool
+	overrides      headerOverrides
+	repeat         int
+	// the number of body bytes to send before cutting the upload off. -1 sends everything
+	truncateAfter int64
+}
+
+// parseOutboundFaults reads the X-Proxy-Request-* headers in request
+func parseOutboundFaults(request *http.Request) (outboundFaults, error) {
+	faults := outboundFaults{
+		dropHeaders:   parseHeaderNameList(request.Header[ProxyRequestDropHeader]),
+		overrides:     parseHeaderOverrides(request.Header[ProxyRequestSetHeader]),
+		truncateAfter: -1,
+	}
+
+	var err error
+	if requestHasHeader(request, ProxyRequestDelay) {
+		if faults.delay, err = stringToDuration(getFirstHeaderValue(request, ProxyRequestDelay)); err != nil {
+			return faults, fmt.Errorf("Invalid %s: %v", ProxyRequestDelay, err)
+		}
+	}
+	if requestHasHeader(request, ProxyRequestThrottle) {
+		if faults.bytesPerSecond, err = parseNonNegativeInt(getFirstHeaderValue(request, ProxyRequestThrottle)); err != nil {
+			return faults, fmt.Errorf("Invalid %s: %v", ProxyRequestThrottle, err)
+		}
+	}
+	if requestHasHeader(request, ProxyRequestRepeat) {
+		if faults.repeat, err = parseNonNegativeInt(getFirstHeaderValue(request, ProxyRequestRepeat)); err != nil {
+			return faults, fmt.Errorf("Invalid %s: %v", ProxyRequestRepeat, err)
+		}
+	}
+	if requestHasHeader(request, ProxyRequestTruncate) {
+		truncateAfter, err := parseNonNegativeInt(getFirstHeaderValue(request, ProxyRequestTruncate))
+		if err != nil {
+			return faults, fmt.Errorf("Invalid %s: %v", ProxyRequestTruncate, err)
+		}
+		faults.truncateAfter = int64(truncateAfter)
+	}
+	return faults, nil
+}
+
+func parseNonNegativeInt(value string) (int, error) {
+	number, err := strconv.Atoi(strings.TrimSpace(value))
+	if err == nil && number < 0 {
+		err = fmt.Errorf("%d is negative", number)
+	}
+	return number, err
+}
+
+// applyHeaders drops and changes headers that are about to be sent upstream
+func (faults outboundFaults) applyHeaders(header http.Header) {
+	for name := range faults.dropHeaders {
+		header.Del(name)
+	}
+	faults.overrides.apply(header)
+}
+
+// wrapBody throttles and truncates body as requested
+func (faults outboundFaults) wrapBody(body io.Reader) io.Reader {
+	if faults.truncateAfter >= 0 {
+		body = &truncatingReader{body, faults.truncateAfter}
+	}
+	if faults.bytesPerSecond > 0 {
+		body = &throttledReader{body, faults.bytesPerSecond}
+	}
+	return body
+}
+
+// wait sleeps for the delay, unless ctx is done first
+func (faults outboundFaults) wait(ctx context.Context) error {
+	if faults.delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(faults.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// truncatingReader fails once remaining bytes have been read
+type truncatingReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (truncator *truncatingReader) Read(buf []byte) (int, error) {
+	if truncator.remaining <= 0 {
+		return 0, errTruncatedUpload
+	}
+	if int64(len(buf)) > truncator.remaining {
+		buf = buf[0:truncator.remaining]
+	}
+	bytesRead, err := truncator.reader.Read(buf)
+	truncator.remaining -= int64(bytesRead)
+	return bytesRead, err
+}
+
+// throttledReader reads at most bytesPerSecond from reader
+type throttledReader struct {
+	reader         io.Reader
+	bytesPerSecond int
+}
+
+func (throttle *throttledReader) Read(buf []byte) (int, error) {
+	// small enough chunks that the throttled rate is reasonably smooth
+	if chunkSize := throttle.bytesPerSecond/10 + 1; len(buf) > chunkSize {
+		buf = buf[0:chunkSize]
+	}
+	bytesRead, err := throttle.reader.Read(buf)
+	time.Sleep(time.Duration(bytesRead) * time.Second / time.Duration(throttle.bytesPerSecond))
+	return bytesRead, err
+}
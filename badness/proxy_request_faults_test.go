@@ -0,0 +1,87 @@
+package badness
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboundHeaderFaults(test *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received = request.Header
+	}))
+	defer upstream.Close()
+
+	request := makeTestRequest()
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[ProxyRequestDropHeader] = []string{"Authorization"}
+	request.Header[ProxyRequestSetHeader] = []string{"Accept: text/html", "+X-Extra: yes"}
+	request.Header.Set("Authorization", "secret")
+	request.Header.Set("Accept", "application/json")
+	runPipeline(request)
+
+	if received.Get("Authorization") != "" {
+		test.Errorf("Expected Authorization to be dropped, got %v", received)
+	}
+	if received.Get("Accept") != "text/html" || received.Get("X-Extra") != "yes" {
+		test.Errorf("Expected headers to be changed, got %v", received)
+	}
+}
+
+func TestOutboundBodyFaults(test *testing.T) {
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		bodies = append(bodies, string(body))
+		response.Write([]byte("response " + string(body)))
+	}))
+	defer upstream.Close()
+
+	request := httptest.NewRequest("POST", "http://localhost/", strings.NewReader("payload"))
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[ProxyRequestRepeat] = []string{"2"}
+	body, _ := ioutil.ReadAll(runPipeline(request).Body)
+	if len(bodies) != 3 || bodies[0] != "payload" || bodies[2] != "payload" {
+		test.Errorf("Expected the request to be sent three times, got %v", bodies)
+	}
+	if string(body) != "response payload" {
+		test.Errorf("Expected the last response, got %s", body)
+	}
+
+	// this upstream can still be reading the cut-off body after the proxy has given up
+	truncated := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		ioutil.ReadAll(request.Body)
+	}))
+	defer truncated.Close()
+	request = httptest.NewRequest("POST", "http://localhost/", strings.NewReader("payload"))
+	request.Header[ProxyRequest] = []string{truncated.URL}
+	request.Header[ProxyRequestTruncate] = []string{"3"}
+	if response := runPipeline(request); response.StatusCode != http.StatusBadGateway {
+		test.Errorf("Expected a truncated upload to fail, got %d", response.StatusCode)
+	}
+
+	bodies = nil
+	start := time.Now()
+	request = httptest.NewRequest("POST", "http://localhost/", strings.NewReader(strings.Repeat("a", 50)))
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[ProxyRequestDelay] = []string{"50ms"}
+	request.Header[ProxyRequestThrottle] = []string{"500"}
+	runPipeline(request)
+	if elapsed := time.Since(start); elapsed < 130*time.Millisecond {
+		test.Errorf("Expected the delay and throttling to take around 150ms, took %v", elapsed)
+	}
+	if len(bodies) != 1 || len(bodies[0]) != 50 {
+		test.Errorf("Expected the whole throttled body to arrive, got %v", bodies)
+	}
+
+	request = makeTestRequest()
+	request.Header[ProxyRequest] = []string{upstream.URL}
+	request.Header[ProxyRequestRepeat] = []string{"-1"}
+	if response := runPipeline(request); response.StatusCode != http.StatusBadRequest {
+		test.Errorf("Expected a negative repeat to be rejected, got %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,258 @@
+package badness
+
+// Raw responses. net/http's ResponseWriter always produces a well-formed response, fixing up
+// things like Content-Length along the way. X-Raw-Response hijacks the connection instead and
+// writes the status line, headers and body by hand, so they can be as broken as requested.
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const RawResponse = "X-Raw-Response"
+
+type rawResponseSettings struct {
+	invalidStatus   bool
+	http10          bool
+	noColon         bool
+	bareLF          bool
+	obsFold         bool
+	crlfInjection   bool
+	duplicateLength bool
+	longerBody      bool
+	shorterBody     bool
+}
+
+// parseRawResponseSettings reads the comma-separated faults in the X-Raw-Response header
+func parseRawResponseSettings(headerValues []string) (rawResponseSettings, error) {
+	settings := rawResponseSettings{}
+	for fault := range parseHeadersWithKeyValues(headerValues, ",") {
+		switch strings.TrimSpace(fault) {
+		case "":
+			continue
+		case "invalid-status":
+			settings.invalidStatus = true
+		case "http10":
+			settings.http10 = true
+		case "no-colon":
+			settings.noColon = true
+		case "bare-lf":
+			settings.bareLF = true
+		case "obs-fold":
+			settings.obsFold = true
+		case "crlf-injection":
+			settings.crlfInjection = true
+		case "duplicate-length":
+			settings.duplicateLength = true
+		case "longer-body":
+			settings.longerBody = true
+		case "shorter-body":
+			settings.shorterBody = true
+		default:
+			return settings, fmt.Errorf("Unknown %s fault %s", RawResponse, fault)
+		}
+	}
+
+	if settings.longerBody && settings.shorterBody {
+		return settings, fmt.Errorf("longer-body and shorter-body can't both be used")
+	}
+	return settings, nil
+}
+
+// capturingResponseWriter collects the status and headers the rest of the pipeline
+// would have sent, so they can be written out by hand
+type capturingResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newCapturingResponseWriter() *capturingResponseWriter {
+	return &capturingResponseWriter{header: make(http.Header), statusCode: http.StatusOK}
+}
+
+func (writer *capturingResponseWriter) Header() http.Header {
+	return writer.header
+}
+
+func (writer *capturingResponseWriter) Write(buffer []byte) (int, error) {
+	return writer.body.Write(buffer)
+}
+
+func (writer *capturingResponseWriter) WriteHeader(statusCode int) {
+	writer.statusCode = statusCode
+}
+
+// captureStatusAndHeaders runs the header and status code generators for request
+func captureStatusAndHeaders(request *http.Request) *capturingResponseWriter {
+	captured := newCapturingResponseWriter()
+	for _, handler := range getHeaderGenerators(request) {
+		handler(captured)
+	}
+	if requestHasHeader(request, CodeByHistogram) {
+		generateHistogramStatusCode(request)(captured)
+	}
+	return captured
+}
+
+// buildRawHead writes the status line and headers, breaking them as settings asks
+func buildRawHead(settings rawResponseSettings, statusCode int, header http.Header) []byte {
+	var head bytes.Buffer
+
+	lineEnding := "\r\n"
+	if settings.bareLF {
+		lineEnding = "\n"
+	}
+
+	protocol := "HTTP/1.1"
+	if settings.http10 {
+		protocol = "HTTP/1.0"
+	}
+
+	if settings.invalidStatus {
+		// the status code and reason are swapped, and the code isn't three digits
+		fmt.Fprintf(&head, "%s %s %d%s", protocol, http.StatusText(statusCode), statusCode*10, lineEnding)
+	} else {
+		fmt.Fprintf(&head, "%s %d %s%s", protocol, statusCode, http.StatusText(statusCode), lineEnding)
+	}
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(&head, "%s: %s%s", key, value, lineEnding)
+		}
+	}
+
+	if settings.duplicateLength {
+		if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+			fmt.Fprintf(&head, "Content-Length: %d%s", length+1, lineEnding)
+		} else {
+			fmt.Fprintf(&head, "Content-Length: 0%s", lineEnding)
+		}
+	}
+	if settings.noColon {
+		fmt.Fprintf(&head, "X-Missing-Colon missing colon%s", lineEnding)
+	}
+	if settings.obsFold {
+		fmt.Fprintf(&head, "X-Folded: this value%s continues on the next line%s", lineEnding, lineEnding)
+	}
+	if settings.crlfInjection {
+		fmt.Fprintf(&head, "X-Injected: harmless\r\nSet-Cookie: injected=true%s", lineEnding)
+	}
+
+	head.WriteString(lineEnding)
+	return head.Bytes()
+}
+
+// hijackConnection takes over the connection underneath response. The reader holds anything the client
+// sent that the server has already read past the request
+func hijackConnection(response http.ResponseWriter) (net.Conn, *bufio.Reader, error) {
+	hijacker, canHijack := response.(http.Hijacker)
+	if !canHijack {
+		return nil, nil, fmt.Errorf("Connection can't be hijacked")
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// anything already buffered for writing has to go out first
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, buffered.Reader, nil
+}
+
+// the largest body a raw response can have, since the whole body is generated before anything is sent
+const maxRawBodySize = 64 * 1024 * 1024
+
+// generateRawBody generates request's whole body, so its length is known before the headers go out.
+// mode is the header that asked for the raw response. Event streams might never end, so they can't be
+// used, and bodies over maxRawBodySize are an error rather than being held in memory
+func generateRawBody(request *http.Request, mode string) ([]byte, error) {
+	if requestHasHeader(request, EventStream) {
+		return nil, fmt.Errorf("%s can't be used with %s", EventStream, mode)
+	}
+
+	generator := getBodyGenerator(request)
+	// whatever's generating the body stops once nothing's reading it
+	if closer, closes := generator.(io.Closer); closes {
+		defer closer.Close()
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(generator, maxRawBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxRawBodySize {
+		return nil, fmt.Errorf("%s bodies can't be more than %d bytes", mode, maxRawBodySize)
+	}
+	return body, nil
+}
+
+// buildRawResponseHandler returns a ResponseHandler that writes request's response
+// directly to the connection
+func buildRawResponseHandler(request *http.Request) ResponseHandler {
+	settings, err := parseRawResponseSettings(request.Header[RawResponse])
+	if err != nil {
+		return generateBadResponseHandler(err.Error())
+	}
+
+	return func(response http.ResponseWriter) error {
+		captured := captureStatusAndHeaders(request)
+		// the whole body is generated up front since its length has to be known before
+		// the headers go out. Affectors are applied afterwards so delays still happen
+		// while the body is being sent
+		body, err := generateRawBody(request, RawResponse)
+		if err != nil {
+			return generateBadResponseHandler(fmt.Sprintf("Could not generate body: %v", err))(response)
+		}
+
+		// a Content-Length from X-Return-Header is sent as-is, which is the point of raw mode
+		if captured.header.Get("Content-Length") == "" {
+			declaredLength := len(body)
+			if settings.longerBody {
+				if len(body) == 0 {
+					body = []byte("more than expected")
+				}
+				declaredLength = len(body) / 2
+			} else if settings.shorterBody {
+				declaredLength = len(body) + 100
+			}
+			captured.header.Set("Content-Length", strconv.Itoa(declaredLength))
+		}
+		if captured.header.Get("Connection") == "" {
+			captured.header.Set("Connection", "close")
+		}
+
+		affected, err := getResponseAffector(request, bytes.NewReader(body))
+		if err != nil {
+			return generateBadResponseHandler(fmt.Sprintf("Could not get affector: %v", err))(response)
+		}
+
+		conn, _, err := hijackConnection(response)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write(buildRawHead(settings, captured.statusCode, captured.header)); err != nil {
+			return err
+		}
+		_, err = io.Copy(conn, affected)
+		return err
+	}
+}
@@ -0,0 +1,105 @@
+package badness
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// rawRequest sends a GET with the given extra header lines to server and returns everything it sends back
+func rawRequest(test *testing.T, address string, headerLines ...string) string {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		test.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(headerLines, "\r\n") + "\r\n\r\n"
+	conn.Write([]byte(request))
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		test.Fatalf("Could not read response: %v", err)
+	}
+	return string(response)
+}
+
+func TestParseRawResponseSettings(test *testing.T) {
+	settings, err := parseRawResponseSettings([]string{"http10,bare-lf", "longer-body"})
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+	if !settings.http10 || !settings.bareLF || !settings.longerBody || settings.obsFold {
+		test.Errorf("Unexpected settings %v", settings)
+	}
+
+	for _, bad := range []string{"sideways", "longer-body,shorter-body"} {
+		if _, err := parseRawResponseSettings([]string{bad}); err == nil {
+			test.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
+
+type rawResponseExpect struct {
+	headerLines []string
+	contains    []string
+}
+
+func TestRawResponses(test *testing.T) {
+	server := newPipelineServer()
+	defer server.Close()
+
+	expectations := []rawResponseExpect{
+		rawResponseExpect{[]string{RawResponse + ": http10", CodeByHistogram + ": 503"}, []string{"HTTP/1.0 503 Service Unavailable\r\n"}},
+		rawResponseExpect{[]string{RawResponse + ": invalid-status"}, []string{"HTTP/1.1 OK 2000\r\n"}},
+		rawResponseExpect{[]string{RawResponse + ": bare-lf"}, []string{"HTTP/1.1 200 OK\nConnection: close\nContent-Length: 0\n\n"}},
+		rawResponseExpect{[]string{RawResponse + ": no-colon,obs-fold"}, []string{"X-Missing-Colon missing colon\r\n", "X-Folded: this value\r\n continues"}},
+		rawResponseExpect{[]string{RawResponse + ": crlf-injection"}, []string{"\r\nSet-Cookie: injected=true\r\n"}},
+		rawResponseExpect{[]string{RawResponse + ": duplicate-length", GenerateRandomResponse + ": 10"}, []string{"Content-Length: 10\r\n", "Content-Length: 11\r\n"}},
+		rawResponseExpect{[]string{RawResponse + ": longer-body", GenerateRandomResponse + ": 10"}, []string{"Content-Length: 5\r\n"}},
+		rawResponseExpect{[]string{RawResponse + ": shorter-body", GenerateRandomResponse + ": 10"}, []string{"Content-Length: 110\r\n"}},
+		// the README's Content-Length examples only work in raw mode
+		rawResponseExpect{[]string{RawResponse + ":", ForceHeader + ": Content-Length: 6000", RequestBodyIsResponse + ": true"}, []string{"Content-Length: 6000\r\n"}},
+	}
+
+	for index, expect := range expectations {
+		response := rawRequest(test, server.Listener.Addr().String(), expect.headerLines...)
+		for _, expected := range expect.contains {
+			if !strings.Contains(response, expected) {
+				test.Errorf("Test %d: Expected %q in %q", index, expected, response)
+			}
+		}
+	}
+}
+
+func TestRawResponseBody(test *testing.T) {
+	server := newPipelineServer()
+	defer server.Close()
+
+	response := rawRequest(test, server.Listener.Addr().String(), RawResponse+": longer-body", RandomJson+": response_template=[int|1]:3")
+	if !strings.HasSuffix(response, "Content-Length: 3\r\n\r\n[1,1,1]") {
+		test.Errorf("Expected the whole body after a short Content-Length, got %q", response)
+	}
+}
+
+func TestRawResponseBodyLimits(test *testing.T) {
+	requests := []map[string]string{
+		{RawResponse: "", GenerateRandomResponse: strconv.Itoa(maxRawBodySize + 1)},
+		{ChunkedFaults: "", GenerateRandomResponse: strconv.Itoa(maxRawBodySize + 1)},
+		{RawResponse: "", EventStream: "events=0"},
+		{ChunkedFaults: "", EventStream: "events=2"},
+	}
+	for _, headers := range requests {
+		request := httptest.NewRequest("GET", "/", nil)
+		for header, value := range headers {
+			request.Header.Set(header, value)
+		}
+		if response := runPipeline(request); response.StatusCode != http.StatusBadRequest {
+			test.Errorf("%v: Expected a 400, got %d", headers, response.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package badness
+
+// Redirect responses. X-Redirect makes bad-server answer with a chain of 3xx responses
+// (or an endless loop of them) before finally falling through to whatever the rest of
+// the headers ask for. Since most clients don't resend custom headers when following
+// a redirect, the badness headers are packed into the query string of each generated
+// Location and unpacked again when the next hop arrives.
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const Redirect = "X-Redirect"
+
+// redirectStateParameter is the query parameter used to carry headers across hops
+const redirectStateParameter = "bad_server_state"
+
+// redirectStateKey signs the state carried across hops, so that a URL can only carry headers that
+// bad-server put there itself. It changes every time bad-server starts, which breaks any chain that
+// was in progress
+var redirectStateKey = newRedirectStateKey()
+
+func newRedirectStateKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("Could not generate a redirect state key: %v", err))
+	}
+	return key
+}
+
+// a Location that no client should be able to parse
+const malformedLocation = "http://[::1%zz/%%bad path"
+
+const (
+	relativeLocation        = "relative"
+	absoluteLocation        = "absolute"
+	missingLocation         = "missing"
+	malformedLocationOption = "malformed"
+)
+
+type redirectSettings struct {
+	// how many more redirects to send before falling through to the final behavior
+	hops int
+	// if true, always redirect back to the same place
+	loop     bool
+	code     int
+	location string
+	// overrides for absolute locations, to allow cross-scheme and cross-host redirects
+	scheme string
+	host   string
+	// the method a 307/308 redirect expects the client to preserve
+	method string
+}
+
+// parseRedirectSettings reads the X-Redirect header. Values are comma-separated key=value pairs:
+//
+//	hops=3,code=307,location=absolute,scheme=https,host=other:8080
+//	loop
+func parseRedirectSettings(headerValues []string) (redirectSettings, error) {
+	settings := redirectSettings{hops: 1, code: http.StatusFound, location: relativeLocation}
+
+	for key, value := range parseHeadersWithKeyValues(headerValues, ",") {
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch key {
+		case "":
+			continue
+		case "hops":
+			hops, err := strconv.Atoi(value)
+			if err != nil || hops < 0 {
+				return settings, fmt.Errorf("hops must be a non-negative integer, got %s", value)
+			}
+			settings.hops = hops
+		case "loop":
+			settings.loop = true
+		case "code":
+			code, err := strconv.Atoi(value)
+			if err != nil || code < 300 || code > 399 {
+				return settings, fmt.Errorf("code must be a 3xx status, got %s", value)
+			}
+			settings.code = code
+		case "location":
+			switch value {
+			case relativeLocation, absoluteLocation, missingLocation, malformedLocationOption:
+				settings.location = value
+			default:
+				return settings, fmt.Errorf("Unknown location type %s", value)
+			}
+		case "scheme":
+			settings.scheme = value
+		case "host":
+			settings.host = value
+		case "method":
+			settings.method = value
+		default:
+			return settings, fmt.Errorf("Unknown %s option %s", Redirect, key)
+		}
+	}
+	return settings, nil
+}
+
+// String converts the settings back into an X-Redirect header value
+func (settings redirectSettings) String() string {
+	fields := []string{
+		fmt.Sprintf("hops=%d", settings.hops),
+		fmt.Sprintf("code=%d", settings.code),
+		fmt.Sprintf("location=%s", settings.location),
+	}
+	if settings.loop {
+		fields = append(fields, "loop")
+	}
+	if settings.scheme != "" {
+		fields = append(fields, fmt.Sprintf("scheme=%s", settings.scheme))
+	}
+	if settings.host != "" {
+		fields = append(fields, fmt.Sprintf("host=%s", settings.host))
+	}
+	if settings.method != "" {
+		fields = append(fields, fmt.Sprintf("method=%s", settings.method))
+	}
+	return strings.Join(fields, ",")
+}
+
+// nextHop returns the settings that should be carried to the next request
+func (settings redirectSettings) nextHop(request *http.Request) redirectSettings {
+	next := settings
+	if !settings.loop {
+		next.hops--
+	}
+
+	// only 307 and 308 require the client to keep the original method
+	if settings.code == http.StatusTemporaryRedirect || settings.code == http.StatusPermanentRedirect {
+		next.method = request.Method
+	} else {
+		next.method = ""
+	}
+	return next
+}
+
+// buildRedirectHandler returns a ResponseHandler for the redirect described by the
+// request's X-Redirect header. The boolean is false if the chain has already finished
+// and the request should be handled normally.
+func buildRedirectHandler(request *http.Request) (ResponseHandler, bool) {
+	settings, err := parseRedirectSettings(request.Header[Redirect])
+	if err != nil {
+		return generateBadResponseHandler(fmt.Sprintf("Could not parse %s: %v", Redirect, err)), true
+	}
+
+	if settings.method != "" && settings.method != request.Method {
+		return generateBadResponseHandler(fmt.Sprintf("Redirect should have preserved method %s but got %s", settings.method, request.Method)), true
+	}
+
+	if settings.hops <= 0 && !settings.loop {
+		return nil, false
+	}
+
+	location := buildRedirectLocation(request, settings)
+
+	return func(response http.ResponseWriter) error {
+		if location != "" {
+			response.Header().Set("Location", location)
+		}
+		response.WriteHeader(settings.code)
+		return nil
+	}, true
+}
+
+// buildRedirectLocation figures out the Location header for settings. It returns
+// an empty string if the Location should be left out.
+func buildRedirectLocation(request *http.Request, settings redirectSettings) string {
+	switch settings.location {
+	case missingLocation:
+		return ""
+	case malformedLocationOption:
+		return malformedLocation
+	}
+
+	query := request.URL.Query()
+	query.Set(redirectStateParameter, encodeRedirectState(request, settings.nextHop(request)))
+	nextURL := url.URL{Path: request.URL.Path, RawQuery: query.Encode()}
+	if nextURL.Path == "" {
+		nextURL.Path = "/"
+	}
+
+	if settings.location == absoluteLocation {
+		nextURL.Scheme = "http"
+		if request.TLS != nil {
+			nextURL.Scheme = "https"
+		}
+		if settings.scheme != "" {
+			nextURL.Scheme = settings.scheme
+		}
+
+		nextURL.Host = request.Host
+		if settings.host != "" {
+			nextURL.Host = settings.host
+		}
+	}
+	return nextURL.String()
+}
+
+// encodeRedirectState packs the request's control headers, along with the redirect
+// settings for the next hop, into a string that is safe to use in a query string
+func encodeRedirectState(request *http.Request, next redirectSettings) string {
+	state := url.Values{}
+	for _, header := range controlHeaders {
+		if values, found := request.Header[header]; found {
+			state[header] = values
+		}
+	}
+	state.Set(Redirect, next.String())
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(state.Encode()))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signRedirectState(encoded))
+}
+
+// signRedirectState returns the signature for an encoded state
+func signRedirectState(encodedState string) []byte {
+	mac := hmac.New(sha256.New, redirectStateKey)
+	mac.Write([]byte(encodedState))
+	return mac.Sum(nil)
+}
+
+// applyRedirectState unpacks any headers carried by a previous redirect into request.
+// Carried headers replace what the client sent, since they reflect how far along the
+// chain the client is. The state parameter is removed from the request's URL afterwards.
+// State that bad-server didn't sign is an error, and only control headers are restored
+// from it, so a crafted URL can't make bad-server proxy somewhere
+func applyRedirectState(request *http.Request) error {
+	query := request.URL.Query()
+	signedState := query.Get(redirectStateParameter)
+	if signedState == "" {
+		return nil
+	}
+
+	parts := strings.Split(signedState, ".")
+	if len(parts) != 2 {
+		return fmt.Errorf("%s isn't signed", redirectStateParameter)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, signRedirectState(parts[0])) {
+		return fmt.Errorf("%s wasn't written by this bad-server", redirectStateParameter)
+	}
+
+	decodedState, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+
+	state, err := url.ParseQuery(string(decodedState))
+	if err != nil {
+		return err
+	}
+
+	for _, header := range controlHeaders {
+		if values, found := state[header]; found {
+			request.Header[header] = values
+		}
+	}
+
+	query.Del(redirectStateParameter)
+	request.URL.RawQuery = query.Encode()
+	return nil
+}
@@ -0,0 +1,169 @@
+package badness
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type redirectSettingsExpect struct {
+	headerValue   string
+	hops          int
+	loop          bool
+	code          int
+	location      string
+	errorExpected bool
+}
+
+func TestParseRedirectSettings(test *testing.T) {
+	expectations := []redirectSettingsExpect{
+		redirectSettingsExpect{"", 1, false, 302, relativeLocation, false},
+		redirectSettingsExpect{"hops=3", 3, false, 302, relativeLocation, false},
+		redirectSettingsExpect{"loop,code=307", 1, true, 307, relativeLocation, false},
+		redirectSettingsExpect{"hops=2,location=absolute,code=308", 2, false, 308, absoluteLocation, false},
+		redirectSettingsExpect{"location=missing", 1, false, 302, missingLocation, false},
+		redirectSettingsExpect{"hops=x", 0, false, 0, "", true},
+		redirectSettingsExpect{"code=200", 0, false, 0, "", true},
+		redirectSettingsExpect{"location=sideways", 0, false, 0, "", true},
+		redirectSettingsExpect{"bogus=1", 0, false, 0, "", true},
+	}
+
+	for index, expect := range expectations {
+		settings, err := parseRedirectSettings([]string{expect.headerValue})
+		if err != nil && !expect.errorExpected {
+			test.Fatalf("Test %d: Unexpected error: %v", index, err)
+		}
+		if err == nil && expect.errorExpected {
+			test.Fatalf("Test %d: Expected error for %s but didn't get one", index, expect.headerValue)
+		}
+		if err != nil {
+			continue
+		}
+
+		if settings.hops != expect.hops || settings.loop != expect.loop || settings.code != expect.code || settings.location != expect.location {
+			test.Errorf("Test %d: Expected %v/%v/%v/%v but got %v", index, expect.hops, expect.loop, expect.code, expect.location, settings)
+		}
+	}
+}
+
+// runPipeline sends request through the full response pipeline
+func runPipeline(request *http.Request) *http.Response {
+	recorder := httptest.NewRecorder()
+	for _, handler := range GetResponsePipeline(request) {
+		handler(recorder)
+	}
+	return recorder.Result()
+}
+
+func TestRedirectChain(test *testing.T) {
+	request := httptest.NewRequest("GET", "http://localhost/start?keep=1", nil)
+	request.Header[Redirect] = []string{"hops=2"}
+	request.Header[CodeByHistogram] = []string{"418"}
+
+	for hop := 0; hop < 2; hop++ {
+		response := runPipeline(request)
+		if response.StatusCode != http.StatusFound {
+			test.Fatalf("Hop %d: Expected 302 but got %d", hop, response.StatusCode)
+		}
+
+		location := response.Header.Get("Location")
+		if !strings.HasPrefix(location, "/start?") || !strings.Contains(location, "keep=1") {
+			test.Fatalf("Hop %d: Unexpected location %s", hop, location)
+		}
+
+		// follow the redirect without resending any headers
+		request = httptest.NewRequest("GET", "http://localhost"+location, nil)
+	}
+
+	response := runPipeline(request)
+	if response.StatusCode != 418 {
+		test.Fatalf("Expected the final hop to use the carried histogram, got %d", response.StatusCode)
+	}
+
+	if request.URL.Query().Get(redirectStateParameter) != "" {
+		test.Errorf("State parameter should have been removed from %v", request.URL)
+	}
+}
+
+func TestRedirectLoop(test *testing.T) {
+	request := httptest.NewRequest("GET", "http://localhost/loop", nil)
+	request.Header[Redirect] = []string{"loop,location=absolute,scheme=https"}
+
+	for hop := 0; hop < 5; hop++ {
+		response := runPipeline(request)
+		location := response.Header.Get("Location")
+		if response.StatusCode != http.StatusFound || !strings.HasPrefix(location, "https://localhost/loop?") {
+			test.Fatalf("Hop %d: Expected a redirect to https://localhost/loop but got %d %s", hop, response.StatusCode, location)
+		}
+		request = httptest.NewRequest("GET", location, nil)
+	}
+}
+
+func TestRedirectLocationTypes(test *testing.T) {
+	request := httptest.NewRequest("GET", "http://localhost/", nil)
+	request.Header[Redirect] = []string{"location=missing"}
+	if location := runPipeline(request).Header.Get("Location"); location != "" {
+		test.Errorf("Expected no Location but got %s", location)
+	}
+
+	request = httptest.NewRequest("GET", "http://localhost/", nil)
+	request.Header[Redirect] = []string{"location=malformed"}
+	if location := runPipeline(request).Header.Get("Location"); location != malformedLocation {
+		test.Errorf("Expected %s but got %s", malformedLocation, location)
+	}
+}
+
+func TestRedirectPreservesMethod(test *testing.T) {
+	request := httptest.NewRequest("POST", "http://localhost/submit", strings.NewReader("body"))
+	request.Header[Redirect] = []string{"code=307"}
+
+	response := runPipeline(request)
+	if response.StatusCode != http.StatusTemporaryRedirect {
+		test.Fatalf("Expected 307 but got %d", response.StatusCode)
+	}
+	location := response.Header.Get("Location")
+
+	// a client that switches to GET should be told about it
+	followUp := httptest.NewRequest("GET", "http://localhost"+location, nil)
+	if response := runPipeline(followUp); response.StatusCode != http.StatusBadRequest {
+		test.Errorf("Expected 400 for a changed method but got %d", response.StatusCode)
+	}
+
+	followUp = httptest.NewRequest("POST", "http://localhost"+location, strings.NewReader("body"))
+	if response := runPipeline(followUp); response.StatusCode != http.StatusOK {
+		test.Errorf("Expected 200 for a preserved method but got %d", response.StatusCode)
+	}
+}
+
+func TestRedirectStateCantBeForged(test *testing.T) {
+	contacted := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		contacted = true
+	}))
+	defer upstream.Close()
+
+	injected := url.Values{ProxyRequest: []string{upstream.URL}}
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(injected.Encode()))
+	signature := base64.RawURLEncoding.EncodeToString(signRedirectState("something else"))
+	for _, state := range []string{encoded, encoded + "." + signature} {
+		request := httptest.NewRequest("GET", "http://localhost/?"+redirectStateParameter+"="+state, nil)
+		if response := runPipeline(request); response.StatusCode != http.StatusBadRequest {
+			test.Errorf("Expected unsigned state to be rejected, got %d", response.StatusCode)
+		}
+	}
+	if contacted {
+		test.Errorf("Expected the injected %s to be ignored", ProxyRequest)
+	}
+
+	// even signed state only carries control headers
+	carried := url.Values{CodeByHistogram: []string{"418"}, "Authorization": []string{"Bearer token"}}
+	encoded = base64.RawURLEncoding.EncodeToString([]byte(carried.Encode()))
+	state := encoded + "." + base64.RawURLEncoding.EncodeToString(signRedirectState(encoded))
+	request := httptest.NewRequest("GET", "http://localhost/?"+redirectStateParameter+"="+state, nil)
+	if response := runPipeline(request); response.StatusCode != 418 || request.Header.Get("Authorization") != "" {
+		test.Errorf("Expected only the histogram to be restored, got %d %v", response.StatusCode, request.Header)
+	}
+}
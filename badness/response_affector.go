@@ -20,15 +20,18 @@ const PauseBeforeStart = "X-Pause-Before-Response-Start"
 // code that affects how body generators are affected before
 // being sent in a response.
 
+// the wait is measured from when the affector is built, so time spent waiting on a proxied
+// upstream counts towards it
 type initialLatency struct {
 	reader      io.Reader
 	initialWait time.Duration
 	hasSlept    bool
+	start       time.Time
 }
 
 func (affector *initialLatency) Read(buffer []byte) (int, error) {
 	if !affector.hasSlept {
-		time.Sleep(affector.initialWait)
+		time.Sleep(affector.initialWait - time.Since(affector.start))
 		affector.hasSlept = true
 	}
 
@@ -42,21 +45,21 @@ func (affector *initialLatency) Read(buffer []byte) (int, error) {
 func getInitialLatencyAffector(request *http.Request, reader io.Reader) (io.Reader, error) {
 	waitString := getFirstHeaderValue(request, PauseBeforeStart)
 	if waitString == "" {
-		return &initialLatency{nil, time.Duration(0) * time.Nanosecond, false}, errors.New(fmt.Sprintf("No value defined for %s header. Pass an integer or a duration string", PauseBeforeStart))
+		return &initialLatency{nil, time.Duration(0) * time.Nanosecond, false, time.Now()}, errors.New(fmt.Sprintf("No value defined for %s header. Pass an integer or a duration string", PauseBeforeStart))
 	}
 
 	// if field is an integer, use that
 	millis, err := strconv.Atoi(waitString)
 	if err == nil {
-		return &initialLatency{reader, time.Duration(millis) * time.Millisecond, false}, nil
+		return &initialLatency{reader, time.Duration(millis) * time.Millisecond, false, time.Now()}, nil
 	}
 
 	// field was not an int. try and parse as duration
 	duration, err := time.ParseDuration(waitString)
 	if err == nil {
-		return &initialLatency{reader, duration, false}, nil
+		return &initialLatency{reader, duration, false, time.Now()}, nil
 	} else {
-		return &initialLatency{nil, time.Duration(0) * time.Nanosecond, false}, err
+		return &initialLatency{nil, time.Duration(0) * time.Nanosecond, false, time.Now()}, err
 	}
 }
 
@@ -73,15 +76,18 @@ type noiseAffector struct {
 func (affector noiseAffector) Read(buffer []byte) (int, error) {
 	// first populate the buffer. per docs, process bytes first
 	bytesRead, err := affector.reader.Read(buffer)
+	addNoise(buffer[0:bytesRead], affector.noiseFrequency)
+	return bytesRead, err
+}
 
-	for index, _ := range buffer[0:bytesRead] {
+// addNoise replaces each byte in buffer with a random one, with a probability of noiseFrequency
+func addNoise(buffer []byte, noiseFrequency float64) {
+	for index, _ := range buffer {
 		randomFloat := rand.Float64()
-		if randomFloat < affector.noiseFrequency {
+		if randomFloat < noiseFrequency {
 			buffer[index] = byte(rand.Intn(256))
 		}
 	}
-
-	return bytesRead, err
 }
 
 // getNoiseAffector returns a noiseAffector using the percentage value in
@@ -141,9 +147,8 @@ func (affector randomLagginessAffector) Read(buf []byte) (int, error) {
 		tempBuf = make([]byte, len(buf))
 	}
 
-	randomizer := affector.randomizerFromHistogram(rand.Float64())
 	bytesRead, err := affector.reader.Read(tempBuf)
-	time.Sleep(randomDurationBetween(randomizer.from, randomizer.upTo))
+	time.Sleep(affector.nextDelay())
 	// put into the read buffer
 	for index, curByte := range tempBuf {
 		buf[index] = curByte
@@ -151,6 +156,12 @@ func (affector randomLagginessAffector) Read(buf []byte) (int, error) {
 	return bytesRead, err
 }
 
+// nextDelay picks a random delay using the affector's histogram
+func (affector randomLagginessAffector) nextDelay() time.Duration {
+	randomizer := affector.randomizerFromHistogram(rand.Float64())
+	return randomDurationBetween(randomizer.from, randomizer.upTo)
+}
+
 // randomizerFromHistogram will use the passed-in random number to find
 // a lagginessRandomizer that meets the criteria
 func (affector randomLagginessAffector) randomizerFromHistogram(random float64) lagginessRandomizer {
@@ -171,6 +182,9 @@ func (affector randomLagginessAffector) randomizerFromHistogram(random float64)
 // durations can be passed in either order
 func randomDurationBetween(from, upTo time.Duration) time.Duration {
 	diff := int(math.Abs(float64(upTo.Nanoseconds() - from.Nanoseconds())))
+	if diff == 0 {
+		return from
+	}
 	random := rand.Intn(diff)
 	if upTo.Nanoseconds() > from.Nanoseconds() {
 		return time.Duration(int(from.Nanoseconds())+random) * time.Nanosecond
@@ -180,7 +194,13 @@ func randomDurationBetween(from, upTo time.Duration) time.Duration {
 }
 
 func getRandomLagginessAffector(request *http.Request, reader io.Reader) (io.Reader, error) {
-	keyValuePairs := parseHeadersWithKeyValues(request.Header[RandomLaggyResponse], ",")
+	return randomLagginessAffector{reader, buildLagginessHistogram(request.Header[RandomLaggyResponse])}, nil
+}
+
+// buildLagginessHistogram parses X-Random-Delays style header values into a sorted
+// histogram of lagginessRandomizers
+func buildLagginessHistogram(headerValues []string) []lagginessRandomizer {
+	keyValuePairs := parseHeadersWithKeyValues(headerValues, ",")
 	histogram := make([]lagginessRandomizer, 0)
 	// for entries without a probability. these will be emended later
 	zeroProbs := make([]lagginessRandomizer, 0)
@@ -212,7 +232,7 @@ func getRandomLagginessAffector(request *http.Request, reader io.Reader) (io.Rea
 
 	// sort for testing predictability
 	sort.Sort(randomizerSet(histogram))
-	return randomLagginessAffector{reader, histogram}, nil
+	return histogram
 }
 
 func lagginessRandomizerFromKeyValue(key, value string) lagginessRandomizer {
@@ -3,6 +3,7 @@ package badness
 import (
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"sort"
@@ -29,17 +30,106 @@ func generateHistogramStatusCode(request *http.Request) ResponseHandler {
 	}
 
 	return func(response http.ResponseWriter) error {
-		buckets := statusCodeHistogramToHistogramBuckets(histogramItems)
-		random := rand.Float64()
-		bucket := bucketForProbability(random, buckets)
-		if bucket == bucketNotFound {
-			log.Printf("Could not find any bucket for %f. Do the probabilities add up to 1?", random)
-			response.WriteHeader(http.StatusBadRequest)
+		response.WriteHeader(pickStatusCode(histogramItems))
+		return nil
+	}
+}
+
+// pickStatusCode randomly chooses a status code from histogramItems. If none can be found,
+// http.StatusBadRequest is returned
+func pickStatusCode(histogramItems []statusCodeHistogramEntry) int {
+	buckets := statusCodeHistogramToHistogramBuckets(histogramItems)
+	random := rand.Float64()
+	bucket := bucketForProbability(random, buckets)
+	if bucket == bucketNotFound {
+		log.Printf("Could not find any bucket for %f. Do the probabilities add up to 1?", random)
+		return http.StatusBadRequest
+	}
+	return histogramItems[bucket].statusCode
+}
+
+// ProxyStatusMode controls how X-Response-Code-Histogram applies to proxied responses
+const ProxyStatusMode = "X-Proxy-Status-Mode"
+
+const (
+	// the histogram always decides the status
+	alwaysStatusMode = "always"
+	// the histogram only decides the status some of the time. Whatever probability
+	// isn't accounted for keeps the upstream status
+	hitStatusMode = "hit"
+)
+
+// upstreamStatusCode stands in for the upstream's status in a hit mode histogram
+const upstreamStatusCode = 0
+
+// buildProxyStatusOverride returns a function that takes the upstream status code and
+// returns the one to send to the client, based on the request's histogram
+func buildProxyStatusOverride(request *http.Request) (func(int) int, error) {
+	var histogramItems []statusCodeHistogramEntry
+	mode := getFirstHeaderValue(request, ProxyStatusMode)
+	switch mode {
+	case "", alwaysStatusMode:
+		histogramItems = buildHistogram(request.Header[CodeByHistogram])
+		if len(histogramItems) == 0 {
+			return nil, fmt.Errorf("Invalid histogram %v", request.Header[CodeByHistogram])
+		}
+	case hitStatusMode:
+		var err error
+		histogramItems, err = buildHitHistogram(request.Header[CodeByHistogram])
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown %s %s", ProxyStatusMode, mode)
+	}
+
+	return func(upstreamStatus int) int {
+		status := pickStatusCode(histogramItems)
+		if status == upstreamStatusCode {
+			return upstreamStatus
+		}
+		return status
+	}, nil
+}
+
+// buildHitHistogram builds the histogram for hit mode, where the upstream status gets whatever
+// probability the entries in headerValues leave over. Entries without a probability split the
+// leftover between them first, as they do in buildHistogram
+func buildHitHistogram(headerValues []string) ([]statusCodeHistogramEntry, error) {
+	histogram := make([]statusCodeHistogramEntry, 0)
+	unset := make([]statusCodeHistogramEntry, 0)
+	var totalProbability float64
+
+	for headerKey, headerValue := range parseHeadersWithKeyValues(headerValues, ",") {
+		histogramValue := fmt.Sprintf("%s=%s", headerKey, headerValue)
+		entry, err := parseHistogramHeader(histogramValue)
+		if err != nil || entry.probability < 0 {
+			return nil, fmt.Errorf("Invalid histogram value %s", histogramValue)
+		}
+		if entry.probability == 0 {
+			unset = append(unset, entry)
 		} else {
-			response.WriteHeader(histogramItems[bucket].statusCode)
+			histogram = append(histogram, entry)
+			totalProbability += entry.probability
 		}
-		return nil
 	}
+
+	// a little slack for rounding, e.g. 33.3 three times
+	if len(histogram)+len(unset) == 0 || totalProbability > 1.0001 {
+		return nil, fmt.Errorf("Invalid histogram %v", headerValues)
+	}
+	leftover := math.Max(0, 1-totalProbability)
+	if len(unset) > 0 {
+		for _, entry := range unset {
+			entry.probability = leftover / float64(len(unset))
+			histogram = append(histogram, entry)
+		}
+	} else if leftover > 0 {
+		histogram = append(histogram, statusCodeHistogramEntry{upstreamStatusCode, histogramBucket{leftover}})
+	}
+
+	sort.Sort(statusCodeHistogram(histogram))
+	return histogram, nil
 }
 
 // buildHistogram uses headerValues to build up a histogram
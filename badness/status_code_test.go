@@ -3,6 +3,7 @@ package badness
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"testing"
 )
 
@@ -84,3 +85,42 @@ func TestHistogramGeneration(test *testing.T) {
 	}
 
 }
+
+func TestHitModeRate(test *testing.T) {
+	request := makeTestRequest()
+	request.Header[CodeByHistogram] = []string{"500=5"}
+	request.Header[ProxyStatusMode] = []string{hitStatusMode}
+	override, err := buildProxyStatusOverride(request)
+	if err != nil {
+		test.Fatalf("Could not build status override: %v", err)
+	}
+
+	failures := 0
+	for attempt := 0; attempt < 4000; attempt++ {
+		switch status := override(http.StatusCreated); status {
+		case http.StatusInternalServerError:
+			failures++
+		case http.StatusCreated:
+		default:
+			test.Fatalf("Expected a 500 or the upstream status, got %d", status)
+		}
+	}
+	// 5% of 4000 is 200
+	if failures < 140 || failures > 260 {
+		test.Errorf("Expected about 200 500s, got %d", failures)
+	}
+
+	// statuses without a probability split the leftover, so the upstream status never comes through
+	request.Header[CodeByHistogram] = []string{"500=60,503"}
+	override, err = buildProxyStatusOverride(request)
+	if err != nil || override(http.StatusCreated) == http.StatusCreated {
+		test.Errorf("Expected 500=60,503 to always replace the upstream status, got %v", err)
+	}
+
+	for _, histogram := range []string{"500=60,503=50", "500=-5", "abc=5", ""} {
+		request.Header[CodeByHistogram] = []string{histogram}
+		if _, err := buildProxyStatusOverride(request); err == nil {
+			test.Errorf("Expected %q to be rejected in hit mode", histogram)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package badness
+
+// TCP proxies. Not everything speaks HTTP, so a TCP proxy listens on its own port and forwards
+// connections to a target address, applying X-Connection-Faults to the raw bytes. Faults can be
+// changed while the proxy is running, and apply to connections that are already open.
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TCPProxy forwards connections from a listening address to a target
+type TCPProxy struct {
+	Name          string
+	ListenAddress string
+	Target        string
+
+	listener net.Listener
+
+	// guards everything below
+	mutex    sync.RWMutex
+	faults   []string
+	settings connectionFaultSettings
+	// each client connection, along with its connection to the target
+	connections map[net.Conn]net.Conn
+}
+
+// TCPProxyStatus describes a running TCPProxy
+type TCPProxyStatus struct {
+	Name              string   `json:"name"`
+	ListenAddress     string   `json:"listenAddress"`
+	Target            string   `json:"target"`
+	Faults            []string `json:"faults"`
+	ActiveConnections int      `json:"activeConnections"`
+}
+
+var tcpProxies = make(map[string]*TCPProxy)
+var tcpProxiesMutex sync.Mutex
+
+// StartTCPProxy starts a proxy from listenAddress to target, with faults in the X-Connection-Faults format.
+// name is used to look it up later, and has to be unique
+func StartTCPProxy(name, listenAddress, target string, faults []string) (*TCPProxy, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("Invalid TCP proxy name %q", name)
+	}
+	if target == "" {
+		return nil, fmt.Errorf("TCP proxy %s needs a target", name)
+	}
+	settings, err := parseConnectionFaultSettings(faults)
+	if err != nil {
+		return nil, err
+	}
+
+	tcpProxiesMutex.Lock()
+	defer tcpProxiesMutex.Unlock()
+	if _, found := tcpProxies[name]; found {
+		return nil, fmt.Errorf("TCP proxy %s already exists", name)
+	}
+
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &TCPProxy{
+		Name:          name,
+		ListenAddress: listener.Addr().String(),
+		Target:        target,
+		listener:      listener,
+		faults:        faults,
+		settings:      settings,
+		connections:   make(map[net.Conn]net.Conn),
+	}
+	tcpProxies[name] = proxy
+	go proxy.acceptConnections()
+	return proxy, nil
+}
+
+// GetTCPProxy returns the named proxy, or nil if there isn't one
+func GetTCPProxy(name string) *TCPProxy {
+	tcpProxiesMutex.Lock()
+	defer tcpProxiesMutex.Unlock()
+	return tcpProxies[name]
+}
+
+// ListTCPProxies returns the status of every running proxy, sorted by name
+func ListTCPProxies() []TCPProxyStatus {
+	tcpProxiesMutex.Lock()
+	defer tcpProxiesMutex.Unlock()
+
+	statuses := make([]TCPProxyStatus, 0, len(tcpProxies))
+	for _, proxy := range tcpProxies {
+		statuses = append(statuses, proxy.Status())
+	}
+	sort.Slice(statuses, func(a, b int) bool { return statuses[a].Name < statuses[b].Name })
+	return statuses
+}
+
+// StopTCPProxy closes the named proxy along with all of its connections
+func StopTCPProxy(name string) error {
+	tcpProxiesMutex.Lock()
+	proxy, found := tcpProxies[name]
+	delete(tcpProxies, name)
+	tcpProxiesMutex.Unlock()
+
+	if !found {
+		return fmt.Errorf("No TCP proxy named %s", name)
+	}
+	return proxy.close()
+}
+
+// SetFaults replaces the proxy's faults. Open connections pick them up straight away
+func (proxy *TCPProxy) SetFaults(faults []string) error {
+	settings, err := parseConnectionFaultSettings(faults)
+	if err != nil {
+		return err
+	}
+
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	proxy.faults = faults
+	proxy.settings = settings
+	return nil
+}
+
+// Status describes the proxy as it is right now
+func (proxy *TCPProxy) Status() TCPProxyStatus {
+	proxy.mutex.RLock()
+	defer proxy.mutex.RUnlock()
+	return TCPProxyStatus{
+		Name:              proxy.Name,
+		ListenAddress:     proxy.ListenAddress,
+		Target:            proxy.Target,
+		Faults:            append([]string{}, proxy.faults...),
+		ActiveConnections: len(proxy.connections),
+	}
+}
+
+func (proxy *TCPProxy) currentSettings() connectionFaultSettings {
+	proxy.mutex.RLock()
+	defer proxy.mutex.RUnlock()
+	return proxy.settings
+}
+
+func (proxy *TCPProxy) acceptConnections() {
+	for {
+		client, err := proxy.listener.Accept()
+		if err != nil {
+			// the listener was closed
+			return
+		}
+		go proxy.handleConnection(client)
+	}
+}
+
+// handleConnection connects client to the target and passes data between them
+func (proxy *TCPProxy) handleConnection(client net.Conn) {
+	settings := proxy.currentSettings()
+	if settings.shouldRefuse() {
+		resetConnection(client)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", proxy.Target, proxyConfig.ConnectTimeout)
+	if err != nil {
+		// the client sees the same thing it would if the target were down
+		resetConnection(client)
+		return
+	}
+
+	proxy.track(client, upstream)
+	defer proxy.untrack(client)
+	tunnelWithFaults(client, upstream, proxy.currentSettings)
+}
+
+func (proxy *TCPProxy) track(client, upstream net.Conn) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	proxy.connections[client] = upstream
+}
+
+func (proxy *TCPProxy) untrack(client net.Conn) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	delete(proxy.connections, client)
+}
+
+func (proxy *TCPProxy) close() error {
+	err := proxy.listener.Close()
+
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	for client, upstream := range proxy.connections {
+		client.Close()
+		upstream.Close()
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package badness
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPProxy(test *testing.T) {
+	echo := newEchoListener(test)
+	defer echo.Close()
+
+	proxy, err := StartTCPProxy("echo", "127.0.0.1:0", echo.Addr().String(), nil)
+	if err != nil {
+		test.Fatalf("Could not start proxy: %v", err)
+	}
+	defer StopTCPProxy("echo")
+
+	if _, err := StartTCPProxy("echo", "127.0.0.1:0", echo.Addr().String(), nil); err == nil {
+		test.Errorf("Expected a second proxy with the same name to be rejected")
+	}
+
+	conn, err := net.Dial("tcp", proxy.ListenAddress)
+	if err != nil {
+		test.Fatalf("Could not connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("hello"))
+	echoed := make([]byte, 5)
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "hello" {
+		test.Fatalf("Expected the data to be echoed, got %s %v", echoed, err)
+	}
+
+	// faults apply to connections that are already open
+	if err := proxy.SetFaults([]string{"downstream-corrupt=100"}); err != nil {
+		test.Fatalf("Could not set faults: %v", err)
+	}
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) == "hello" {
+		test.Errorf("Expected the echo to be corrupted, got %s %v", echoed, err)
+	}
+
+	if status := proxy.Status(); status.ActiveConnections != 1 || status.Faults[0] != "downstream-corrupt=100" {
+		test.Errorf("Unexpected status %+v", status)
+	}
+
+	proxy.SetFaults([]string{"refuse"})
+	refused, err := net.Dial("tcp", proxy.ListenAddress)
+	if err != nil {
+		test.Fatalf("Could not connect to proxy: %v", err)
+	}
+	refused.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(refused); err == nil {
+		test.Errorf("Expected a refused connection to be reset")
+	}
+	refused.Close()
+
+	if err := StopTCPProxy("echo"); err != nil {
+		test.Errorf("Could not stop proxy: %v", err)
+	}
+	if GetTCPProxy("echo") != nil || len(ListTCPProxies()) != 0 {
+		test.Errorf("Expected the proxy to be gone")
+	}
+}
+
+func TestTCPProxyHalfOpen(test *testing.T) {
+	// the target closes every connection straight away
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	proxy, err := StartTCPProxy("closing", "127.0.0.1:0", listener.Addr().String(), []string{"half-open"})
+	if err != nil {
+		test.Fatalf("Could not start proxy: %v", err)
+	}
+	defer StopTCPProxy("closing")
+
+	conn, err := net.Dial("tcp", proxy.ListenAddress)
+	if err != nil {
+		test.Fatalf("Could not connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, isNetErr := err.(net.Error); !isNetErr || !netErr.Timeout() {
+		test.Errorf("Expected the connection to stay open after the target closed, got %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package badness
+
+// Upstream pools. A pool is a named group of upstreams that X-Proxy-To-Pool balances requests across.
+// Each member can have its own bad-server headers, so a single member can be made slow or broken
+// while the rest behave, the way a partially degraded fleet does. Pools are set up through the
+// admin server, which also reports each member's hit count and health.
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProxyPool names the pool to proxy the request to
+const ProxyPool = "X-Proxy-To-Pool"
+
+// members are marked unhealthy after this many failures in a row
+const unhealthyAfterFailures = 3
+
+const balanceRoundRobin = "round-robin"
+const balanceRandom = "random"
+
+// PoolMemberConfig is one upstream in a pool
+type PoolMemberConfig struct {
+	URL string `json:"url"`
+	// bad-server headers applied to requests sent to this member. They override the request's own
+	Headers http.Header `json:"headers,omitempty"`
+}
+
+// PoolConfig describes a pool of upstreams
+type PoolConfig struct {
+	// round-robin (the default) or random
+	Balance string `json:"balance"`
+	// if set, unhealthy members only get requests when no member is healthy
+	SkipUnhealthy bool               `json:"skipUnhealthy"`
+	Members       []PoolMemberConfig `json:"members"`
+}
+
+// PoolMemberStatus reports how a pool member has been doing
+type PoolMemberStatus struct {
+	PoolMemberConfig
+	Hits                int64 `json:"hits"`
+	Failures            int64 `json:"failures"`
+	ConsecutiveFailures int   `json:"consecutiveFailures"`
+	Healthy             bool  `json:"healthy"`
+	// the status of the member's last response. 0 if it isn't known, because the member's headers took over
+	// the connection
+	LastStatus int `json:"lastStatus"`
+}
+
+// PoolStatus reports on a pool and all of its members
+type PoolStatus struct {
+	Name          string             `json:"name"`
+	Balance       string             `json:"balance"`
+	SkipUnhealthy bool               `json:"skipUnhealthy"`
+	Members       []PoolMemberStatus `json:"members"`
+}
+
+type upstreamPool struct {
+	name          string
+	balance       string
+	skipUnhealthy bool
+	members       []*PoolMemberStatus
+	next          int
+}
+
+var pools = make(map[string]*upstreamPool)
+
+// guards pools, and everything in them
+var poolsMutex sync.Mutex
+
+// SetPool creates or replaces the named pool. Members that were already in the pool with the same URL
+// keep their hit counts and health
+func SetPool(name string, config PoolConfig) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid pool name %q", name)
+	}
+	switch config.Balance {
+	case "":
+		config.Balance = balanceRoundRobin
+	case balanceRoundRobin, balanceRandom:
+	default:
+		return fmt.Errorf("Unknown balance %s. Use %s or %s", config.Balance, balanceRoundRobin, balanceRandom)
+	}
+	if len(config.Members) == 0 {
+		return fmt.Errorf("Pool %s needs at least one member", name)
+	}
+
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
+
+	previous := make(map[string]*PoolMemberStatus)
+	if existing, found := pools[name]; found {
+		for _, member := range existing.members {
+			previous[member.URL] = member
+		}
+	}
+
+	pool := &upstreamPool{name: name, balance: config.Balance, skipUnhealthy: config.SkipUnhealthy}
+	for _, memberConfig := range config.Members {
+		if _, err := url.Parse(memberConfig.URL); err != nil || memberConfig.URL == "" {
+			return fmt.Errorf("Invalid member URL %q", memberConfig.URL)
+		}
+
+		member := &PoolMemberStatus{PoolMemberConfig: memberConfig, Healthy: true}
+		if existing, found := previous[memberConfig.URL]; found {
+			member.Hits = existing.Hits
+			member.Failures = existing.Failures
+			member.ConsecutiveFailures = existing.ConsecutiveFailures
+			member.Healthy = existing.Healthy
+			member.LastStatus = existing.LastStatus
+		}
+		pool.members = append(pool.members, member)
+	}
+	pools[name] = pool
+	return nil
+}
+
+// GetPool reports on the named pool
+func GetPool(name string) (PoolStatus, bool) {
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
+
+	pool, found := pools[name]
+	if !found {
+		return PoolStatus{}, false
+	}
+	return pool.status(), true
+}
+
+// ListPools reports on every pool, sorted by name
+func ListPools() []PoolStatus {
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
+
+	statuses := make([]PoolStatus, 0, len(pools))
+	for _, pool := range pools {
+		statuses = append(statuses, pool.status())
+	}
+	sort.Slice(statuses, func(a, b int) bool { return statuses[a].Name < statuses[b].Name })
+	return statuses
+}
+
+// DeletePool removes the named pool
+func DeletePool(name string) error {
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
+
+	if _, found := pools[name]; !found {
+		return fmt.Errorf("No pool named %s", name)
+	}
+	delete(pools, name)
+	return nil
+}
+
+// status copies the pool's current state. poolsMutex must be held
+func (pool *upstreamPool) status() PoolStatus {
+	status := PoolStatus{Name: pool.name, Balance: pool.balance, SkipUnhealthy: pool.skipUnhealthy}
+	for _, member := range pool.members {
+		status.Members = append(status.Members, *member)
+	}
+	return status
+}
+
+// choose picks the member for the next request. poolsMutex must be held
+func (pool *upstreamPool) choose() *PoolMemberStatus {
+	candidates := pool.members
+	if pool.skipUnhealthy {
+		healthy := make([]*PoolMemberStatus, 0, len(candidates))
+		for _, member := range candidates {
+			if member.Healthy {
+				healthy = append(healthy, member)
+			}
+		}
+		if len(healthy) > 0 {
+			candidates = healthy
+		}
+	}
+
+	if pool.balance == balanceRandom {
+		return candidates[rand.Intn(len(candidates))]
+	}
+	pool.next++
+	return candidates[(pool.next-1)%len(candidates)]
+}
+
+// applyPoolMember picks a member of the pool named in request's X-Proxy-To-Pool header, and
+// points request at it. It returns a function that records how the member's response went
+func applyPoolMember(request *http.Request) (func(status int), error) {
+	name := getFirstHeaderValue(request, ProxyPool)
+	request.Header.Del(ProxyPool)
+
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
+
+	pool, found := pools[name]
+	if !found {
+		return nil, fmt.Errorf("No pool named %s", name)
+	}
+	member := pool.choose()
+	member.Hits++
+
+	request.Header.Set(ProxyRequest, member.URL)
+	for header, values := range member.Headers {
+		request.Header[http.CanonicalHeaderKey(header)] = values
+	}
+
+	return func(status int) {
+		poolsMutex.Lock()
+		defer poolsMutex.Unlock()
+
+		member.LastStatus = status
+		// a response that can't be seen doesn't count either way
+		if status == unknownStatus {
+			return
+		}
+		if status >= 500 {
+			member.Failures++
+			member.ConsecutiveFailures++
+			if member.ConsecutiveFailures >= unhealthyAfterFailures {
+				member.Healthy = false
+			}
+		} else {
+			member.ConsecutiveFailures = 0
+			member.Healthy = true
+		}
+	}, nil
+}
+
+// recorded for a member when its response was written straight to a hijacked connection
+const unknownStatus = 0
+
+// upstreamStatusRecorder is implemented by ResponseWriters that want the status the upstream sent,
+// before anything in the pipeline changed it
+type upstreamStatusRecorder interface {
+	recordUpstreamStatus(status int)
+}
+
+// statusRecordingWriter remembers the status written to the ResponseWriter it wraps, and the status
+// the upstream sent if the response was proxied
+type statusRecordingWriter struct {
+	http.ResponseWriter
+	status         int
+	upstreamStatus int
+	hijacked       bool
+}
+
+func (writer *statusRecordingWriter) recordUpstreamStatus(status int) {
+	writer.upstreamStatus = status
+}
+
+func (writer *statusRecordingWriter) WriteHeader(statusCode int) {
+	// like a real ResponseWriter, only the first status counts
+	if writer.status == 0 {
+		writer.status = statusCode
+	}
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (writer *statusRecordingWriter) Write(buffer []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	return writer.ResponseWriter.Write(buffer)
+}
+
+func (writer *statusRecordingWriter) Flush() {
+	if flusher, canFlush := writer.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes on the connection underneath, for members whose headers write raw responses or
+// websockets. Nothing written to it goes through WriteHeader, so the status isn't known
+func (writer *statusRecordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, canHijack := writer.ResponseWriter.(http.Hijacker)
+	if !canHijack {
+		return nil, nil, fmt.Errorf("Connection can't be hijacked")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err == nil {
+		writer.hijacked = true
+	}
+	return conn, buffered, err
+}
+
+// buildPoolPipeline runs pipeline, then passes the member's status to record. That's the status the
+// upstream sent, since the member's headers can change what the client gets. If the member's headers
+// answer without going to the upstream, it's the status the client got
+func buildPoolPipeline(pipeline []ResponseHandler, record func(status int)) ResponseHandler {
+	return func(response http.ResponseWriter) error {
+		writer := &statusRecordingWriter{ResponseWriter: response}
+		// nothing written at all is still a 200 as far as the client's concerned
+		defer func() {
+			if writer.upstreamStatus != 0 {
+				record(writer.upstreamStatus)
+				return
+			}
+			if writer.hijacked {
+				record(unknownStatus)
+				return
+			}
+			if writer.status == 0 {
+				writer.status = http.StatusOK
+			}
+			record(writer.status)
+		}()
+
+		for _, handler := range pipeline {
+			handler(writer)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,113 @@
+package badness
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPool(test *testing.T) {
+	newMember := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.WriteHeader(status)
+			response.Write([]byte(name))
+		}))
+	}
+	good, bad, masked := newMember("good", http.StatusOK), newMember("bad", http.StatusServiceUnavailable), newMember("masked", http.StatusOK)
+	defer good.Close()
+	defer bad.Close()
+	defer masked.Close()
+
+	// the masked member is fine, but its headers make clients see a 503
+	members := []PoolMemberConfig{
+		{URL: good.URL},
+		{URL: bad.URL},
+		{URL: masked.URL, Headers: http.Header{"x-response-code-histogram": []string{"503"}}},
+	}
+	if err := SetPool("fleet", PoolConfig{Members: members}); err != nil {
+		test.Fatalf("Could not set up pool: %v", err)
+	}
+	defer DeletePool("fleet")
+
+	bodies := make(map[string]int)
+	for attempt := 0; attempt < 9; attempt++ {
+		request := makeTestRequest()
+		request.Header[ProxyPool] = []string{"fleet"}
+		response := runPipeline(request)
+		body, _ := ioutil.ReadAll(response.Body)
+		bodies[string(body)]++
+
+		if string(body) == "masked" && response.StatusCode != http.StatusServiceUnavailable {
+			test.Errorf("Expected the masked member's headers to apply, got %d", response.StatusCode)
+		}
+	}
+	if bodies["good"] != 3 || bodies["bad"] != 3 || bodies["masked"] != 3 {
+		test.Errorf("Expected round-robin to split requests evenly, got %v", bodies)
+	}
+
+	status, _ := GetPool("fleet")
+	if status.Members[0].Hits != 3 || !status.Members[0].Healthy || status.Members[0].LastStatus != http.StatusOK {
+		test.Errorf("Unexpected status for the good member: %+v", status.Members[0])
+	}
+	if status.Members[1].Failures != 3 || status.Members[1].Healthy || status.Members[1].LastStatus != http.StatusServiceUnavailable {
+		test.Errorf("Expected the bad member to be unhealthy: %+v", status.Members[1])
+	}
+	// health follows what the upstream sent, not what the member's headers turned it into
+	if status.Members[2].Failures != 0 || !status.Members[2].Healthy || status.Members[2].LastStatus != http.StatusOK {
+		test.Errorf("Expected the masked member to be healthy: %+v", status.Members[2])
+	}
+
+	// once it's unhealthy, the bad member can be skipped
+	SetPool("fleet", PoolConfig{SkipUnhealthy: true, Members: members[:2]})
+	for attempt := 0; attempt < 4; attempt++ {
+		request := makeTestRequest()
+		request.Header[ProxyPool] = []string{"fleet"}
+		if body, _ := ioutil.ReadAll(runPipeline(request).Body); string(body) != "good" {
+			test.Errorf("Expected only the healthy member to be used, got %s", body)
+		}
+	}
+
+	request := makeTestRequest()
+	request.Header[ProxyPool] = []string{"missing"}
+	if response := runPipeline(request); response.StatusCode != http.StatusBadRequest {
+		test.Errorf("Expected an unknown pool to be rejected, got %d", response.StatusCode)
+	}
+
+	if err := SetPool("fleet", PoolConfig{Balance: "sideways", Members: []PoolMemberConfig{{URL: good.URL}}}); err == nil {
+		test.Errorf("Expected an unknown balance to be rejected")
+	}
+}
+
+func TestPoolMemberHijacks(test *testing.T) {
+	server := newPipelineServer()
+	defer server.Close()
+
+	// the member is never contacted, since its raw response is written straight to the client
+	err := SetPool("raw", PoolConfig{Members: []PoolMemberConfig{
+		{URL: "http://localhost:1", Headers: http.Header{"x-raw-response": []string{"http10"}}},
+	}})
+	if err != nil {
+		test.Fatalf("Could not set up pool: %v", err)
+	}
+	defer DeletePool("raw")
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set(ProxyPool, "raw")
+	client := &http.Client{Timeout: time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		test.Fatalf("Request failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.Proto != "HTTP/1.0" || response.StatusCode != http.StatusOK {
+		test.Errorf("Expected the member's raw response, got %s %d %s", response.Proto, response.StatusCode, body)
+	}
+
+	status, _ := GetPool("raw")
+	if member := status.Members[0]; member.Hits != 1 || member.LastStatus != unknownStatus || member.Failures != 0 || !member.Healthy {
+		test.Errorf("Expected a hit with an unknown status, got %+v", member)
+	}
+}
@@ -1,6 +1,7 @@
 package badness
 
 import (
+	"fmt"
 	"math"
 	"net/http"
 	"net/http/httptest"
@@ -98,6 +99,18 @@ func stringToDuration(toParse string) (time.Duration, error) {
 	return time.Duration(0), durationErr
 }
 
+// parsePercentage converts a 0-100 string into a 0-1 probability
+func parsePercentage(value string) (float64, error) {
+	percentage, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if percentage < 0 || percentage > 100 {
+		return 0, fmt.Errorf("percentage must be 0-100")
+	}
+	return percentage / 100.0, nil
+}
+
 // anyAreNil dtermines if any of the passed-in objects are nil. Returns true
 // if at least one is, false otherwise.
 func anyAreNil(items ...interface{}) bool {
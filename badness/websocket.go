@@ -0,0 +1,420 @@
+package badness
+
+// WebSockets. X-Websocket upgrades the connection (RFC 6455) and then echoes messages
+// back, or answers them with documents from the X-Random-Json template, while breaking
+// the protocol in the ways requested. Only the standard library is used, so the
+// handshake and framing are done by hand.
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const WebSocket = "X-Websocket"
+
+// WebSocketDelays uses the same syntax as X-Random-Delays to delay each outgoing message
+const WebSocketDelays = "X-Websocket-Delays"
+
+// from RFC 6455, used to compute Sec-WebSocket-Accept
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	continuationFrame byte = 0x0
+	textFrame         byte = 0x1
+	binaryFrame       byte = 0x2
+	closeFrame        byte = 0x8
+	pingFrame         byte = 0x9
+	pongFrame         byte = 0xA
+)
+
+// opcodes that RFC 6455 reserves, and so should never be seen by a client
+var reservedOpcodes = []byte{0x3, 0x4, 0x5, 0x6, 0x7, 0xB, 0xC, 0xD, 0xE, 0xF}
+
+const (
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	// the range of close codes that can be sent in a close frame
+	minCloseCode = 1000
+	maxCloseCode = 4999
+)
+
+// the largest frame that's read or written. Clients have no reason to send anything this big, and
+// oversized messages are allocated in full, so they can't be any bigger either
+const maxFrameSize = 64 * 1024 * 1024
+
+const (
+	echoMode = "echo"
+	jsonMode = "json"
+)
+
+type webSocketSettings struct {
+	mode      string
+	badAccept bool
+	// probabilities (0-1) of breaking an outgoing message
+	invalidOpcodeProbability float64
+	oversizedProbability     float64
+	maskProbability          float64
+	dropPongProbability      float64
+	// size in bytes of an oversized message
+	oversizedSize int
+	// close the connection after this many messages. 0 never closes
+	closeAfter int
+	// the code to send when closing early. If 0, the connection is dropped without a close frame
+	closeCode int
+}
+
+// parseWebSocketSettings reads the comma-separated key=value options in the X-Websocket header.
+// percentages are passed in as 0-100
+func parseWebSocketSettings(headerValues []string) (webSocketSettings, error) {
+	settings := webSocketSettings{mode: echoMode, oversizedSize: 16 * 1024 * 1024, closeCode: closeNormal}
+
+	for key, value := range parseHeadersWithKeyValues(headerValues, ",") {
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "":
+			continue
+		case "mode":
+			if value != echoMode && value != jsonMode {
+				err = fmt.Errorf("mode must be %s or %s", echoMode, jsonMode)
+			}
+			settings.mode = value
+		case "accept":
+			settings.badAccept = value == "bad"
+		case "invalid-opcode":
+			settings.invalidOpcodeProbability, err = parsePercentage(value)
+		case "oversized":
+			settings.oversizedProbability, err = parsePercentage(value)
+		case "oversized-size":
+			settings.oversizedSize, err = strconv.Atoi(value)
+			if err == nil && (settings.oversizedSize < 0 || settings.oversizedSize > maxFrameSize) {
+				err = fmt.Errorf("size must be 0-%d", maxFrameSize)
+			}
+		case "mask":
+			settings.maskProbability, err = parsePercentage(value)
+		case "drop-pong":
+			settings.dropPongProbability, err = parsePercentage(value)
+		case "close-after":
+			settings.closeAfter, err = strconv.Atoi(value)
+		case "close-code":
+			if value == "none" {
+				settings.closeCode = 0
+			} else {
+				settings.closeCode, err = strconv.Atoi(value)
+				if err == nil && (settings.closeCode < minCloseCode || settings.closeCode > maxCloseCode) {
+					err = fmt.Errorf("code must be %d-%d or none", minCloseCode, maxCloseCode)
+				}
+			}
+		default:
+			err = fmt.Errorf("Unknown option")
+		}
+
+		if err != nil {
+			return settings, fmt.Errorf("Invalid %s option %s=%s: %v", WebSocket, key, value, err)
+		}
+	}
+	return settings, nil
+}
+
+// computeAcceptKey calculates the Sec-WebSocket-Accept value for a Sec-WebSocket-Key
+func computeAcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+type webSocketFrame struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+// readWebSocketFrame reads a single frame, unmasking its payload if needed
+func readWebSocketFrame(reader io.Reader) (webSocketFrame, error) {
+	var frame webSocketFrame
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return frame, err
+	}
+
+	frame.fin = header[0]&0x80 != 0
+	frame.opcode = header[0] & 0x0F
+	frame.masked = header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			return frame, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			return frame, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	if length > maxFrameSize {
+		return frame, fmt.Errorf("Frame of %d bytes is too large", length)
+	}
+
+	var maskKey []byte
+	if frame.masked {
+		maskKey = make([]byte, 4)
+		if _, err := io.ReadFull(reader, maskKey); err != nil {
+			return frame, err
+		}
+	}
+
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, frame.payload); err != nil {
+		return frame, err
+	}
+
+	if frame.masked {
+		maskBytes(frame.payload, maskKey)
+	}
+	return frame, nil
+}
+
+// writeWebSocketFrame writes a single frame. Servers aren't supposed to mask frames,
+// but masked can be set to do it anyway
+func writeWebSocketFrame(writer io.Writer, frame webSocketFrame) error {
+	var buffer bytes.Buffer
+
+	firstByte := frame.opcode & 0x0F
+	if frame.fin {
+		firstByte |= 0x80
+	}
+	buffer.WriteByte(firstByte)
+
+	var maskBit byte
+	if frame.masked {
+		maskBit = 0x80
+	}
+
+	length := len(frame.payload)
+	switch {
+	case length < 126:
+		buffer.WriteByte(maskBit | byte(length))
+	case length <= 0xFFFF:
+		buffer.WriteByte(maskBit | 126)
+		binary.Write(&buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(maskBit | 127)
+		binary.Write(&buffer, binary.BigEndian, uint64(length))
+	}
+
+	payload := frame.payload
+	if frame.masked {
+		maskKey := make([]byte, 4)
+		rand.Read(maskKey)
+		buffer.Write(maskKey)
+
+		payload = make([]byte, length)
+		copy(payload, frame.payload)
+		maskBytes(payload, maskKey)
+	}
+	buffer.Write(payload)
+
+	_, err := writer.Write(buffer.Bytes())
+	return err
+}
+
+// maskBytes applies (or removes) a websocket mask in place
+func maskBytes(payload []byte, maskKey []byte) {
+	for index := range payload {
+		payload[index] ^= maskKey[index%4]
+	}
+}
+
+// closePayload builds the body of a close frame
+func closePayload(code int, reason string) []byte {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return append(payload, []byte(reason)...)
+}
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+type webSocketSession struct {
+	settings webSocketSettings
+	conn     net.Conn
+	reader   *bufio.Reader
+	// used in json mode to create replies
+	generator jsonElementGenerator
+	// nil if there's no X-Websocket-Delays header
+	delays       *randomLagginessAffector
+	messagesSent int
+}
+
+// run reads frames from the client until the connection closes, replying as configured
+func (session *webSocketSession) run() error {
+	var message bytes.Buffer
+	var messageOpcode byte
+
+	for {
+		frame, err := readWebSocketFrame(session.reader)
+		if err != nil {
+			return err
+		}
+
+		if !frame.masked {
+			// RFC 6455 requires clients to mask everything they send
+			return session.close(closeProtocolError, "client frames must be masked")
+		}
+
+		switch frame.opcode {
+		case textFrame, binaryFrame, continuationFrame:
+			if frame.opcode != continuationFrame {
+				message.Reset()
+				messageOpcode = frame.opcode
+			}
+			message.Write(frame.payload)
+			if !frame.fin {
+				continue
+			}
+
+			if err := session.reply(messageOpcode, message.Bytes()); err != nil {
+				return err
+			}
+		case pingFrame:
+			if rand.Float64() < session.settings.dropPongProbability {
+				continue
+			}
+			if err := writeWebSocketFrame(session.conn, webSocketFrame{fin: true, opcode: pongFrame, payload: frame.payload}); err != nil {
+				return err
+			}
+		case pongFrame:
+			continue
+		case closeFrame:
+			// echo the client's close back and hang up
+			writeWebSocketFrame(session.conn, webSocketFrame{fin: true, opcode: closeFrame, payload: frame.payload})
+			return nil
+		default:
+			return session.close(closeProtocolError, "unknown opcode")
+		}
+	}
+}
+
+// reply answers a complete message from the client
+func (session *webSocketSession) reply(opcode byte, message []byte) error {
+	settings := session.settings
+
+	if settings.closeAfter > 0 && session.messagesSent >= settings.closeAfter {
+		return session.close(settings.closeCode, "closing early")
+	}
+
+	if session.delays != nil {
+		time.Sleep(session.delays.nextDelay())
+	}
+
+	payload := message
+	if settings.mode == jsonMode {
+		var generated bytes.Buffer
+		if _, err := session.generator.generate(&generated); err != nil {
+			return err
+		}
+		opcode = textFrame
+		payload = generated.Bytes()
+	}
+
+	if rand.Float64() < settings.oversizedProbability {
+		payload = bytes.Repeat([]byte{'x'}, settings.oversizedSize)
+	}
+
+	if rand.Float64() < settings.invalidOpcodeProbability {
+		opcode = reservedOpcodes[rand.Intn(len(reservedOpcodes))]
+	}
+
+	masked := rand.Float64() < settings.maskProbability
+
+	session.messagesSent++
+	return writeWebSocketFrame(session.conn, webSocketFrame{fin: true, opcode: opcode, masked: masked, payload: payload})
+}
+
+// close sends a close frame with code (or nothing at all if code is 0) and stops the session
+func (session *webSocketSession) close(code int, reason string) error {
+	if code != 0 {
+		writeWebSocketFrame(session.conn, webSocketFrame{fin: true, opcode: closeFrame, payload: closePayload(code, reason)})
+	}
+	return errWebSocketClosed
+}
+
+// isWebSocketUpgrade checks that request is asking to be upgraded to a websocket
+func isWebSocketUpgrade(request *http.Request) bool {
+	return strings.EqualFold(request.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(request.Header.Get("Connection")), "upgrade") &&
+		request.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+// buildWebSocketHandler returns a ResponseHandler that takes over the connection
+// and speaks (bad) websocket on it
+func buildWebSocketHandler(request *http.Request) ResponseHandler {
+	settings, err := parseWebSocketSettings(request.Header[WebSocket])
+	if err != nil {
+		return generateBadResponseHandler(err.Error())
+	}
+
+	if !isWebSocketUpgrade(request) {
+		return generateBadResponseHandler(fmt.Sprintf("%s requires a websocket upgrade request", WebSocket))
+	}
+
+	session := &webSocketSession{settings: settings}
+	if settings.mode == jsonMode {
+		session.generator = getJsonTemplateGenerator(request)
+	}
+	if requestHasHeader(request, WebSocketDelays) {
+		session.delays = &randomLagginessAffector{nil, buildLagginessHistogram(request.Header[WebSocketDelays])}
+	}
+
+	acceptKey := computeAcceptKey(request.Header.Get("Sec-WebSocket-Key"))
+	if settings.badAccept {
+		acceptKey = computeAcceptKey(request.Header.Get("Sec-WebSocket-Key") + "bad")
+	}
+
+	return func(response http.ResponseWriter) error {
+		hijacker, canHijack := response.(http.Hijacker)
+		if !canHijack {
+			return generateBadResponseHandler("Connection can't be upgraded")(response)
+		}
+
+		conn, buffered, err := hijacker.Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + acceptKey + "\r\n\r\n"
+		if _, err := conn.Write([]byte(handshake)); err != nil {
+			return err
+		}
+
+		session.conn = conn
+		session.reader = buffered.Reader
+		err = session.run()
+		if err == errWebSocketClosed || err == io.EOF {
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,172 @@
+package badness
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestComputeAcceptKey(test *testing.T) {
+	// the example from RFC 6455
+	accept := computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	if accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		test.Errorf("Unexpected accept key %s", accept)
+	}
+}
+
+func TestWebSocketFrameRoundTrip(test *testing.T) {
+	payloads := [][]byte{[]byte("short"), bytes.Repeat([]byte{'a'}, 300), bytes.Repeat([]byte{'b'}, 70000)}
+
+	for index, payload := range payloads {
+		for _, masked := range []bool{true, false} {
+			var buffer bytes.Buffer
+			err := writeWebSocketFrame(&buffer, webSocketFrame{fin: true, opcode: binaryFrame, masked: masked, payload: payload})
+			if err != nil {
+				test.Fatalf("Test %d: Unexpected error writing frame: %v", index, err)
+			}
+
+			frame, err := readWebSocketFrame(&buffer)
+			if err != nil {
+				test.Fatalf("Test %d: Unexpected error reading frame: %v", index, err)
+			}
+
+			if !frame.fin || frame.opcode != binaryFrame || frame.masked != masked || !bytes.Equal(frame.payload, payload) {
+				test.Errorf("Test %d: frame did not survive the round trip", index)
+			}
+		}
+	}
+}
+
+func TestParseWebSocketSettings(test *testing.T) {
+	settings, err := parseWebSocketSettings([]string{"mode=json,accept=bad,drop-pong=100,close-after=3,close-code=none"})
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+	if settings.mode != jsonMode || !settings.badAccept || settings.closeAfter != 3 || settings.closeCode != 0 {
+		test.Errorf("Unexpected settings %v", settings)
+	}
+
+	for _, bad := range []string{"mode=shout", "mask=lots", "close-code=x", "oversized-size=-1", "oversized-size=2000000000", "close-code=70000", "close-code=-1", "close-code=999", "nonsense"} {
+		if _, err := parseWebSocketSettings([]string{bad}); err == nil {
+			test.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
+
+// dialWebSocket performs a handshake against server with the given X-WebSocket options
+func dialWebSocket(test *testing.T, server *httptest.Server, options string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		test.Fatalf("Could not connect: %v", err)
+	}
+
+	handshake := "GET / HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		WebSocket + ": " + options + "\r\n\r\n"
+	conn.Write([]byte(handshake))
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		test.Fatalf("Could not read handshake response: %v", err)
+	}
+	return conn, reader, response
+}
+
+func newPipelineServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		for _, handler := range GetResponsePipeline(request) {
+			handler(response)
+		}
+	}))
+}
+
+func TestWebSocketEcho(test *testing.T) {
+	server := newPipelineServer()
+	defer server.Close()
+
+	conn, reader, response := dialWebSocket(test, server, "mode=echo,close-after=1,close-code=1011")
+	defer conn.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		test.Fatalf("Expected 101 but got %d", response.StatusCode)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		test.Errorf("Unexpected accept key %s", response.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	writeWebSocketFrame(conn, webSocketFrame{fin: true, opcode: textFrame, masked: true, payload: []byte("hello")})
+	frame, err := readWebSocketFrame(reader)
+	if err != nil || frame.opcode != textFrame || string(frame.payload) != "hello" {
+		test.Fatalf("Expected an echo of hello, got %v (%v)", frame, err)
+	}
+
+	// the second message should get the early close
+	writeWebSocketFrame(conn, webSocketFrame{fin: true, opcode: textFrame, masked: true, payload: []byte("again")})
+	frame, err = readWebSocketFrame(reader)
+	if err != nil || frame.opcode != closeFrame || !bytes.Equal(frame.payload[0:2], closePayload(1011, "")) {
+		test.Fatalf("Expected a 1011 close frame, got %v (%v)", frame, err)
+	}
+}
+
+func TestWebSocketFaults(test *testing.T) {
+	server := newPipelineServer()
+	defer server.Close()
+
+	conn, reader, response := dialWebSocket(test, server, "accept=bad,invalid-opcode=100,mask=100")
+	defer conn.Close()
+
+	if response.Header.Get("Sec-WebSocket-Accept") == "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		test.Errorf("Expected a bad accept key")
+	}
+
+	writeWebSocketFrame(conn, webSocketFrame{fin: true, opcode: textFrame, masked: true, payload: []byte("hello")})
+	frame, err := readWebSocketFrame(reader)
+	if err != nil {
+		test.Fatalf("Unexpected error: %v", err)
+	}
+	if !frame.masked || !bytes.Contains(reservedOpcodes, []byte{frame.opcode}) {
+		test.Errorf("Expected a masked frame with a reserved opcode, got %v", frame)
+	}
+	if string(frame.payload) != "hello" {
+		test.Errorf("Expected hello but got %s", string(frame.payload))
+	}
+}
+
+func TestWebSocketJson(test *testing.T) {
+	server := newPipelineServer()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		test.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: abc\r\n" + WebSocket + ": mode=json\r\n" + RandomJson + ": response_template=[int|5]:3\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	http.ReadResponse(reader, nil)
+
+	writeWebSocketFrame(conn, webSocketFrame{fin: true, opcode: textFrame, masked: true, payload: []byte("anything")})
+	frame, err := readWebSocketFrame(reader)
+	if err != nil || string(frame.payload) != "[5,5,5]" {
+		test.Errorf("Expected generated json but got %v (%v)", frame, err)
+	}
+}
+
+func TestWebSocketRequiresUpgrade(test *testing.T) {
+	request := makeTestRequest()
+	request.Header[WebSocket] = []string{""}
+	response := runPipeline(request)
+	if response.StatusCode != http.StatusBadRequest {
+		test.Errorf("Expected 400 for a request that isn't an upgrade, got %d", response.StatusCode)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 
 	"bad-server/adminserver"
 	"bad-server/badness"
@@ -12,6 +14,9 @@ import (
 
 var port int
 var adminPort int
+var forwardProxyPort int
+var tcpProxies tcpProxyFlags
+var proxyConfig = badness.DefaultProxyConfig()
 
 type mainHandler struct{}
 
@@ -23,10 +28,35 @@ func (mainHandler) ServeHTTP(response http.ResponseWriter, request *http.Request
 	}
 }
 
+type forwardProxyHandler struct{}
+
+func (forwardProxyHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	// rules for the target host win over the global defaults
+	mergeHeadersToRequest(request, adminserver.GetHostHeaders(request.URL.Host))
+	mergeDefaultHeadersToRequest(request)
+	badness.ServeForwardProxy(response, request)
+}
+
+// tcpProxyFlags collects each -tcpProxy flag, in the form name|listenAddress|target|faults
+type tcpProxyFlags []string
+
+func (flags *tcpProxyFlags) String() string {
+	return strings.Join(*flags, " ")
+}
+
+func (flags *tcpProxyFlags) Set(value string) error {
+	if len(strings.SplitN(value, "|", 4)) < 3 {
+		return fmt.Errorf("expected name|listenAddress|target|faults, got %s", value)
+	}
+	*flags = append(*flags, value)
+	return nil
+}
+
 type adminHandler struct{}
 
+// admin requests only carry what the client sent. The default headers would otherwise end up in
+// whatever the request sets, such as a host's rules
 func (adminHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
-	mergeDefaultHeadersToRequest(request)
 	adminserver.RouteAdminCall(response, request)
 	defer request.Body.Close()
 }
@@ -34,10 +64,40 @@ func (adminHandler) ServeHTTP(response http.ResponseWriter, request *http.Reques
 func init() {
 	flag.IntVar(&port, "port", 7865, "The port to listen on")
 	flag.IntVar(&adminPort, "adminPort", 7866, "The port for admin functions")
+	flag.IntVar(&forwardProxyPort, "forwardProxyPort", 0, "The port to accept HTTP_PROXY/HTTPS_PROXY traffic on. 0 disables the forward proxy")
+
+	flag.Var(&tcpProxies, "tcpProxy", "A TCP proxy to start, as name|listenAddress|target|faults. faults use the X-Connection-Faults format and are optional. Can be repeated")
+
+	flag.DurationVar(&proxyConfig.ConnectTimeout, "proxyConnectTimeout", proxyConfig.ConnectTimeout, "How long to wait to connect to a proxied host")
+	flag.DurationVar(&proxyConfig.TLSHandshakeTimeout, "proxyTLSTimeout", proxyConfig.TLSHandshakeTimeout, "How long to wait for a TLS handshake with a proxied host")
+	flag.DurationVar(&proxyConfig.ResponseHeaderTimeout, "proxyResponseHeaderTimeout", proxyConfig.ResponseHeaderTimeout, "How long to wait for a proxied host's response headers")
+	flag.DurationVar(&proxyConfig.IdleConnTimeout, "proxyIdleTimeout", proxyConfig.IdleConnTimeout, "How long to keep idle connections to proxied hosts")
+	flag.IntVar(&proxyConfig.MaxIdleConnsPerHost, "proxyMaxIdlePerHost", proxyConfig.MaxIdleConnsPerHost, "How many idle connections to keep for each proxied host")
+	flag.BoolVar(&proxyConfig.InsecureSkipVerify, "proxyInsecure", proxyConfig.InsecureSkipVerify, "Skip verifying proxied hosts' TLS certificates")
+	flag.IntVar(&proxyConfig.ErrorStatus, "proxyErrorStatus", proxyConfig.ErrorStatus, "The status to send when a proxied request fails")
+	flag.IntVar(&proxyConfig.TimeoutStatus, "proxyTimeoutStatus", proxyConfig.TimeoutStatus, "The status to send when a proxied request times out")
+	flag.StringVar(&proxyConfig.CassetteDir, "cassetteDir", proxyConfig.CassetteDir, "The directory where recorded proxy responses are kept")
 }
 
 func main() {
 	flag.Parse()
+	if err := proxyConfig.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	badness.ConfigureProxy(proxyConfig)
+
+	for _, tcpProxy := range tcpProxies {
+		fields := strings.SplitN(tcpProxy, "|", 4)
+		var faults []string
+		if len(fields) == 4 {
+			faults = []string{fields[3]}
+		}
+		if _, err := badness.StartTCPProxy(fields[0], fields[1], fields[2], faults); err != nil {
+			log.Fatalf("Could not start TCP proxy %s: %v", fields[0], err)
+		}
+	}
 
 	// use different server multiplexers for each server, to avoid path conflicts
 	mainServerMux := http.NewServeMux()
@@ -46,15 +106,25 @@ func main() {
 		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), mainServerMux))
 	}()
 
+	if forwardProxyPort != 0 {
+		// no ServeMux here, since it would redirect CONNECT and absolute-form requests
+		go func() {
+			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", forwardProxyPort), &forwardProxyHandler{}))
+		}()
+	}
+
 	adminServerMux := http.NewServeMux()
 	adminServerMux.Handle("/", &adminHandler{})
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", adminPort), adminServerMux))
 }
 
 func mergeDefaultHeadersToRequest(request *http.Request) {
-	defaultHeaders := adminserver.GetCurrentHeaders()
+	mergeHeadersToRequest(request, adminserver.GetCurrentHeaders())
+}
 
-	for key, value := range defaultHeaders {
+// mergeHeadersToRequest adds headers to the request, unless it already has them
+func mergeHeadersToRequest(request *http.Request, headers map[string][]string) {
+	for key, value := range headers {
 		if _, found := request.Header[key]; !found {
 			request.Header[key] = value
 		}